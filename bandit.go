@@ -0,0 +1,430 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidBandit = errors.New("invalid bandit")
+
+const (
+	banditEpsilonGreedy         = "epsilonGreedy"
+	banditThompson              = "thompson"
+	defaultBanditEpsilon        = 10.0
+	defaultBanditUpdateInterval = 30 * time.Second
+	// thompsonDraws is the number of samples Thompson sampling estimates each
+	// backend's chance of being the best from.
+	thompsonDraws = 1000
+
+	rewardStatus           = "status"
+	rewardHeaderPrefix     = "header:"
+	rewardConversionPrefix = "conversion:"
+
+	// Bandit assignments are stored in the sticky assignment cookie under these
+	// prefixes and the group's path.
+	banditAssignmentPrefix = "bandit:"
+	banditConvertedPrefix  = "bandit-converted:"
+)
+
+// bandit is a multi-armed bandit over the backends of a rule group. Weights,
+// pulls and rewards are indexed by the backend's position in the group.
+type bandit struct {
+	// key is the group's path, path prefix or path pattern.
+	key            string
+	strategy       string
+	epsilon        float64
+	minWeight      float64
+	maxWeight      float64
+	interval       time.Duration
+	rewardHeader   string
+	conversionPath string
+	backends       []string
+	arms           []bool
+	mu             sync.Mutex
+	pulls, rewards []float64
+	weights        []float64
+	updated        time.Time
+}
+
+// banditConfigured reports whether a bandit is configured.
+func banditConfigured(cfg config.Bandit) bool {
+	return cfg != (config.Bandit{})
+}
+
+// validateBandit checks a rule's bandit settings.
+func (re *RuleEngine) validateBandit(rule RoutingRule) error {
+	if !banditConfigured(rule.Bandit) {
+		return nil
+	}
+	if _, err := newBandit(rule.Bandit, "", nil); err != nil {
+		return err
+	}
+	if rule.Percentage != 0 || rampConfigured(rule.Ramp) {
+		return fmt.Errorf("%w: percentage, ramp and bandit are mutually exclusive", errInvalidBandit)
+	}
+	if re.config.StickyAssignments.Secret == "" {
+		return fmt.Errorf("%w: stickyAssignments.secret is required to keep sessions on their backend", errInvalidBandit)
+	}
+	return nil
+}
+
+func newBandit(cfg config.Bandit, key string, backends []string) (*bandit, error) {
+	b := &bandit{
+		key:       key,
+		strategy:  cfg.Strategy,
+		epsilon:   cfg.Epsilon,
+		minWeight: cfg.MinWeight,
+		maxWeight: cfg.MaxWeight,
+		interval:  defaultBanditUpdateInterval,
+		backends:  backends,
+		arms:      make([]bool, len(backends)),
+		pulls:     make([]float64, len(backends)),
+		rewards:   make([]float64, len(backends)),
+		weights:   make([]float64, len(backends)),
+	}
+	if b.strategy != banditEpsilonGreedy && b.strategy != banditThompson {
+		return nil, fmt.Errorf("%w: strategy must be %s or %s", errInvalidBandit, banditEpsilonGreedy, banditThompson)
+	}
+	if b.epsilon == 0 {
+		b.epsilon = defaultBanditEpsilon
+	}
+	if b.maxWeight == 0 {
+		b.maxWeight = maxPercentage
+	}
+	if !validRampValue(b.epsilon) || !validRampValue(b.minWeight) || !validRampValue(b.maxWeight) || b.minWeight > b.maxWeight {
+		return nil, fmt.Errorf("%w: epsilon, minWeight and maxWeight must be between 0 and 100, with minWeight <= maxWeight", errInvalidBandit)
+	}
+	if cfg.UpdateInterval != "" {
+		d, err := time.ParseDuration(cfg.UpdateInterval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%w: updateInterval %q", errInvalidBandit, cfg.UpdateInterval)
+		}
+		b.interval = d
+	}
+	switch {
+	case cfg.Reward == rewardStatus:
+	case strings.HasPrefix(cfg.Reward, rewardHeaderPrefix) && len(cfg.Reward) > len(rewardHeaderPrefix):
+		b.rewardHeader = http.CanonicalHeaderKey(strings.TrimPrefix(cfg.Reward, rewardHeaderPrefix))
+	case strings.HasPrefix(cfg.Reward, rewardConversionPrefix+"/"):
+		b.conversionPath = strings.TrimPrefix(cfg.Reward, rewardConversionPrefix)
+	default:
+		return nil, fmt.Errorf("%w: reward must be status, header:<name> or conversion:<path>", errInvalidBandit)
+	}
+	return b, nil
+}
+
+// compileBandits turns rule groups with bandit rules into bandits. The bandit
+// settings of the group's first bandit rule apply; the backends of all its
+// bandit rules are the arms.
+func (re *RuleEngine) compileBandits() error {
+	idx := re.index
+	for i := range idx.entries {
+		entry := &idx.entries[i]
+		if !banditConfigured(entry.rule.Bandit) {
+			continue
+		}
+		group := &idx.groups[entry.group]
+		if group.bandit == nil {
+			b, err := newBandit(entry.rule.Bandit, groupKey(entry.rule), group.backends)
+			if err != nil {
+				return err
+			}
+			group.bandit = b
+			re.bandits = append(re.bandits, b)
+		}
+		entry.bandit = group.bandit
+		entry.bandit.arms[entry.backend] = true
+	}
+	for i := range idx.entries {
+		entry := &idx.entries[i]
+		if b := idx.groups[entry.group].bandit; b != nil && entry.bandit == nil && isPercentageRule(entry) {
+			return fmt.Errorf("%w %s: percentage and ramp rules can't share a path with bandit rules", errInvalidBandit, b.key)
+		}
+	}
+	for _, b := range re.bandits {
+		var arms float64
+		for _, arm := range b.arms {
+			if arm {
+				arms++
+			}
+		}
+		if arms < 2 {
+			return fmt.Errorf("%w %s: at least two backends are required", errInvalidBandit, b.key)
+		}
+		if arms*b.minWeight > maxPercentage || arms*b.maxWeight < maxPercentage {
+			return fmt.Errorf("%w %s: minWeight and maxWeight can't be met by %.0f backends", errInvalidBandit, b.key, arms)
+		}
+	}
+	return nil
+}
+
+// weight returns the percentage of a backend, recomputing the weights if they
+// are older than the update interval.
+func (b *bandit) weight(position int, now time.Time) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.updated.IsZero() || now.Sub(b.updated) >= b.interval {
+		b.update()
+		b.updated = now
+	}
+	return b.weights[position]
+}
+
+// update recomputes the weights from the pulls and rewards.
+func (b *bandit) update() {
+	raw := make([]float64, len(b.backends))
+	if b.strategy == banditThompson {
+		b.thompson(raw)
+	} else {
+		b.epsilonGreedy(raw)
+	}
+	b.bound(raw)
+}
+
+// mean is a backend's mean reward, starting from 0.5 before any pull.
+func (b *bandit) mean(position int) float64 {
+	return (b.rewards[position] + 1) / (b.pulls[position] + 2)
+}
+
+// epsilonGreedy spreads epsilon evenly and gives the rest to the backends with
+// the best mean reward.
+func (b *bandit) epsilonGreedy(raw []float64) {
+	best := -1.0
+	var arms, leaders float64
+	for i, arm := range b.arms {
+		if !arm {
+			continue
+		}
+		arms++
+		switch mean := b.mean(i); {
+		case mean > best:
+			best, leaders = mean, 1
+		case mean == best:
+			leaders++
+		}
+	}
+	for i, arm := range b.arms {
+		if !arm {
+			continue
+		}
+		raw[i] = b.epsilon / arms
+		if b.mean(i) == best {
+			raw[i] += (maxPercentage - b.epsilon) / leaders
+		}
+	}
+}
+
+// thompson weighs every backend by its chance of having the best reward rate,
+// sampled from Beta(rewards+1, failures+1) posteriors.
+func (b *bandit) thompson(raw []float64) {
+	for draw := 0; draw < thompsonDraws; draw++ {
+		best, winner := -1.0, -1
+		for i, arm := range b.arms {
+			if !arm {
+				continue
+			}
+			// Conversions of sessions assigned before a reload can outnumber
+			// the pulls counted since.
+			failures := math.Max(0, b.pulls[i]-b.rewards[i])
+			if sample := sampleBeta(b.rewards[i]+1, failures+1); sample > best {
+				best, winner = sample, i
+			}
+		}
+		raw[winner] += maxPercentage / thompsonDraws
+	}
+}
+
+// bound stores raw as the weights, clamped to the minimum and maximum weight
+// and scaled to add up to 100. Clamped backends are fixed and the others are
+// scaled again until none is out of bounds.
+func (b *bandit) bound(raw []float64) {
+	fixed := make([]bool, len(raw))
+	for i := range b.weights {
+		b.weights[i] = 0
+	}
+	for pass := 0; pass <= len(raw); pass++ {
+		remaining := maxPercentage
+		var free, freeRaw float64
+		for i, arm := range b.arms {
+			switch {
+			case !arm:
+			case fixed[i]:
+				remaining -= b.weights[i]
+			default:
+				free++
+				freeRaw += raw[i]
+			}
+		}
+		clamped := false
+		for i, arm := range b.arms {
+			if !arm || fixed[i] {
+				continue
+			}
+			if freeRaw > 0 {
+				b.weights[i] = raw[i] * remaining / freeRaw
+			} else {
+				b.weights[i] = remaining / free
+			}
+			switch {
+			case b.weights[i] < b.minWeight:
+				b.weights[i], fixed[i], clamped = b.minWeight, true, true
+			case b.weights[i] > b.maxWeight:
+				b.weights[i], fixed[i], clamped = b.maxWeight, true, true
+			}
+		}
+		if !clamped {
+			return
+		}
+	}
+}
+
+// sampleBeta draws from Beta(alpha, beta), for alpha and beta of at least 1.
+func sampleBeta(alpha, beta float64) float64 {
+	x := sampleGamma(alpha)
+	return x / (x + sampleGamma(beta))
+}
+
+// sampleGamma draws from Gamma(shape, 1) for shapes of at least 1, with the
+// Marsaglia-Tsang method.
+func sampleGamma(shape float64) float64 {
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rand.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rand.Float64()
+		if math.Log(u) < x*x/2+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+// record adds a pull with the given reward.
+func (b *bandit) record(position int, reward float64) {
+	b.mu.Lock()
+	b.pulls[position]++
+	b.rewards[position] += reward
+	b.mu.Unlock()
+}
+
+// convert adds the reward of a conversion to a pull counted earlier.
+func (b *bandit) convert(position int) {
+	b.mu.Lock()
+	b.rewards[position]++
+	b.mu.Unlock()
+}
+
+// reward returns the reward of a response: 1 for statuses below 400, or the
+// number between 0 and 1 the backend sent in the reward header. The reward
+// header is removed from the response.
+func (b *bandit) reward(status int, header http.Header) float64 {
+	if b.rewardHeader == "" {
+		if status < http.StatusBadRequest {
+			return 1
+		}
+		return 0
+	}
+	value := header.Get(b.rewardHeader)
+	header.Del(b.rewardHeader)
+	reward, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	return math.Max(0, math.Min(1, reward))
+}
+
+// armID identifies a backend in the assignment cookie without revealing it.
+func armID(backend string) string {
+	return strconv.FormatUint(fnvAdd(fnvOffset64, backend), 36)
+}
+
+// stickyBanditEntry returns the matching bandit rule of the group whose
+// backend the request's assignment cookie holds.
+func (re *RuleEngine) stickyBanditEntry(req *http.Request, b *bandit, group int, matched []int) (*indexedRule, bool) {
+	id, ok := re.requestAssignments(req)[banditAssignmentPrefix+b.key]
+	if !ok {
+		return nil, false
+	}
+	for _, position := range matched {
+		if entry := &re.index.entries[position]; entry.group == group && entry.bandit != nil && armID(entry.rule.Backend) == id {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// pullBandit notes the bandit backend the request is routed to, so that its
+// response or conversion can be rewarded, and stores new assignments.
+func (re *RuleEngine) pullBandit(req *http.Request, entry *indexedRule, sticky bool) {
+	state := stateOf(req)
+	state.bandit, state.banditArm, state.banditNew = entry.bandit, entry.backend, !sticky
+	if !sticky {
+		assignments := re.requestAssignments(req)
+		delete(assignments, banditConvertedPrefix+entry.bandit.key)
+		re.recordAssignment(req, banditAssignmentPrefix+entry.bandit.key, armID(entry.rule.Backend))
+	}
+}
+
+// exposeBandit counts a new assignment as a pull of bandits rewarded by
+// conversions.
+func (re *RuleEngine) exposeBandit(req *http.Request) {
+	state := stateOf(req)
+	if b := state.bandit; b != nil && b.conversionPath != "" && state.banditNew {
+		b.record(state.banditArm, 0)
+	}
+}
+
+// recordConversions rewards the backends the request's session was assigned
+// to by bandits converting on the request's path, once per assignment.
+func (re *RuleEngine) recordConversions(req *http.Request) {
+	for _, b := range re.bandits {
+		if b.conversionPath != req.URL.Path {
+			continue
+		}
+		assignments := re.requestAssignments(req)
+		id, ok := assignments[banditAssignmentPrefix+b.key]
+		if !ok || assignments[banditConvertedPrefix+b.key] != "" {
+			continue
+		}
+		for position, backend := range b.backends {
+			if b.arms[position] && armID(backend) == id {
+				b.convert(position)
+				re.recordAssignment(req, banditConvertedPrefix+b.key, "1")
+				re.logDebugf("Conversion for backend %s of the bandit on %s", backend, b.key)
+			}
+		}
+	}
+}
+
+// recordBanditResponse rewards the bandit backend a response came from,
+// unless the bandit is rewarded by conversions.
+func (re *RuleEngine) recordBanditResponse(req *http.Request, status int, header http.Header) {
+	state := stateOf(req)
+	if b := state.bandit; b != nil && b.conversionPath == "" {
+		b.record(state.banditArm, b.reward(status, header))
+	}
+}
+
+// knownBanditAssignment reports whether an assignment cookie entry belongs to
+// a configured bandit.
+func (re *RuleEngine) knownBanditAssignment(name string) bool {
+	for _, b := range re.bandits {
+		if name == banditAssignmentPrefix+b.key || name == banditConvertedPrefix+b.key {
+			return true
+		}
+	}
+	return false
+}
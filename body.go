@@ -0,0 +1,223 @@
+package forklift
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errInvalidJSONPath = errors.New("invalid JSON path")
+
+const defaultMaxBodySize = 1 << 20
+
+// replayableBody puts the bytes already read back in front of the unread rest
+// of the original body, so the backend still receives the complete body.
+type replayableBody struct {
+	io.Reader
+	io.Closer
+}
+
+// requestBody returns the request body, reading at most MaxBodySize bytes.
+// The second result is false if there is no body or it is larger than the
+// limit, in which case the first MaxBodySize bytes are returned. The request
+// body stays intact for proxying either way.
+func (re *RuleEngine) requestBody(req *http.Request) ([]byte, bool) {
+	state := stateOf(req)
+	if state.bodyRead {
+		return state.body, state.bodyComplete
+	}
+	state.bodyRead = true
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, false
+	}
+
+	limit := re.config.MaxBodySize
+	if limit <= 0 {
+		limit = defaultMaxBodySize
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	req.Body = &replayableBody{Reader: io.MultiReader(bytes.NewReader(buf), req.Body), Closer: req.Body}
+	if err != nil {
+		re.logger.Errorf("Error reading request body: %v", err)
+		return nil, false
+	}
+	if int64(len(buf)) > limit {
+		re.logDebugf("Request body exceeds %d bytes", limit)
+		state.body = buf[:limit]
+		return state.body, false
+	}
+	state.body, state.bodyComplete = buf, true
+	return buf, true
+}
+
+// hasMediaType reports whether the request Content-Type is one of the given
+// media types or, for JSON, any +json type.
+func hasMediaType(req *http.Request, mediaTypes ...string) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range mediaTypes {
+		if mediaType == t || (t == "application/json" && strings.HasSuffix(mediaType, "+json")) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestJSON returns the decoded JSON body, decoding it once per request.
+func (re *RuleEngine) requestJSON(req *http.Request) (interface{}, bool) {
+	state := stateOf(req)
+	if state.jsonDecoded {
+		return state.json, state.jsonValid
+	}
+	state.jsonDecoded = true
+	if !hasMediaType(req, "application/json") {
+		re.logDebugf("Content-Type %q is not JSON", req.Header.Get("Content-Type"))
+		return nil, false
+	}
+	body, ok := re.requestBody(req)
+	if !ok {
+		return nil, false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&state.json); err != nil {
+		re.logDebugf("Error decoding JSON body: %v", err)
+		return nil, false
+	}
+	state.jsonValid = true
+	return state.json, true
+}
+
+// jsonPathStep is one step of a JSON path: an object key or an array index.
+type jsonPathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// parseJSONPath parses selectors such as "$.cart.total", "items[0].sku" or
+// "$['first name']". The leading "$" is optional.
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	rest := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	var steps []jsonPathStep
+	for rest != "" {
+		var step jsonPathStep
+		var err error
+		switch {
+		case rest[0] == '.':
+			step.key, rest = splitJSONPathKey(rest[1:])
+		case rest[0] == '[':
+			step, rest, err = parseJSONPathBracket(rest)
+		case len(steps) == 0:
+			step.key, rest = splitJSONPathKey(rest)
+		default:
+			err = fmt.Errorf("%w: unexpected %q in %q", errInvalidJSONPath, rest[0], path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if step.key == "" && !step.isIndex {
+			return nil, fmt.Errorf("%w: empty segment in %q", errInvalidJSONPath, path)
+		}
+		steps = append(steps, step)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%w: %q selects nothing", errInvalidJSONPath, path)
+	}
+	return steps, nil
+}
+
+func splitJSONPathKey(s string) (string, string) {
+	end := strings.IndexAny(s, ".[")
+	if end < 0 {
+		end = len(s)
+	}
+	return s[:end], s[end:]
+}
+
+func parseJSONPathBracket(s string) (jsonPathStep, string, error) {
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return jsonPathStep{}, "", fmt.Errorf("%w: unclosed [ in %q", errInvalidJSONPath, s)
+	}
+	inner, rest := s[1:end], s[end+1:]
+	if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+		return jsonPathStep{key: inner[1 : len(inner)-1]}, rest, nil
+	}
+	index, err := strconv.Atoi(inner)
+	if err != nil || index < 0 {
+		return jsonPathStep{}, "", fmt.Errorf("%w: invalid index %q", errInvalidJSONPath, inner)
+	}
+	return jsonPathStep{index: index, isIndex: true}, rest, nil
+}
+
+// selectJSON walks the decoded document along the path.
+func selectJSON(doc interface{}, steps []jsonPathStep) (interface{}, bool) {
+	for _, step := range steps {
+		if !step.isIndex {
+			object, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if doc, ok = object[step.key]; !ok {
+				return nil, false
+			}
+			continue
+		}
+		array, ok := doc.([]interface{})
+		if !ok || step.index >= len(array) {
+			return nil, false
+		}
+		doc = array[step.index]
+	}
+	return doc, true
+}
+
+// jsonString renders a selected JSON value for comparison: strings as is,
+// numbers as written in the body, null as "" and objects or arrays as JSON.
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(encoded)
+	}
+}
+
+func (re *RuleEngine) checkJSON(req *http.Request, condition RuleCondition) bool {
+	steps, ok := re.jsonPaths[condition.Parameter]
+	if !ok {
+		re.logger.Warnf("JSON path was not compiled: %s", condition.Parameter)
+		return false
+	}
+	doc, ok := re.requestJSON(req)
+	if !ok {
+		return false
+	}
+	value, ok := selectJSON(doc, steps)
+	if !ok {
+		re.logDebugf("JSON path %s not found in body", condition.Parameter)
+		return false
+	}
+	actual := jsonString(value)
+	re.logDebugf("JSON path %s: %s", condition.Parameter, actual)
+	return re.compareCondition(actual, condition, condition.Value)
+}
@@ -0,0 +1,144 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var errInvalidBucketKey = errors.New("invalid bucketBy key")
+
+const (
+	bucketBySession = "session"
+	bucketByIP      = "ip"
+	// bucketKeySeparator joins the parts of a composite key.
+	bucketKeySeparator = "|"
+)
+
+// bucketSource is one part of a bucketing key, e.g. header:X-User-ID.
+type bucketSource struct {
+	kind  string
+	name  string
+	steps []jsonPathStep
+}
+
+// bucketKey is a key made of one or more sources, all of which must be present.
+type bucketKey []bucketSource
+
+// bucketChain lists bucketing keys in order of preference.
+type bucketChain []bucketKey
+
+// defaultBucketChain buckets by the session cookie.
+var defaultBucketChain = bucketChain{{{kind: bucketBySession}}}
+
+// parseBucketChain parses bucketBy specs such as "header:X-User-ID",
+// "jwt:sub", "ip" or "header:X-Tenant+cookie:uid". No specs bucket by session.
+func (re *RuleEngine) parseBucketChain(specs []string) (bucketChain, error) {
+	if len(specs) == 0 {
+		return defaultBucketChain, nil
+	}
+	chain := make(bucketChain, 0, len(specs))
+	for _, spec := range specs {
+		var key bucketKey
+		for _, part := range strings.Split(spec, "+") {
+			source, err := re.parseBucketSource(strings.TrimSpace(part))
+			if err != nil {
+				return nil, err
+			}
+			key = append(key, source)
+		}
+		chain = append(chain, key)
+	}
+	return chain, nil
+}
+
+func (re *RuleEngine) parseBucketSource(spec string) (bucketSource, error) {
+	kind, name, _ := strings.Cut(spec, ":")
+	source := bucketSource{kind: strings.ToLower(kind), name: name}
+	switch source.kind {
+	case bucketBySession, bucketByIP:
+		if name != "" {
+			return source, fmt.Errorf("%w: %q takes no name", errInvalidBucketKey, spec)
+		}
+	case "header", "cookie", "query", "param":
+		if name == "" {
+			return source, fmt.Errorf("%w: %q needs a name", errInvalidBucketKey, spec)
+		}
+	case "jwt":
+		if re.jwtVerifier == nil {
+			return source, errJWTNotConfigured
+		}
+		steps, err := parseJSONPath(name)
+		if err != nil {
+			return source, err
+		}
+		source.steps = steps
+	default:
+		return source, fmt.Errorf("%w: %q", errInvalidBucketKey, spec)
+	}
+	return source, nil
+}
+
+// bucketChainKey is the key of a bucketBy list in RuleEngine.bucketChains.
+func bucketChainKey(specs []string) string {
+	return strings.Join(specs, "\n")
+}
+
+// bucketKeyOf returns the first key of the chain whose sources are all present
+// in the request. Path parameters are read from params.
+func (re *RuleEngine) bucketKeyOf(req *http.Request, chain bucketChain, sessionID string, params map[string]string) (string, bool) {
+	for _, key := range chain {
+		if value, ok := re.resolveBucketKey(req, key, sessionID, params); ok {
+			return value, true
+		}
+	}
+	re.logDebugf("No bucketing key present in the request")
+	return "", false
+}
+
+func (re *RuleEngine) resolveBucketKey(req *http.Request, key bucketKey, sessionID string, params map[string]string) (string, bool) {
+	if len(key) == 1 {
+		return re.resolveBucketSource(req, key[0], sessionID, params)
+	}
+	parts := make([]string, 0, len(key))
+	for _, source := range key {
+		value, ok := re.resolveBucketSource(req, source, sessionID, params)
+		if !ok {
+			return "", false
+		}
+		parts = append(parts, value)
+	}
+	return strings.Join(parts, bucketKeySeparator), true
+}
+
+func (re *RuleEngine) resolveBucketSource(req *http.Request, source bucketSource, sessionID string, params map[string]string) (string, bool) {
+	var value string
+	switch source.kind {
+	case bucketBySession:
+		value = sessionID
+	case bucketByIP:
+		value = re.clientIP(req)
+	case "header":
+		value = strings.TrimSpace(req.Header.Get(source.name))
+	case "cookie":
+		if cookie, err := req.Cookie(source.name); err == nil {
+			value = cookie.Value
+		}
+	case "query":
+		value = req.URL.Query().Get(source.name)
+	case "param":
+		value = params[source.name]
+	case "jwt":
+		claims, ok := re.requestClaims(req)
+		if !ok {
+			return "", false
+		}
+		claim, ok := selectJSON(claims, source.steps)
+		if !ok || claim == nil {
+			return "", false
+		}
+		value = jsonString(claim)
+	}
+	return value, value != ""
+}
@@ -0,0 +1,569 @@
+package forklift
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+)
+
+var errInvalidCanary = errors.New("invalid canary")
+
+const (
+	defaultCanaryWindow      = 5 * time.Minute
+	defaultCanaryMinRequests = 100
+	// canarySlots is the number of slots a window is divided into. The window
+	// slides by one slot at a time.
+	canarySlots = 10
+	// canaryCheckInterval limits how often a canary compares its arms.
+	canaryCheckInterval = time.Second
+	// Latencies are counted in buckets growing by latencyBucketGrowth from 1ms,
+	// so the p95 is estimated to within 10%.
+	latencyBuckets      = 120
+	latencyBucketGrowth = 1.1
+	canaryPercentile    = 0.95
+)
+
+// canaryRollbacks holds the time of every rollback, keyed by middleware name
+// and canary key. Traefik creates a new middleware on every configuration
+// reload; keeping rollbacks outside of it means a rolled back variant stays
+// rolled back until its canary's resetAt explicitly re-enables it. With a
+// canaryStateFile, they are also written to disk and loaded again after a
+// restart; canaryStateFiles holds the files already loaded.
+var (
+	canaryRollbacksMu sync.Mutex
+	canaryRollbacks   = make(map[string]time.Time)
+	canaryStateFiles  = make(map[string]bool)
+)
+
+// canarySlot counts the responses of one slot of a window.
+type canarySlot struct {
+	epoch     int64
+	requests  int
+	errors    int
+	latencies [latencyBuckets]uint32
+}
+
+// canaryArm counts the responses of one side of a canary over a sliding window.
+type canaryArm struct {
+	mu    sync.Mutex
+	width time.Duration
+	slots [canarySlots]canarySlot
+	// canaries are checked whenever the arm records a response.
+	canaries []*canary
+}
+
+// canarySummary sums up an arm's responses in the window.
+type canarySummary struct {
+	requests int
+	// errorRate is the percentage of 5xx responses.
+	errorRate float64
+	p95       time.Duration
+}
+
+// canary compares an arm with its control and rolls the arm back when a
+// threshold is breached.
+type canary struct {
+	// key identifies the canary across reloads.
+	key string
+	// rule, backend, experiment and variant describe the canary in alerts.
+	rule, backend, experiment, variant string
+	// controlBackend is the backend of a rule canary's control.
+	controlBackend string
+
+	arm, control         *canaryArm
+	minRequests          int
+	maxErrorRateIncrease float64
+	maxLatencyIncrease   float64
+	webhook              string
+	middleware           string
+	stateFile            string
+	logger               logger.Logger
+
+	mu      sync.Mutex
+	checked time.Time
+	// rolledBack is 1 once the canary has been rolled back.
+	rolledBack int32
+}
+
+// canaryAlert is the JSON body posted to a canary's webhook.
+type canaryAlert struct {
+	Middleware       string  `json:"middleware"`
+	Rule             string  `json:"rule,omitempty"`
+	Experiment       string  `json:"experiment,omitempty"`
+	Variant          string  `json:"variant,omitempty"`
+	Backend          string  `json:"backend"`
+	Reason           string  `json:"reason"`
+	RolledBackAt     string  `json:"rolledBackAt"`
+	Requests         int     `json:"requests"`
+	ErrorRate        float64 `json:"errorRate"`
+	P95Ms            float64 `json:"p95Ms"`
+	ControlRequests  int     `json:"controlRequests"`
+	ControlErrorRate float64 `json:"controlErrorRate"`
+	ControlP95Ms     float64 `json:"controlP95Ms"`
+}
+
+// canaryConfigured reports whether a canary is configured.
+func canaryConfigured(cfg config.Canary) bool {
+	return cfg != (config.Canary{})
+}
+
+// newCanaryArm creates an arm counting responses over window.
+func newCanaryArm(window time.Duration) *canaryArm {
+	return &canaryArm{width: window / canarySlots}
+}
+
+// validateCanary checks the settings shared by rule and experiment canaries.
+func validateCanary(cfg config.Canary) (time.Duration, error) {
+	window := defaultCanaryWindow
+	if cfg.Window != "" {
+		d, err := time.ParseDuration(cfg.Window)
+		if err != nil || d < canarySlots*time.Millisecond {
+			return 0, fmt.Errorf("%w: window %q", errInvalidCanary, cfg.Window)
+		}
+		window = d
+	}
+	if cfg.MinRequests < 0 {
+		return 0, fmt.Errorf("%w: minRequests must not be negative", errInvalidCanary)
+	}
+	if cfg.MaxErrorRateIncrease < 0 || cfg.MaxLatencyIncrease < 0 {
+		return 0, fmt.Errorf("%w: thresholds must not be negative", errInvalidCanary)
+	}
+	if cfg.MaxErrorRateIncrease == 0 && cfg.MaxLatencyIncrease == 0 {
+		return 0, fmt.Errorf("%w: maxErrorRateIncrease or maxLatencyIncrease is required", errInvalidCanary)
+	}
+	if cfg.ResetAt != "" {
+		if _, err := time.Parse(time.RFC3339, cfg.ResetAt); err != nil {
+			return 0, fmt.Errorf("%w: resetAt: %w", errInvalidCanary, err)
+		}
+	}
+	return window, nil
+}
+
+// validateRuleCanary checks a rule's canary. Only rules taking part in a
+// percentage split can be rolled back.
+func (re *RuleEngine) validateRuleCanary(rule RoutingRule) error {
+	if !canaryConfigured(rule.Canary) {
+		return nil
+	}
+	if _, err := validateCanary(rule.Canary); err != nil {
+		return err
+	}
+	if rule.Percentage == 0 && !rampConfigured(rule.Ramp) {
+		return fmt.Errorf("%w: only rules with a percentage or ramp can have a canary", errInvalidCanary)
+	}
+	if ruleCanaryControl(re.config, rule) == rule.Backend {
+		return fmt.Errorf("%w: the control must be another backend", errInvalidCanary)
+	}
+	return nil
+}
+
+// ruleCanaryControl returns the control backend of a rule's canary.
+func ruleCanaryControl(cfg *config.Config, rule RoutingRule) string {
+	if rule.Canary.Control != "" {
+		return rule.Canary.Control
+	}
+	return cfg.DefaultBackend
+}
+
+// setupCanary makes c compare arm with control. A rollback recorded by a
+// previous configuration is restored unless resetAt is after it.
+func (re *RuleEngine) setupCanary(c *canary, cfg config.Canary, arm, control *canaryArm) {
+	c.arm, c.control = arm, control
+	c.minRequests = cfg.MinRequests
+	c.maxErrorRateIncrease = cfg.MaxErrorRateIncrease
+	c.maxLatencyIncrease = cfg.MaxLatencyIncrease
+	c.webhook = cfg.Webhook
+	c.middleware = re.name
+	c.stateFile = re.config.CanaryStateFile
+	c.logger = re.logger
+	if c.minRequests == 0 {
+		c.minRequests = defaultCanaryMinRequests
+	}
+	arm.canaries = append(arm.canaries, c)
+	control.canaries = append(control.canaries, c)
+
+	resetAt, _ := time.Parse(time.RFC3339, cfg.ResetAt)
+	canaryRollbacksMu.Lock()
+	defer canaryRollbacksMu.Unlock()
+	rolledBackAt, ok := canaryRollbacks[c.registryKey()]
+	switch {
+	case !ok:
+	case cfg.ResetAt != "" && rolledBackAt.Before(resetAt):
+		delete(canaryRollbacks, c.registryKey())
+		re.logger.Infof("Canary %s re-enabled, it was rolled back at %s", c, rolledBackAt.Format(time.RFC3339))
+		if err := saveCanaryState(c.stateFile); err != nil {
+			re.logger.Errorf("Error saving canary state: %v", err)
+		}
+	default:
+		c.rolledBack = 1
+		re.logger.Warnf("Canary %s stays rolled back since %s", c, rolledBackAt.Format(time.RFC3339))
+	}
+}
+
+// loadCanaryState adds the rollbacks recorded in the state file to those in
+// memory, once per process. A missing file has no rollbacks; a file that can't
+// be read is an error, so that rolled back canaries aren't re-enabled by
+// accident.
+func loadCanaryState(path string) error {
+	canaryRollbacksMu.Lock()
+	defer canaryRollbacksMu.Unlock()
+	if canaryStateFiles[path] {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		canaryStateFiles[path] = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: canaryStateFile: %w", errInvalidCanary, err)
+	}
+	var rollbacks map[string]time.Time
+	if err := json.Unmarshal(data, &rollbacks); err != nil {
+		return fmt.Errorf("%w: canaryStateFile %s: %w", errInvalidCanary, path, err)
+	}
+	for key, rolledBackAt := range rollbacks {
+		if _, ok := canaryRollbacks[key]; !ok {
+			canaryRollbacks[key] = rolledBackAt
+		}
+	}
+	canaryStateFiles[path] = true
+	return nil
+}
+
+// saveCanaryState writes the rollbacks to the state file, if there is one. The
+// file is replaced atomically. The caller holds canaryRollbacksMu.
+func saveCanaryState(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(canaryRollbacks)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// compileRuleCanaries attaches canaries to the indexed rules. Rules sharing a
+// path and backend share a canary; the first rule's settings are used. Both
+// arms only count requests whose percentage split included the canary's rule,
+// so the control is the traffic the canary competes for.
+func (re *RuleEngine) compileRuleCanaries() {
+	canaries := make(map[string]*canary)
+	for i := range re.index.entries {
+		entry := &re.index.entries[i]
+		rule := entry.rule
+		if !canaryConfigured(rule.Canary) {
+			continue
+		}
+		key := "rule\x00" + groupKey(rule) + "\x00" + rule.Backend
+		if c, ok := canaries[key]; ok {
+			entry.canary = c
+			continue
+		}
+		window, _ := validateCanary(rule.Canary)
+		arm, control := newCanaryArm(window), newCanaryArm(window)
+		c := &canary{key: key, rule: groupKey(rule), backend: rule.Backend, controlBackend: ruleCanaryControl(re.config, rule)}
+		re.setupCanary(c, rule.Canary, arm, control)
+		canaries[key] = c
+		entry.canary = c
+	}
+}
+
+// compileExperimentCanary gives every variant of an experiment but the control
+// a canary comparing it with the control.
+func (re *RuleEngine) compileExperimentCanary(e *experiment, cfg config.Canary) error {
+	window, err := validateCanary(cfg)
+	if err != nil {
+		return err
+	}
+	control := -1
+	for i, variant := range e.variants {
+		if variant.Name == cfg.Control || cfg.Control == "" && i == 0 {
+			control = i
+		}
+	}
+	if control < 0 {
+		return fmt.Errorf("%w: unknown control variant %q", errInvalidCanary, cfg.Control)
+	}
+	e.control = control
+	e.arms = make([]*canaryArm, len(e.variants))
+	e.canaries = make([]*canary, len(e.variants))
+	e.arms[control] = newCanaryArm(window)
+	for i, variant := range e.variants {
+		if i == control {
+			continue
+		}
+		e.arms[i] = newCanaryArm(window)
+		c := &canary{
+			key:        "experiment\x00" + e.name + "\x00" + variant.Name,
+			experiment: e.name,
+			variant:    variant.Name,
+			backend:    variant.Backend,
+		}
+		re.setupCanary(c, cfg, e.arms[i], e.arms[control])
+		e.canaries[i] = c
+	}
+	return nil
+}
+
+// noteSplitCanaries remembers the canaries of the group's matching rules once
+// its percentage split has been decided.
+func (re *RuleEngine) noteSplitCanaries(req *http.Request, group int, matched []int) {
+	state := stateOf(req)
+	for _, position := range matched {
+		entry := &re.index.entries[position]
+		if entry.group != group || entry.canary == nil || hasCanary(state.splitCanaries, entry.canary) {
+			continue
+		}
+		state.splitCanaries = append(state.splitCanaries, entry.canary)
+	}
+}
+
+func hasCanary(canaries []*canary, c *canary) bool {
+	for _, other := range canaries {
+		if other == c {
+			return true
+		}
+	}
+	return false
+}
+
+// canaryArms returns the arms counting the responses of a selected backend:
+// those of the rule canaries whose split the request went through, or the
+// variant's arm.
+func (re *RuleEngine) canaryArms(req *http.Request, selected SelectedBackend) []*canaryArm {
+	if selected.Experiment == "" {
+		var arms []*canaryArm
+		for _, c := range stateOf(req).splitCanaries {
+			switch selected.Backend {
+			case c.backend:
+				arms = append(arms, c.arm)
+			case c.controlBackend:
+				arms = append(arms, c.control)
+			}
+		}
+		return arms
+	}
+	for _, e := range re.experiments {
+		if e.name != selected.Experiment || e.arms == nil {
+			continue
+		}
+		for i, variant := range e.variants {
+			if variant.Name == selected.Variant {
+				return e.arms[i : i+1]
+			}
+		}
+	}
+	return nil
+}
+
+// recordResponse counts a response in the canary arms and bandit noted in
+// the request's state. The bandit's reward header is removed from header.
+func (re *RuleEngine) recordResponse(req *http.Request, status int, header http.Header, latency time.Duration) {
+	re.recordBanditResponse(req, status, header)
+	re.recordCanaries(stateOf(req).canaryArms, status, latency)
+}
+
+// recordCanaries counts a response in the arms and checks their canaries.
+func (re *RuleEngine) recordCanaries(arms []*canaryArm, status int, latency time.Duration) {
+	if len(arms) == 0 {
+		return
+	}
+	now := re.now()
+	for _, arm := range arms {
+		arm.record(now, status, latency)
+		for _, c := range arm.canaries {
+			c.check(now)
+		}
+	}
+}
+
+func (arm *canaryArm) epoch(now time.Time) int64 {
+	return now.UnixNano() / int64(arm.width)
+}
+
+// record counts a response. 5xx responses count as errors.
+func (arm *canaryArm) record(now time.Time, status int, latency time.Duration) {
+	epoch := arm.epoch(now)
+	arm.mu.Lock()
+	defer arm.mu.Unlock()
+	slot := &arm.slots[epoch%canarySlots]
+	if slot.epoch != epoch {
+		*slot = canarySlot{epoch: epoch}
+	}
+	slot.requests++
+	if status >= http.StatusInternalServerError {
+		slot.errors++
+	}
+	slot.latencies[latencyBucket(latency)]++
+}
+
+// summary sums up the responses of the window ending at now.
+func (arm *canaryArm) summary(now time.Time) canarySummary {
+	epoch := arm.epoch(now)
+	var latencies [latencyBuckets]int
+	var requests, errors int
+	arm.mu.Lock()
+	for i := range arm.slots {
+		slot := &arm.slots[i]
+		if slot.epoch > epoch || slot.epoch <= epoch-canarySlots {
+			continue
+		}
+		requests += slot.requests
+		errors += slot.errors
+		for j, n := range slot.latencies {
+			latencies[j] += int(n)
+		}
+	}
+	arm.mu.Unlock()
+	if requests == 0 {
+		return canarySummary{}
+	}
+
+	summary := canarySummary{requests: requests, errorRate: float64(errors) * percentageScale / float64(requests)}
+	rank := int(math.Ceil(canaryPercentile * float64(requests)))
+	var seen int
+	for i, n := range latencies {
+		if seen += n; seen >= rank {
+			summary.p95 = bucketLatency(i)
+			break
+		}
+	}
+	return summary
+}
+
+// latencyBucket returns the bucket of a latency. Bucket i holds latencies up
+// to bucketLatency(i).
+func latencyBucket(latency time.Duration) int {
+	ms := float64(latency) / float64(time.Millisecond)
+	if ms <= 1 {
+		return 0
+	}
+	i := int(math.Ceil(math.Log(ms) / math.Log(latencyBucketGrowth)))
+	if i >= latencyBuckets {
+		return latencyBuckets - 1
+	}
+	return i
+}
+
+func bucketLatency(i int) time.Duration {
+	return time.Duration(math.Pow(latencyBucketGrowth, float64(i)) * float64(time.Millisecond))
+}
+
+func (c *canary) String() string {
+	if c.experiment != "" {
+		return "experiment " + c.experiment + " variant " + c.variant
+	}
+	return "rule " + c.rule + " backend " + c.backend
+}
+
+func (c *canary) registryKey() string {
+	return c.middleware + "\x00" + c.key
+}
+
+func (c *canary) isRolledBack() bool {
+	return atomic.LoadInt32(&c.rolledBack) == 1
+}
+
+// check compares the arm with the control, at most once per
+// canaryCheckInterval, once both have enough responses in the window.
+func (c *canary) check(now time.Time) {
+	if c.isRolledBack() {
+		return
+	}
+	c.mu.Lock()
+	if now.Sub(c.checked) < canaryCheckInterval {
+		c.mu.Unlock()
+		return
+	}
+	c.checked = now
+	c.mu.Unlock()
+
+	arm, control := c.arm.summary(now), c.control.summary(now)
+	if arm.requests < c.minRequests || control.requests < c.minRequests {
+		return
+	}
+	if reason := c.breach(arm, control); reason != "" {
+		c.rollBack(now, reason, arm, control)
+	}
+}
+
+// breach describes the threshold the arm breaches, if any.
+func (c *canary) breach(arm, control canarySummary) string {
+	if c.maxErrorRateIncrease > 0 && arm.errorRate-control.errorRate > c.maxErrorRateIncrease {
+		return fmt.Sprintf("5xx rate %.1f%% against %.1f%% for the control", arm.errorRate, control.errorRate)
+	}
+	if c.maxLatencyIncrease > 0 && float64(arm.p95) > float64(control.p95)*(1+c.maxLatencyIncrease/percentageScale) {
+		return fmt.Sprintf("p95 latency %s against %s for the control", arm.p95, control.p95)
+	}
+	return ""
+}
+
+// rollBack drops the canary's arm to 0%, remembers the rollback across reloads
+// and sends the alert.
+func (c *canary) rollBack(now time.Time, reason string, arm, control canarySummary) {
+	if !atomic.CompareAndSwapInt32(&c.rolledBack, 0, 1) {
+		return
+	}
+	canaryRollbacksMu.Lock()
+	canaryRollbacks[c.registryKey()] = now
+	if err := saveCanaryState(c.stateFile); err != nil {
+		c.logger.Errorf("Error saving canary state: %v", err)
+	}
+	canaryRollbacksMu.Unlock()
+
+	c.logger.Errorf("Canary %s rolled back to 0%%: %s", c, reason)
+	if c.webhook == "" {
+		return
+	}
+	alert := canaryAlert{
+		Middleware:       c.middleware,
+		Rule:             c.rule,
+		Experiment:       c.experiment,
+		Variant:          c.variant,
+		Backend:          c.backend,
+		Reason:           reason,
+		RolledBackAt:     now.UTC().Format(time.RFC3339),
+		Requests:         arm.requests,
+		ErrorRate:        arm.errorRate,
+		P95Ms:            float64(arm.p95) / float64(time.Millisecond),
+		ControlRequests:  control.requests,
+		ControlErrorRate: control.errorRate,
+		ControlP95Ms:     float64(control.p95) / float64(time.Millisecond),
+	}
+	go c.notify(alert)
+}
+
+// notify posts an alert to the canary's webhook.
+func (c *canary) notify(alert canaryAlert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		c.logger.Errorf("Error encoding canary alert: %v", err)
+		return
+	}
+	client := &http.Client{Timeout: defaultTimeout}
+	resp, err := client.Post(c.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		c.logger.Errorf("Error sending canary alert to %s: %v", c.webhook, err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		c.logger.Errorf("Canary alert webhook %s answered %d", c.webhook, resp.StatusCode)
+	}
+}
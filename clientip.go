@@ -0,0 +1,137 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var errInvalidClientIPHeader = errors.New("invalid client IP header: must be X-Forwarded-For, X-Real-IP or Forwarded")
+
+const (
+	headerXForwardedFor = "X-Forwarded-For"
+	headerXRealIP       = "X-Real-Ip"
+	headerForwarded     = "Forwarded"
+)
+
+// clientIPResolver finds the real client address of requests that passed
+// through trusted proxies.
+type clientIPResolver struct {
+	header  string
+	trusted []*net.IPNet
+	depth   int
+}
+
+func newClientIPResolver(header string, trustedProxies []string, depth int) (*clientIPResolver, error) {
+	resolver := &clientIPResolver{header: http.CanonicalHeaderKey(header), depth: depth}
+	if resolver.header == "" {
+		resolver.header = headerXForwardedFor
+	}
+	switch resolver.header {
+	case headerXForwardedFor, headerXRealIP, headerForwarded:
+	default:
+		return nil, fmt.Errorf("%w: %s", errInvalidClientIPHeader, header)
+	}
+	if len(trustedProxies) > 0 {
+		trusted, err := parseNetworks(strings.Join(trustedProxies, ","))
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxies: %w", err)
+		}
+		resolver.trusted = trusted
+	}
+	return resolver, nil
+}
+
+// resolve returns the client IP of the request. Forwarding headers are only
+// believed while every hop that added them is a trusted proxy, and at most
+// depth hops are walked, so untrusted clients cannot spoof their address.
+func (r *clientIPResolver) resolve(req *http.Request) string {
+	candidate := remoteIP(req)
+	if !r.isTrusted(candidate) {
+		return candidate
+	}
+	if r.header == headerXRealIP {
+		if ip := net.ParseIP(strings.TrimSpace(req.Header.Get(headerXRealIP))); ip != nil {
+			return ip.String()
+		}
+		return candidate
+	}
+
+	hops := r.forwardedHops(req)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if r.depth > 0 && len(hops)-i > r.depth {
+			break
+		}
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			break
+		}
+		candidate = ip.String()
+		if !r.isTrusted(candidate) {
+			break
+		}
+	}
+	return candidate
+}
+
+func (r *clientIPResolver) isTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && networksContain(r.trusted, ip)
+}
+
+// forwardedHops returns the addresses recorded in the configured header, from
+// the original client to the closest proxy.
+func (r *clientIPResolver) forwardedHops(req *http.Request) []string {
+	var hops []string
+	for _, line := range req.Header.Values(r.header) {
+		for _, element := range strings.Split(line, ",") {
+			if r.header == headerForwarded {
+				element = forwardedFor(element)
+			}
+			hops = append(hops, strings.TrimSpace(element))
+		}
+	}
+	return hops
+}
+
+// forwardedFor extracts the address of the for= parameter of one RFC 7239
+// Forwarded element, dropping quotes, brackets and port.
+func forwardedFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !strings.EqualFold(key, "for") {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		if host, _, err := net.SplitHostPort(value); err == nil {
+			return host
+		}
+		return strings.Trim(value, "[]")
+	}
+	return ""
+}
+
+// clientIP returns the resolved client IP of the request, computing it once.
+func (re *RuleEngine) clientIP(req *http.Request) string {
+	state := stateOf(req)
+	if !state.clientIPResolved {
+		if re.clientIPResolver != nil {
+			state.clientIP = re.clientIPResolver.resolve(req)
+		} else {
+			state.clientIP = remoteIP(req)
+		}
+		state.clientIPResolved = true
+	}
+	return state.clientIP
+}
+
+// remoteIP returns the IP address of the peer that sent the request.
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
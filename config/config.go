@@ -17,6 +17,180 @@ type Config struct {
 	ConfigFile        string        `yaml:"configFile,omitempty"`
 	DefaultBackendEnv string        `yaml:"defaultBackendEnv,omitempty"`
 	DebugEnv          string        `yaml:"debugEnv,omitempty"`
+	ClientIP          ClientIP      `yaml:"clientIP,omitempty"`
+	// MaxBodySize limits how many body bytes are read for body conditions. Defaults to 1 MiB.
+	MaxBodySize int64 `yaml:"maxBodySize,omitempty"`
+	JWT         JWT   `yaml:"jwt,omitempty"`
+	GeoIP       GeoIP `yaml:"geoIP,omitempty"`
+	// VariantOverride enables signed forced-variant overrides for QA.
+	VariantOverride VariantOverride `yaml:"variantOverride,omitempty"`
+	// Lists are named targeting lists for the inList and notInList operators.
+	Lists []List `yaml:"lists,omitempty"`
+	// Experiments split the traffic of sets of routes between named variants.
+	Experiments []Experiment `yaml:"experiments,omitempty"`
+	// StickyAssignments keeps users on their experiment variants when splits change.
+	StickyAssignments StickyAssignments `yaml:"stickyAssignments,omitempty"`
+	// Layers divide users between mutually exclusive experiments.
+	Layers []Layer `yaml:"layers,omitempty"`
+	// Holdout keeps a percentage of users out of every experiment and percentage split.
+	Holdout Holdout `yaml:"holdout,omitempty"`
+	// SampleRatio tests the observed splits of experiments and percentage rules against the configured ones.
+	SampleRatio SampleRatio `yaml:"sampleRatio,omitempty"`
+	// SessionCookie configures the session cookie. The assignment and override cookies share its attributes.
+	SessionCookie SessionCookie `yaml:"sessionCookie,omitempty"`
+	// CanaryStateFile records canary rollbacks, so that they survive restarts.
+	CanaryStateFile string `yaml:"canaryStateFile,omitempty"`
+}
+
+// SessionCookie configures the cookie that holds the session ID.
+type SessionCookie struct {
+	// Name defaults to forklift_id.
+	Name string `yaml:"name,omitempty"`
+	// Domain is unset by default, which limits the cookie to the request host.
+	Domain string `yaml:"domain,omitempty"`
+	// Path defaults to "/".
+	Path string `yaml:"path,omitempty"`
+	// MaxAge is the lifetime of the cookie, e.g. "720h". Defaults to 30 days.
+	MaxAge string `yaml:"maxAge,omitempty"`
+	// SameSite is strict (default), lax or none.
+	SameSite string `yaml:"sameSite,omitempty"`
+	// Secure is auto (default), always or never. Auto marks the cookie Secure
+	// for HTTPS requests, including those a trusted proxy of ClientIP reports
+	// in X-Forwarded-Proto. SameSite none and Partitioned require always,
+	// which is then the default.
+	Secure string `yaml:"secure,omitempty"`
+	// Partitioned adds the Partitioned attribute to Secure cookies.
+	Partitioned bool `yaml:"partitioned,omitempty"`
+}
+
+// SampleRatio configures sample ratio mismatch detection.
+type SampleRatio struct {
+	// Disabled turns the detection off.
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Window is the sliding window decisions are counted over, e.g. "1h". Defaults to 1 hour.
+	Window string `yaml:"window,omitempty"`
+	// MinDecisions is how many decisions the window needs before it is tested. Defaults to 1000.
+	MinDecisions int `yaml:"minDecisions,omitempty"`
+	// PValue is the significance level of the chi-squared test. Defaults to 0.001.
+	PValue float64 `yaml:"pValue,omitempty"`
+}
+
+// Layer is a traffic space divided between experiments, so that a user is in
+// at most one of them.
+type Layer struct {
+	Name string `yaml:"name,omitempty"`
+	// Salt seeds the layer hash. Defaults to Name.
+	Salt string `yaml:"salt,omitempty"`
+	// BucketBy and HashAlgorithm apply to every experiment of the layer.
+	BucketBy      []string `yaml:"bucketBy,omitempty"`
+	HashAlgorithm string   `yaml:"hashAlgorithm,omitempty"`
+}
+
+// Holdout configures the users excluded from every experiment.
+type Holdout struct {
+	// Percentage is the share of users held out.
+	Percentage float64 `yaml:"percentage,omitempty"`
+	// Salt seeds the holdout hash. Defaults to "holdout".
+	Salt          string   `yaml:"salt,omitempty"`
+	BucketBy      []string `yaml:"bucketBy,omitempty"`
+	HashAlgorithm string   `yaml:"hashAlgorithm,omitempty"`
+}
+
+// StickyAssignments configures the signed cookie that remembers experiment assignments.
+type StickyAssignments struct {
+	// Secret signs the cookie. Sticky assignments are disabled without it.
+	Secret string `yaml:"secret,omitempty"`
+	// MaxAge is how long the cookie is kept, e.g. "720h". Defaults to 30 days.
+	MaxAge string `yaml:"maxAge,omitempty"`
+}
+
+// Experiment assigns users to variants, identically on every route it covers.
+type Experiment struct {
+	Name string `yaml:"name,omitempty"`
+	// Salt seeds the assignment hash. Defaults to Name; change it to reshuffle users.
+	Salt string `yaml:"salt,omitempty"`
+	// Allocation is the percentage of users that enter the experiment. The others
+	// are routed by the rules.
+	Allocation float64             `yaml:"allocation,omitempty"`
+	Variants   []ExperimentVariant `yaml:"variants,omitempty"`
+	Routes     []ExperimentRoute   `yaml:"routes,omitempty"`
+	// BucketBy lists the keys users are assigned by, in order of preference. Defaults to the session.
+	BucketBy []string `yaml:"bucketBy,omitempty"`
+	// HashAlgorithm selects how users are hashed into buckets: fnv (default) or murmur3.
+	HashAlgorithm string `yaml:"hashAlgorithm,omitempty"`
+	// Canary rolls variants back when they perform worse than the control variant.
+	Canary Canary `yaml:"canary,omitempty"`
+	// Layer puts the experiment in a layer. Allocation is then its share of the layer.
+	Layer string `yaml:"layer,omitempty"`
+}
+
+// ExperimentVariant is a variant of an experiment and the backend serving it.
+type ExperimentVariant struct {
+	Name    string `yaml:"name,omitempty"`
+	Backend string `yaml:"backend,omitempty"`
+	// Weight is the variant's share of the enrolled users, relative to the other variants.
+	Weight float64 `yaml:"weight,omitempty"`
+	// Ramp sets the variant's percentage of the enrolled users over time instead of Weight.
+	Ramp Ramp `yaml:"ramp,omitempty"`
+}
+
+// ExperimentRoute selects requests covered by an experiment, like the path and
+// method of a routing rule.
+type ExperimentRoute struct {
+	Path        string `yaml:"path,omitempty"`
+	PathPrefix  string `yaml:"pathPrefix,omitempty"`
+	PathPattern string `yaml:"pathPattern,omitempty"`
+	Method      string `yaml:"method,omitempty"`
+}
+
+// List is a targeting list loaded from a file with one entry per line.
+type List struct {
+	Name string `yaml:"name,omitempty"`
+	File string `yaml:"file,omitempty"`
+	// ReloadInterval is how often the file is checked for changes. Defaults to 1m.
+	ReloadInterval string `yaml:"reloadInterval,omitempty"`
+}
+
+// VariantOverride configures the forklift_variant override tokens.
+type VariantOverride struct {
+	// Secret signs the override tokens. Overrides are disabled without it.
+	Secret string `yaml:"secret,omitempty"`
+}
+
+// GeoIP configures the local MaxMind databases used by country, region and asn conditions.
+type GeoIP struct {
+	// Database is a City or Country database such as GeoLite2-City.mmdb.
+	Database string `yaml:"database,omitempty"`
+	// ASNDatabase is an ASN database such as GeoLite2-ASN.mmdb.
+	ASNDatabase string `yaml:"asnDatabase,omitempty"`
+	// ReloadInterval is how often the files are checked for changes. Defaults to 1m.
+	ReloadInterval string `yaml:"reloadInterval,omitempty"`
+}
+
+// JWT configures local verification of the tokens read by jwt conditions.
+type JWT struct {
+	// Header holds the token, optionally with a "Bearer " prefix. Defaults to Authorization.
+	Header string `yaml:"header,omitempty"`
+	// Cookie reads the token from this cookie instead of a header.
+	Cookie string `yaml:"cookie,omitempty"`
+	// Secret is the shared HS256 secret.
+	Secret string `yaml:"secret,omitempty"`
+	// PublicKeyFile is a PEM file with RS256 or ES256 public keys or certificates.
+	PublicKeyFile string `yaml:"publicKeyFile,omitempty"`
+	// JWKSFile is a JSON Web Key Set file with RS256 or ES256 keys.
+	JWKSFile string `yaml:"jwksFile,omitempty"`
+	// Leeway is the clock skew tolerated when checking exp and nbf, e.g. "30s".
+	Leeway string `yaml:"leeway,omitempty"`
+}
+
+// ClientIP configures how the client IP is resolved when Forklift runs behind proxies.
+type ClientIP struct {
+	// Header is the forwarding header to read: X-Forwarded-For (default), X-Real-IP or Forwarded.
+	Header string `yaml:"header,omitempty"`
+	// TrustedProxies lists the IPs and CIDRs of proxies whose forwarding headers are believed.
+	TrustedProxies []string `yaml:"trustedProxies,omitempty"`
+	// Depth limits how many forwarding hops are walked. Zero means no limit.
+	Depth int `yaml:"depth,omitempty"`
 }
 
 // RoutingRule defines the structure for routing rules in the middleware.
@@ -30,6 +204,94 @@ type RoutingRule struct {
 	Priority          int             `yaml:"priority,omitempty"`
 	PathPrefixRewrite string          `yaml:"pathPrefixRewrite,omitempty"`
 	AffinityToken     string          `yaml:"affinityToken,omitempty"`
+	Expr              string          `yaml:"expr,omitempty"`
+	ActiveFrom        string          `yaml:"activeFrom,omitempty"`
+	ActiveUntil       string          `yaml:"activeUntil,omitempty"`
+	// PathPattern matches templates such as "/users/{id}/orders/*" or "/static/**.js".
+	PathPattern string `yaml:"pathPattern,omitempty"`
+	// PathRewrite replaces the path, substituting "{name}" with captured parameters.
+	PathRewrite string `yaml:"pathRewrite,omitempty"`
+	// Name identifies the rule, e.g. as the target of a variant override.
+	Name string `yaml:"name,omitempty"`
+	// BucketBy lists the keys percentage splits hash, in order of preference. Defaults to the session.
+	BucketBy []string `yaml:"bucketBy,omitempty"`
+	// HashAlgorithm selects how percentage splits hash: legacy (default), fnv or murmur3.
+	HashAlgorithm string `yaml:"hashAlgorithm,omitempty"`
+	// Ramp changes the percentage over time instead of a fixed Percentage.
+	Ramp Ramp `yaml:"ramp,omitempty"`
+	// Canary rolls the rule back to 0% when its backend performs worse than the control backend.
+	Canary Canary `yaml:"canary,omitempty"`
+	// Bandit makes the rule's backend an arm of a multi-armed bandit instead of a fixed Percentage.
+	Bandit Bandit `yaml:"bandit,omitempty"`
+	// Remainder gives the rule's backend the share the percentage rules of its path leave unallocated.
+	Remainder bool `yaml:"remainder,omitempty"`
+	// Shard routes the rule's requests to one of a set of backends by their bucketing key.
+	Shard Shard `yaml:"shard,omitempty"`
+}
+
+// Shard maps bucketing keys onto a set of backends with a consistent-hash ring.
+type Shard struct {
+	// Backends are the shards. Adding or removing one moves about 1/N of the keys.
+	Backends []string `yaml:"backends,omitempty"`
+	// VirtualNodes is the number of points each backend has on the ring. Defaults to 160.
+	VirtualNodes int `yaml:"virtualNodes,omitempty"`
+}
+
+// Bandit shifts the traffic of a rule group toward the backends earning the
+// most reward.
+type Bandit struct {
+	// Strategy is epsilonGreedy or thompson.
+	Strategy string `yaml:"strategy,omitempty"`
+	// Epsilon is the percentage of traffic epsilonGreedy spreads evenly to explore. Defaults to 10.
+	Epsilon float64 `yaml:"epsilon,omitempty"`
+	// Reward is status, header:<name> or conversion:<path>.
+	Reward string `yaml:"reward,omitempty"`
+	// MinWeight and MaxWeight bound every backend's percentage. They default to 0 and 100.
+	MinWeight float64 `yaml:"minWeight,omitempty"`
+	MaxWeight float64 `yaml:"maxWeight,omitempty"`
+	// UpdateInterval is how often the weights are recomputed, e.g. "1m". Defaults to 30 seconds.
+	UpdateInterval string `yaml:"updateInterval,omitempty"`
+}
+
+// Canary compares the responses of a variant with those of its control and
+// rolls the variant back when a threshold is breached.
+type Canary struct {
+	// Control is the backend of a rule's control, or the name of an experiment's
+	// control variant. Defaults to the default backend or the first variant.
+	Control string `yaml:"control,omitempty"`
+	// Window is the sliding window responses are compared over, e.g. "5m". Defaults to 5 minutes.
+	Window string `yaml:"window,omitempty"`
+	// MinRequests is how many responses both sides need in the window. Defaults to 100.
+	MinRequests int `yaml:"minRequests,omitempty"`
+	// MaxErrorRateIncrease is how many percentage points the 5xx rate may exceed control's by.
+	MaxErrorRateIncrease float64 `yaml:"maxErrorRateIncrease,omitempty"`
+	// MaxLatencyIncrease is how many percent the p95 latency may exceed control's by.
+	MaxLatencyIncrease float64 `yaml:"maxLatencyIncrease,omitempty"`
+	// Webhook receives a JSON POST on every rollback.
+	Webhook string `yaml:"webhook,omitempty"`
+	// ResetAt re-enables variants rolled back before this time (RFC 3339).
+	ResetAt string `yaml:"resetAt,omitempty"`
+}
+
+// Ramp raises a percentage over time, in steps or linearly.
+type Ramp struct {
+	// Start is when the ramp begins (RFC 3339). Before it, the value is 0.
+	Start string `yaml:"start,omitempty"`
+	// Steps set the value from Start plus their offset on.
+	Steps []RampStep `yaml:"steps,omitempty"`
+	// End, From and To ramp linearly from From at Start to To at End (RFC 3339).
+	End  string  `yaml:"end,omitempty"`
+	From float64 `yaml:"from,omitempty"`
+	To   float64 `yaml:"to,omitempty"`
+	// PausedAt holds the ramp at the value it had at this time (RFC 3339).
+	PausedAt string `yaml:"pausedAt,omitempty"`
+}
+
+// RampStep is a step of a ramp.
+type RampStep struct {
+	// After is the offset from the ramp's start, e.g. "0s", "2h" or "1d".
+	After string  `yaml:"after,omitempty"`
+	Value float64 `yaml:"value,omitempty"`
 }
 
 // RuleCondition defines the structure for conditions in routing rules.
@@ -39,6 +301,10 @@ type RuleCondition struct {
 	QueryParam string `yaml:"queryParam,omitempty"`
 	Operator   string `yaml:"operator,omitempty"`
 	Value      string `yaml:"value,omitempty"`
+	// Days, Hours and Timezone configure schedule conditions.
+	Days     []string `yaml:"days,omitempty"`
+	Hours    []string `yaml:"hours,omitempty"`
+	Timezone string   `yaml:"timezone,omitempty"`
 }
 
 // CreateConfig creates and initializes the plugin configuration.
@@ -0,0 +1,175 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidSessionCookie = errors.New("invalid sessionCookie")
+
+const (
+	defaultSessionCookieName   = "forklift_id"
+	defaultSessionCookieMaxAge = 30 * 24 * time.Hour
+
+	secureAuto   = "auto"
+	secureAlways = "always"
+	secureNever  = "never"
+)
+
+// sameSiteModes maps the sameSite setting to its attribute.
+var sameSiteModes = map[string]http.SameSite{
+	"strict": http.SameSiteStrictMode,
+	"lax":    http.SameSiteLaxMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// cookieSettings are the compiled session cookie settings. The assignment and
+// override cookies share the domain, path, SameSite, Secure and Partitioned
+// attributes.
+type cookieSettings struct {
+	name        string
+	domain      string
+	path        string
+	maxAge      time.Duration
+	sameSite    http.SameSite
+	secure      string
+	partitioned bool
+	// proxies is the client IP resolver, whose trusted proxies are believed
+	// about X-Forwarded-Proto. It is nil without trusted proxies.
+	proxies *clientIPResolver
+}
+
+// compileCookieSettings validates the session cookie settings and fills in
+// the defaults.
+func compileCookieSettings(cfg config.SessionCookie) (*cookieSettings, error) {
+	c := &cookieSettings{
+		name:        cfg.Name,
+		domain:      strings.TrimPrefix(cfg.Domain, "."),
+		path:        cfg.Path,
+		maxAge:      defaultSessionCookieMaxAge,
+		secure:      strings.ToLower(cfg.Secure),
+		partitioned: cfg.Partitioned,
+	}
+	if c.name == "" {
+		c.name = defaultSessionCookieName
+	}
+	if !validCookieName(c.name) || c.name == assignmentCookieName || c.name == overrideParam {
+		return nil, fmt.Errorf("%w: name %q", errInvalidSessionCookie, c.name)
+	}
+	if !validCookieDomain(c.domain) {
+		return nil, fmt.Errorf("%w: domain %q", errInvalidSessionCookie, cfg.Domain)
+	}
+	if c.path == "" {
+		c.path = "/"
+	}
+	if !strings.HasPrefix(c.path, "/") || strings.ContainsAny(c.path, "; \t") {
+		return nil, fmt.Errorf("%w: path %q must start with / and contain no ; or spaces", errInvalidSessionCookie, c.path)
+	}
+	if cfg.MaxAge != "" {
+		d, err := time.ParseDuration(cfg.MaxAge)
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("%w: maxAge %q must be a duration of at least a second", errInvalidSessionCookie, cfg.MaxAge)
+		}
+		c.maxAge = d
+	}
+	sameSite := strings.ToLower(cfg.SameSite)
+	if sameSite == "" {
+		sameSite = "strict"
+	}
+	var ok bool
+	if c.sameSite, ok = sameSiteModes[sameSite]; !ok {
+		return nil, fmt.Errorf("%w: sameSite must be strict, lax or none", errInvalidSessionCookie)
+	}
+	// Browsers reject SameSite=None and Partitioned cookies without Secure,
+	// so they must be Secure on every response, not only on HTTPS ones.
+	crossSite := c.sameSite == http.SameSiteNoneMode || c.partitioned
+	switch c.secure {
+	case "":
+		c.secure = secureAuto
+		if crossSite {
+			c.secure = secureAlways
+		}
+	case secureAuto, secureAlways, secureNever:
+	default:
+		return nil, fmt.Errorf("%w: secure must be auto, always or never", errInvalidSessionCookie)
+	}
+	if crossSite && c.secure != secureAlways {
+		return nil, fmt.Errorf("%w: sameSite none and partitioned require secure: always", errInvalidSessionCookie)
+	}
+	return c, nil
+}
+
+// validCookieName reports whether name is an RFC 6265 token.
+func validCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if b := name[i]; b <= ' ' || b >= 0x7f || strings.IndexByte(`()<>@,;:\"/[]?={}`, b) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validCookieDomain reports whether domain is empty or a host name.
+func validCookieDomain(domain string) bool {
+	if domain == "" {
+		return true
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			if b := label[i]; !('a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || b == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isSecure reports whether cookies set in response to the request are Secure.
+// In auto mode they are when the request came over TLS, directly or through a
+// trusted proxy that says so in X-Forwarded-Proto.
+func (c *cookieSettings) isSecure(req *http.Request) bool {
+	switch c.secure {
+	case secureAlways:
+		return true
+	case secureNever:
+		return false
+	}
+	if req.TLS != nil {
+		return true
+	}
+	if c.proxies == nil || !c.proxies.isTrusted(remoteIP(req)) {
+		return false
+	}
+	proto, _, _ := strings.Cut(req.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// set sets the cookie with the shared attributes. The caller sets its name,
+// value and lifetime. Partitioned is only added to Secure cookies, which
+// browsers require of it.
+func (c *cookieSettings) set(rw http.ResponseWriter, req *http.Request, cookie *http.Cookie) {
+	cookie.Path = c.path
+	cookie.Domain = c.domain
+	cookie.HttpOnly = true
+	cookie.Secure = c.isSecure(req)
+	cookie.SameSite = c.sameSite
+	value := cookie.String()
+	if value == "" {
+		return
+	}
+	if c.partitioned && cookie.Secure {
+		value += "; Partitioned"
+	}
+	rw.Header().Add("Set-Cookie", value)
+}
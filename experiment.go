@@ -0,0 +1,343 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidExperiment = errors.New("invalid experiment")
+
+// allocationSeedSuffix derives the seed of the enrollment hash from the salt,
+// so that enrollment and variant assignment are independent: raising the
+// allocation only adds users and never moves enrolled users between variants.
+const allocationSeedSuffix = ".allocation"
+
+// experiment is a compiled experiment. Allocation and bounds are in buckets out
+// of hashModulo.
+type experiment struct {
+	name       string
+	salt       string
+	allocation int
+	variants   []config.ExperimentVariant
+	// control is the index of the control variant: the canary's control, or
+	// else the first variant. Held out users get its backend.
+	control int
+	// bounds holds the exclusive upper bucket of each variant. It is nil if
+	// a variant has a ramp, and the shares are then computed per request.
+	bounds []int
+	// ramps holds the compiled ramp of each variant, or nil.
+	ramps []*ramp
+	// arms and canaries are set when the experiment has a canary. They hold
+	// each variant's arm and canary; the control has no canary.
+	arms     []*canaryArm
+	canaries []*canary
+	routes   []RoutingRule
+	bucketBy bucketChain
+	hash     bucketHasher
+	// layer is set when the experiment is in a layer. It then enrolls the
+	// keys whose layer bucket is in [layerStart, layerStart+allocation).
+	layer      *layer
+	layerStart int
+	// srm tests the assignments for a sample ratio mismatch.
+	srm *srmTracker
+}
+
+// compileExperiments validates the experiments and compiles their routes.
+func (re *RuleEngine) compileExperiments() error {
+	seen := make(map[string]bool, len(re.config.Experiments))
+	for _, cfg := range re.config.Experiments {
+		e, err := newExperiment(cfg)
+		if err != nil {
+			return err
+		}
+		if e.bucketBy, err = re.parseBucketChain(cfg.BucketBy); err != nil {
+			return fmt.Errorf("experiment %s: %w", e.name, err)
+		}
+		if seen[e.name] {
+			return fmt.Errorf("%w: duplicate name %q", errInvalidExperiment, e.name)
+		}
+		if cfg.Layer != "" {
+			if err := re.joinLayer(e, cfg); err != nil {
+				return err
+			}
+		}
+		if canaryConfigured(cfg.Canary) {
+			if err := re.compileExperimentCanary(e, cfg.Canary); err != nil {
+				return fmt.Errorf("experiment %s: %w", e.name, err)
+			}
+		}
+		seen[e.name] = true
+		for _, route := range e.routes {
+			if err := re.compilePath(route); err != nil {
+				return fmt.Errorf("experiment %s: %w", e.name, err)
+			}
+		}
+		re.experiments = append(re.experiments, e)
+	}
+	return nil
+}
+
+func newExperiment(cfg config.Experiment) (*experiment, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("%w: name is required", errInvalidExperiment)
+	}
+	if cfg.Allocation < 0 || cfg.Allocation > maxPercentage {
+		return nil, fmt.Errorf("%w %s: allocation must be between 0 and 100", errInvalidExperiment, cfg.Name)
+	}
+	if len(cfg.Variants) == 0 || len(cfg.Routes) == 0 {
+		return nil, fmt.Errorf("%w %s: variants and routes are required", errInvalidExperiment, cfg.Name)
+	}
+	e := &experiment{
+		name:       cfg.Name,
+		salt:       cfg.Salt,
+		allocation: int(math.Round(cfg.Allocation * hashModulo / maxPercentage)),
+		variants:   cfg.Variants,
+	}
+	if e.salt == "" {
+		e.salt = cfg.Name
+	}
+	algorithm, err := parseHashAlgorithm(cfg.HashAlgorithm)
+	if err != nil {
+		return nil, fmt.Errorf("experiment %s: %w", cfg.Name, err)
+	}
+	e.hash = bucketHashers[algorithm]
+
+	var total float64
+	ramped := false
+	names := make(map[string]bool, len(cfg.Variants))
+	for _, variant := range cfg.Variants {
+		if variant.Name == "" || variant.Backend == "" {
+			return nil, fmt.Errorf("%w %s: variants need a name and a backend", errInvalidExperiment, cfg.Name)
+		}
+		if names[variant.Name] {
+			return nil, fmt.Errorf("%w %s: duplicate variant %q", errInvalidExperiment, cfg.Name, variant.Name)
+		}
+		names[variant.Name] = true
+		if variant.Weight < 0 {
+			return nil, fmt.Errorf("%w %s: variant %s has a negative weight", errInvalidExperiment, cfg.Name, variant.Name)
+		}
+		r, err := compileRamp(variant.Ramp)
+		if err != nil {
+			return nil, fmt.Errorf("experiment %s: variant %s: %w", cfg.Name, variant.Name, err)
+		}
+		if r != nil {
+			r.label = "experiment " + cfg.Name + " variant " + variant.Name
+			ramped = true
+		}
+		e.ramps = append(e.ramps, r)
+		total += variant.Weight
+	}
+	if total == 0 && !ramped {
+		return nil, fmt.Errorf("%w %s: variant weights must not all be zero", errInvalidExperiment, cfg.Name)
+	}
+	if !ramped {
+		var cumulative float64
+		for _, variant := range cfg.Variants {
+			cumulative += variant.Weight
+			e.bounds = append(e.bounds, int(math.Round(cumulative/total*hashModulo)))
+		}
+	}
+
+	for _, route := range cfg.Routes {
+		if route.Path == "" && route.PathPrefix == "" && route.PathPattern == "" {
+			return nil, fmt.Errorf("%w %s: routes need a path, pathPrefix or pathPattern", errInvalidExperiment, cfg.Name)
+		}
+		e.routes = append(e.routes, RoutingRule{
+			Path:        route.Path,
+			PathPrefix:  route.PathPrefix,
+			PathPattern: route.PathPattern,
+			Method:      route.Method,
+		})
+	}
+	return e, nil
+}
+
+// assign returns the position of the variant the key is assigned to, or false
+// if the key is outside the allocation. It only depends on the hash
+// algorithm, the salt, the allocation, the weights, the ramps at now, the
+// rolled back variants, the layer range and the key.
+func (e *experiment) assign(key string, now time.Time) (int, bool) {
+	if !e.enrolls(key) {
+		return 0, false
+	}
+	b := e.hash(e.salt, key)
+	if e.bounds == nil || e.anyRolledBack() {
+		return e.assignShares(b, now)
+	}
+	for i, bound := range e.bounds {
+		if b < bound {
+			return i, true
+		}
+	}
+	return len(e.bounds) - 1, true
+}
+
+// assignShares assigns a bucket when variants have ramps or were rolled back.
+// A ramped variant gets its ramp's value as a percentage of the enrolled
+// users, scaled down if the ramps add up to more than 100. The other variants
+// share the rest by weight. Rolled back variants get nothing. Buckets left
+// over when only ramped variants exist are not enrolled.
+func (e *experiment) assignShares(b int, now time.Time) (int, bool) {
+	scale, rest, static := e.shareScale(now)
+	var cumulative float64
+	for i, variant := range e.variants {
+		switch {
+		case e.rolledBack(i):
+		case e.ramps[i] != nil:
+			cumulative += e.ramps[i].value(now) * scale
+		case static > 0:
+			cumulative += rest * variant.Weight / static
+		}
+		if b < int(math.Round(cumulative*hashModulo/maxPercentage)) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// shareScale returns the factor that scales ramps down to 100 at most, the
+// percentage left to the static variants and the sum of their weights. Rolled
+// back variants count for neither.
+func (e *experiment) shareScale(now time.Time) (scale, rest, static float64) {
+	var ramped float64
+	for i, variant := range e.variants {
+		switch {
+		case e.rolledBack(i):
+		case e.ramps[i] != nil:
+			ramped += e.ramps[i].value(now)
+		default:
+			static += variant.Weight
+		}
+	}
+	scale = 1.0
+	if ramped > maxPercentage {
+		scale = maxPercentage / ramped
+	}
+	return scale, maxPercentage - ramped*scale, static
+}
+
+// shares fills dst with the percentage of the enrolled keys each variant gets
+// at now.
+func (e *experiment) shares(now time.Time, dst []float64) {
+	if e.bounds != nil && !e.anyRolledBack() {
+		previous := 0
+		for i, bound := range e.bounds {
+			dst[i] = float64(bound-previous) * maxPercentage / hashModulo
+			previous = bound
+		}
+		return
+	}
+	scale, rest, static := e.shareScale(now)
+	for i, variant := range e.variants {
+		switch {
+		case e.rolledBack(i):
+			dst[i] = 0
+		case e.ramps[i] != nil:
+			dst[i] = e.ramps[i].value(now) * scale
+		case static > 0:
+			dst[i] = rest * variant.Weight / static
+		default:
+			dst[i] = 0
+		}
+	}
+}
+
+// rolledBack reports whether the canary of the variant at position i rolled
+// it back.
+func (e *experiment) rolledBack(i int) bool {
+	return e.canaries != nil && e.canaries[i] != nil && e.canaries[i].isRolledBack()
+}
+
+func (e *experiment) anyRolledBack() bool {
+	for i := range e.canaries {
+		if e.rolledBack(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether one of the experiment's routes matches the request.
+func (e *experiment) covers(re *RuleEngine, req *http.Request) bool {
+	for _, route := range e.routes {
+		if re.matchPath(req, route) && re.matchMethod(req, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// enrolls reports whether the key is inside the allocation: its layer range
+// for experiments in a layer, or else the experiment's own enrollment hash.
+func (e *experiment) enrolls(key string) bool {
+	if e.layer != nil {
+		b := e.hash(e.layer.salt, key)
+		return b >= e.layerStart && b < e.layerStart+e.allocation
+	}
+	return e.hash(e.salt+allocationSeedSuffix, key) < e.allocation
+}
+
+// selectExperiment routes requests covered by an experiment to the backend of
+// their sticky variant, or else of the variant their bucketing key is assigned
+// to. Experiments are tried in
+// configuration order; requests outside every allocation or without a
+// bucketing key are left to the rules. Requests in the holdout get the control
+// variant of the first experiment covering them, without being enrolled.
+func (a *Forklift) selectExperiment(req *http.Request, sessionID string) (SelectedBackend, bool) {
+	if len(a.ruleEngine.experiments) > 0 && a.ruleEngine.inHoldout(req, sessionID) {
+		for _, e := range a.ruleEngine.experiments {
+			if e.covers(a.ruleEngine, req) {
+				control := e.variants[e.control]
+				a.ruleEngine.logDebugf("Request is in the holdout, routing to the control variant %s of experiment %s at %s", control.Name, e.name, control.Backend)
+				return SelectedBackend{Backend: control.Backend}, true
+			}
+		}
+		return SelectedBackend{}, false
+	}
+	for _, e := range a.ruleEngine.experiments {
+		if !e.covers(a.ruleEngine, req) {
+			continue
+		}
+		if i, ok := a.ruleEngine.stickyVariant(req, e); ok {
+			variant := e.variants[i]
+			if e.srm != nil {
+				e.srm.request(a.ruleEngine.now(), i)
+			}
+			a.ruleEngine.logDebugf("Experiment %s keeps sticky variant %s, routing to %s", e.name, variant.Name, variant.Backend)
+			return SelectedBackend{Backend: variant.Backend, Experiment: e.name, Variant: variant.Name}, true
+		}
+		key, ok := a.ruleEngine.bucketKeyOf(req, e.bucketBy, sessionID, stateOf(req).pathParams)
+		if !ok {
+			continue
+		}
+		now := a.ruleEngine.now()
+		a.ruleEngine.observeRamps(e, now)
+		i, enrolled := e.assign(key, now)
+		if !enrolled {
+			a.ruleEngine.logDebugf("Bucketing key is outside the allocation of experiment %s", e.name)
+			continue
+		}
+		if e.srm != nil {
+			e.srm.decideVariant(now, e, i)
+		}
+		variant := e.variants[i]
+		a.ruleEngine.recordAssignment(req, e.name, variant.Name)
+		a.ruleEngine.logDebugf("Experiment %s assigned variant %s, routing to %s", e.name, variant.Name, variant.Backend)
+		return SelectedBackend{Backend: variant.Backend, Experiment: e.name, Variant: variant.Name}, true
+	}
+	return SelectedBackend{}, false
+}
+
+// observeRamps logs changes of the experiment's variant ramps.
+func (re *RuleEngine) observeRamps(e *experiment, now time.Time) {
+	for _, r := range e.ramps {
+		if r != nil {
+			re.observeRamp(r, now)
+		}
+	}
+}
@@ -0,0 +1,579 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var errInvalidExpr = errors.New("invalid expression")
+
+// exprType is the static type of an expression node.
+type exprType int
+
+const (
+	exprBool exprType = iota
+	exprString
+	exprNumber
+)
+
+func (t exprType) String() string {
+	switch t {
+	case exprBool:
+		return "bool"
+	case exprString:
+		return "string"
+	default:
+		return "number"
+	}
+}
+
+// exprValue holds the result of evaluating an expression node.
+type exprValue struct {
+	s string
+	n float64
+	b bool
+}
+
+// exprNode is a type-checked node of a compiled rule expression.
+type exprNode interface {
+	typ() exprType
+	eval(re *RuleEngine, req *http.Request) exprValue
+}
+
+// exprFunc describes a function callable from rule expressions.
+type exprFunc struct {
+	args   []exprType
+	result exprType
+	call   func(re *RuleEngine, req *http.Request, args []exprValue) exprValue
+}
+
+// exprVars are the identifiers available to rule expressions.
+var exprVars = map[string]func(re *RuleEngine, req *http.Request) string{
+	"path":   func(_ *RuleEngine, req *http.Request) string { return req.URL.Path },
+	"method": func(_ *RuleEngine, req *http.Request) string { return req.Method },
+	"host":   func(_ *RuleEngine, req *http.Request) string { return req.Host },
+	"ip":     func(re *RuleEngine, req *http.Request) string { return re.clientIP(req) },
+	"scheme": func(_ *RuleEngine, req *http.Request) string { return requestScheme(req) },
+	"port":   func(_ *RuleEngine, req *http.Request) string { return requestPort(req) },
+}
+
+// exprFuncs are the functions available to rule expressions.
+var exprFuncs = map[string]exprFunc{
+	"header": {
+		args: []exprType{exprString}, result: exprString,
+		call: func(_ *RuleEngine, req *http.Request, args []exprValue) exprValue {
+			return exprValue{s: req.Header.Get(args[0].s)}
+		},
+	},
+	"query": {
+		args: []exprType{exprString}, result: exprString,
+		call: func(_ *RuleEngine, req *http.Request, args []exprValue) exprValue {
+			return exprValue{s: req.URL.Query().Get(args[0].s)}
+		},
+	},
+	"cookie": {
+		args: []exprType{exprString}, result: exprString,
+		call: func(_ *RuleEngine, req *http.Request, args []exprValue) exprValue {
+			cookie, err := req.Cookie(args[0].s)
+			if err != nil {
+				return exprValue{}
+			}
+			return exprValue{s: cookie.Value}
+		},
+	},
+	"param": {
+		args: []exprType{exprString}, result: exprString,
+		call: func(_ *RuleEngine, req *http.Request, args []exprValue) exprValue {
+			return exprValue{s: stateOf(req).pathParams[args[0].s]}
+		},
+	},
+	"lower": {
+		args: []exprType{exprString}, result: exprString,
+		call: func(_ *RuleEngine, _ *http.Request, args []exprValue) exprValue {
+			return exprValue{s: strings.ToLower(args[0].s)}
+		},
+	},
+	"contains": {
+		args: []exprType{exprString, exprString}, result: exprBool,
+		call: func(_ *RuleEngine, _ *http.Request, args []exprValue) exprValue {
+			return exprValue{b: strings.Contains(args[0].s, args[1].s)}
+		},
+	},
+	"startsWith": {
+		args: []exprType{exprString, exprString}, result: exprBool,
+		call: func(_ *RuleEngine, _ *http.Request, args []exprValue) exprValue {
+			return exprValue{b: strings.HasPrefix(args[0].s, args[1].s)}
+		},
+	},
+	"endsWith": {
+		args: []exprType{exprString, exprString}, result: exprBool,
+		call: func(_ *RuleEngine, _ *http.Request, args []exprValue) exprValue {
+			return exprValue{b: strings.HasSuffix(args[0].s, args[1].s)}
+		},
+	},
+}
+
+// compileExpr parses and type-checks a rule expression. The result must be a boolean.
+func compileExpr(src string) (exprNode, error) {
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("%w: unexpected %q at offset %d", errInvalidExpr, tok.text, tok.pos)
+	}
+	if node.typ() != exprBool {
+		return nil, fmt.Errorf("%w: expression must be bool, got %s", errInvalidExpr, node.typ())
+	}
+	return node, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// exprOperators lists the operators, two-character operators first.
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "!", "<", ">"}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, exprToken{kind: tokLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, exprToken{kind: tokRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, exprToken{kind: tokComma, text: ",", pos: i})
+			i++
+		case c == '"' || c == '\'':
+			tok, next, err := lexString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+			i = next
+		case isDigit(c) || (c == '-' && i+1 < len(src) && isDigit(src[i+1])):
+			start := i
+			i++
+			for i < len(src) && (isDigit(src[i]) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokNumber, text: src[start:i], pos: start})
+		case isIdentStart(c):
+			start := i
+			for i < len(src) && (isIdentStart(src[i]) || isDigit(src[i])) {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokIdent, text: src[start:i], pos: start})
+		default:
+			op := matchOperator(src[i:])
+			if op == "" {
+				return nil, fmt.Errorf("%w: unexpected character %q at offset %d", errInvalidExpr, c, i)
+			}
+			tokens = append(tokens, exprToken{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, exprToken{kind: tokEOF, pos: len(src)}), nil
+}
+
+func lexString(src string, start int) (exprToken, int, error) {
+	quote := src[start]
+	var sb strings.Builder
+	for i := start + 1; i < len(src); i++ {
+		switch src[i] {
+		case quote:
+			return exprToken{kind: tokString, text: sb.String(), pos: start}, i + 1, nil
+		case '\\':
+			if i+1 < len(src) {
+				i++
+			}
+		}
+		sb.WriteByte(src[i])
+	}
+	return exprToken{}, 0, fmt.Errorf("%w: unterminated string at offset %d", errInvalidExpr, start)
+}
+
+func matchOperator(s string) string {
+	for _, op := range exprOperators {
+		if strings.HasPrefix(s, op) {
+			return op
+		}
+	}
+	return ""
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) acceptOp(op string) bool {
+	if tok := p.peek(); tok.kind == tokOp && tok.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOp("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if err := requireBool("||", left, right); err != nil {
+			return nil, err
+		}
+		left = &logicalNode{or: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOp("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if err := requireBool("&&", left, right); err != nil {
+			return nil, err
+		}
+		left = &logicalNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.acceptOp("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if err := requireBool("!", operand); err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	if tok.kind != tokOp || !isComparisonOp(tok.text) {
+		return left, nil
+	}
+	p.pos++
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	return newCompareNode(tok.text, left, right)
+}
+
+func isComparisonOp(op string) bool {
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokRParen {
+			return nil, fmt.Errorf("%w: expected ) at offset %d", errInvalidExpr, closing.pos)
+		}
+		return node, nil
+	case tokString:
+		return &literalNode{t: exprString, v: exprValue{s: tok.text}}, nil
+	case tokNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid number %q at offset %d", errInvalidExpr, tok.text, tok.pos)
+		}
+		return &literalNode{t: exprNumber, v: exprValue{n: n, s: tok.text}}, nil
+	case tokIdent:
+		return p.parseIdent(tok)
+	default:
+		return nil, fmt.Errorf("%w: unexpected %q at offset %d", errInvalidExpr, tok.text, tok.pos)
+	}
+}
+
+func (p *exprParser) parseIdent(tok exprToken) (exprNode, error) {
+	switch tok.text {
+	case "true":
+		return &literalNode{t: exprBool, v: exprValue{b: true}}, nil
+	case "false":
+		return &literalNode{t: exprBool}, nil
+	}
+	if p.peek().kind != tokLParen {
+		getter, ok := exprVars[tok.text]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown identifier %q at offset %d", errInvalidExpr, tok.text, tok.pos)
+		}
+		return &varNode{get: getter}, nil
+	}
+	p.pos++
+	var args []exprNode
+	for p.peek().kind != tokRParen {
+		if len(args) > 0 {
+			if comma := p.next(); comma.kind != tokComma {
+				return nil, fmt.Errorf("%w: expected , at offset %d", errInvalidExpr, comma.pos)
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.pos++
+	return newCallNode(tok, args)
+}
+
+func requireBool(op string, operands ...exprNode) error {
+	for _, operand := range operands {
+		if operand.typ() != exprBool {
+			return fmt.Errorf("%w: operator %s requires bool operands, got %s", errInvalidExpr, op, operand.typ())
+		}
+	}
+	return nil
+}
+
+type literalNode struct {
+	t exprType
+	v exprValue
+}
+
+func (n *literalNode) typ() exprType { return n.t }
+
+func (n *literalNode) eval(_ *RuleEngine, _ *http.Request) exprValue { return n.v }
+
+type varNode struct {
+	get func(re *RuleEngine, req *http.Request) string
+}
+
+func (n *varNode) typ() exprType { return exprString }
+
+func (n *varNode) eval(re *RuleEngine, req *http.Request) exprValue {
+	return exprValue{s: n.get(re, req)}
+}
+
+type notNode struct {
+	operand exprNode
+}
+
+func (n *notNode) typ() exprType { return exprBool }
+
+func (n *notNode) eval(re *RuleEngine, req *http.Request) exprValue {
+	return exprValue{b: !n.operand.eval(re, req).b}
+}
+
+type logicalNode struct {
+	or          bool
+	left, right exprNode
+}
+
+func (n *logicalNode) typ() exprType { return exprBool }
+
+func (n *logicalNode) eval(re *RuleEngine, req *http.Request) exprValue {
+	left := n.left.eval(re, req).b
+	if left == n.or {
+		return exprValue{b: left}
+	}
+	return n.right.eval(re, req)
+}
+
+type compareNode struct {
+	op          string
+	numeric     bool
+	left, right exprNode
+}
+
+// newCompareNode type-checks a comparison. Bools only support equality, and a
+// string compared with a number is parsed as a number at evaluation time.
+func newCompareNode(op string, left, right exprNode) (exprNode, error) {
+	lt, rt := left.typ(), right.typ()
+	if lt == exprBool || rt == exprBool {
+		if lt != rt || (op != "==" && op != "!=") {
+			return nil, fmt.Errorf("%w: cannot apply %s to %s and %s", errInvalidExpr, op, lt, rt)
+		}
+	}
+	numeric := lt == exprNumber || rt == exprNumber || (op != "==" && op != "!=" && lt != exprBool)
+	return &compareNode{op: op, numeric: numeric, left: left, right: right}, nil
+}
+
+func (n *compareNode) typ() exprType { return exprBool }
+
+func (n *compareNode) eval(re *RuleEngine, req *http.Request) exprValue {
+	left, right := n.left.eval(re, req), n.right.eval(re, req)
+	if n.left.typ() == exprBool {
+		return exprValue{b: (left.b == right.b) == (n.op == "==")}
+	}
+	if !n.numeric {
+		return exprValue{b: (left.s == right.s) == (n.op == "==")}
+	}
+	l, lok := exprNumberOf(n.left.typ(), left)
+	r, rok := exprNumberOf(n.right.typ(), right)
+	if !lok || !rok {
+		return exprValue{b: n.op == "!="}
+	}
+	return exprValue{b: compareNumbers(n.op, l, r)}
+}
+
+func exprNumberOf(t exprType, v exprValue) (float64, bool) {
+	if t == exprNumber {
+		return v.n, true
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(v.s), 64)
+	return n, err == nil
+}
+
+func compareNumbers(op string, l, r float64) bool {
+	switch op {
+	case "==":
+		return l == r
+	case "!=":
+		return l != r
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	default:
+		return l >= r
+	}
+}
+
+type callNode struct {
+	fn   exprFunc
+	args []exprNode
+}
+
+// newCallNode type-checks a function call. matches() is handled here so its
+// pattern is compiled once, when the rule set is loaded.
+func newCallNode(tok exprToken, args []exprNode) (exprNode, error) {
+	if tok.text == "matches" {
+		return newMatchesNode(tok, args)
+	}
+	fn, ok := exprFuncs[tok.text]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown function %q at offset %d", errInvalidExpr, tok.text, tok.pos)
+	}
+	if len(args) != len(fn.args) {
+		return nil, fmt.Errorf("%w: %s expects %d arguments, got %d", errInvalidExpr, tok.text, len(fn.args), len(args))
+	}
+	for i, arg := range args {
+		if arg.typ() != fn.args[i] {
+			return nil, fmt.Errorf("%w: argument %d of %s must be %s, got %s", errInvalidExpr, i+1, tok.text, fn.args[i], arg.typ())
+		}
+	}
+	return &callNode{fn: fn, args: args}, nil
+}
+
+func (n *callNode) typ() exprType { return n.fn.result }
+
+func (n *callNode) eval(re *RuleEngine, req *http.Request) exprValue {
+	args := make([]exprValue, len(n.args))
+	for i, arg := range n.args {
+		args[i] = arg.eval(re, req)
+	}
+	return n.fn.call(re, req, args)
+}
+
+type matchesNode struct {
+	subject exprNode
+	pattern *regexp.Regexp
+}
+
+func newMatchesNode(tok exprToken, args []exprNode) (exprNode, error) {
+	if len(args) != 2 || args[0].typ() != exprString {
+		return nil, fmt.Errorf("%w: matches expects a string and a pattern at offset %d", errInvalidExpr, tok.pos)
+	}
+	literal, ok := args[1].(*literalNode)
+	if !ok || literal.t != exprString {
+		return nil, fmt.Errorf("%w: matches pattern must be a string literal at offset %d", errInvalidExpr, tok.pos)
+	}
+	pattern, err := regexp.Compile(literal.v.s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidExpr, err)
+	}
+	return &matchesNode{subject: args[0], pattern: pattern}, nil
+}
+
+func (n *matchesNode) typ() exprType { return exprBool }
+
+func (n *matchesNode) eval(re *RuleEngine, req *http.Request) exprValue {
+	return exprValue{b: n.pattern.MatchString(n.subject.eval(re, req).s)}
+}
@@ -7,9 +7,9 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"hash"
-	"hash/fnv"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"sort"
 	"strconv"
@@ -36,8 +36,6 @@ var (
 )
 
 const (
-	sessionCookieName    = "forklift_id"
-	sessionCookieMaxAge  = 86400 * 30
 	cacheDuration        = 24 * time.Hour
 	cacheCleanupInterval = 10 * time.Minute
 	maxSessionIDLength   = 128
@@ -62,17 +60,281 @@ type RuleEngine struct {
 	config *config.Config
 	cache  *sync.Map
 	logger logger.Logger
+	// exprs holds the compiled rule expressions, keyed by their source.
+	exprs map[string]exprNode
+	// networks holds the parsed CIDR lists of ip conditions, keyed by the condition value.
+	networks map[string][]*net.IPNet
+	// jsonPaths holds the parsed selectors of json conditions, keyed by the condition parameter.
+	jsonPaths map[string][]jsonPathStep
+	// clientIPResolver is set when trusted proxies are configured.
+	clientIPResolver *clientIPResolver
+	// jwtVerifier is set when a JWT secret or key is configured.
+	jwtVerifier *jwtVerifier
+	// geoIP is set when a GeoIP database is configured.
+	geoIP *geoIP
+	// index is the rule set compiled for matching.
+	index *ruleIndex
+	// lists holds the targeting lists of inList conditions, keyed by name.
+	lists map[string]*targetList
+	// pathPatterns holds the compiled path patterns of the rules, keyed by their source.
+	pathPatterns map[string]*pathPattern
+	// schedules holds the compiled schedule conditions, keyed by scheduleKey.
+	schedules map[string]*schedule
+	// bucketChains holds the parsed bucketBy lists of the rules, keyed by bucketChainKey.
+	bucketChains map[string]bucketChain
+	// experiments holds the compiled experiments in configuration order.
+	experiments []*experiment
+	// layers holds the compiled layers, keyed by name.
+	layers map[string]*layer
+	// holdout is set when a global holdout is configured.
+	holdout *holdout
+	// name is the middleware's name, which keeps canary rollbacks across reloads.
+	name string
+	// bandits holds the bandits of the rule groups.
+	bandits []*bandit
+	// cookies holds the session cookie settings.
+	cookies *cookieSettings
+	// assignmentMaxAge is the lifetime of the sticky assignment cookie.
+	assignmentMaxAge time.Duration
+	// times holds the parsed activeFrom/activeUntil timestamps of the rules.
+	times map[string]time.Time
+	// now is the clock used for everything time-dependent.
+	now func() time.Time
 }
 
 // NewRuleEngine creates a new RuleEngine instance.
 func NewRuleEngine(cfg *config.Config, logger logger.Logger) *RuleEngine {
 	return &RuleEngine{
-		config: cfg,
-		cache:  &sync.Map{},
-		logger: logger,
+		config:       cfg,
+		cache:        &sync.Map{},
+		logger:       logger,
+		exprs:        make(map[string]exprNode),
+		networks:     make(map[string][]*net.IPNet),
+		jsonPaths:    make(map[string][]jsonPathStep),
+		pathPatterns: make(map[string]*pathPattern),
+		bucketChains: make(map[string]bucketChain),
+		schedules:    make(map[string]*schedule),
+		times:        make(map[string]time.Time),
+		now:          time.Now,
 	}
 }
 
+// compile prepares everything the rules need at request time, so that
+// configuration errors surface when the middleware is created.
+func (re *RuleEngine) compile() error {
+	if clientIP := re.config.ClientIP; len(clientIP.TrustedProxies) > 0 {
+		resolver, err := newClientIPResolver(clientIP.Header, clientIP.TrustedProxies, clientIP.Depth)
+		if err != nil {
+			return fmt.Errorf("client IP: %w", err)
+		}
+		re.clientIPResolver = resolver
+	}
+	if jwt := re.config.JWT; jwt.Secret != "" || jwt.PublicKeyFile != "" || jwt.JWKSFile != "" {
+		verifier, err := newJWTVerifier(jwt)
+		if err != nil {
+			return fmt.Errorf("jwt: %w", err)
+		}
+		re.jwtVerifier = verifier
+	}
+	if geo := re.config.GeoIP; geo.Database != "" || geo.ASNDatabase != "" {
+		g, err := newGeoIP(geo)
+		if err != nil {
+			return fmt.Errorf("geoIP: %w", err)
+		}
+		re.geoIP = g
+	}
+	lists, err := newTargetLists(re.config.Lists)
+	if err != nil {
+		return err
+	}
+	re.lists = lists
+	for _, list := range lists {
+		re.logListStats(list)
+	}
+	if path := re.config.CanaryStateFile; path != "" {
+		if err := loadCanaryState(path); err != nil {
+			return err
+		}
+	}
+	for i, rule := range re.config.Rules {
+		if err := re.compileRule(rule); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	if err := re.compileLayers(); err != nil {
+		return err
+	}
+	if err := re.compileExperiments(); err != nil {
+		return err
+	}
+	if err := re.compileHoldout(); err != nil {
+		return err
+	}
+	cookies, err := compileCookieSettings(re.config.SessionCookie)
+	if err != nil {
+		return err
+	}
+	cookies.proxies = re.clientIPResolver
+	re.cookies = cookies
+	re.assignmentMaxAge = cookies.maxAge
+	if maxAge := re.config.StickyAssignments.MaxAge; maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("%w: %q", errInvalidAssignmentMaxAge, maxAge)
+		}
+		re.assignmentMaxAge = d
+	}
+	re.index = newRuleIndex(re.config.Rules)
+	for i := range re.index.entries {
+		entry := &re.index.entries[i]
+		entry.bucketBy = defaultBucketChain
+		if chain, ok := re.bucketChains[bucketChainKey(entry.rule.BucketBy)]; ok {
+			entry.bucketBy = chain
+		}
+		if entry.ramp, _ = compileRamp(entry.rule.Ramp); entry.ramp != nil {
+			entry.ramp.label = "rule " + splitLabel(groupKey(entry.rule), entry.rule.Method) + " to " + entry.rule.Backend
+		}
+		entry.shard, _ = newShardRing(entry.rule.Shard)
+		if algorithm, _ := parseRuleHashAlgorithm(entry.rule.HashAlgorithm); algorithm != hashLegacy {
+			entry.hash = bucketHashers[algorithm]
+			entry.salt = ruleSalt(entry.rule)
+		}
+	}
+	re.compileRuleCanaries()
+	if err := re.compileBandits(); err != nil {
+		return err
+	}
+	if err := re.validateSplits(); err != nil {
+		return err
+	}
+	return re.compileSampleRatios()
+}
+
+func (re *RuleEngine) compileRule(rule RoutingRule) error {
+	start, end, err := parseTimeWindow(rule.ActiveFrom, rule.ActiveUntil)
+	if err != nil {
+		return err
+	}
+	if !start.IsZero() {
+		re.times[rule.ActiveFrom] = start
+	}
+	if !end.IsZero() {
+		re.times[rule.ActiveUntil] = end
+	}
+	if err := re.compilePath(rule); err != nil {
+		return err
+	}
+	if _, err := parseRuleHashAlgorithm(rule.HashAlgorithm); err != nil {
+		return err
+	}
+	if _, err := compileRamp(rule.Ramp); err != nil {
+		return err
+	}
+	if rampConfigured(rule.Ramp) && rule.Percentage != 0 {
+		return fmt.Errorf("%w: percentage and ramp are mutually exclusive", errInvalidRamp)
+	}
+	if err := re.validateRuleCanary(rule); err != nil {
+		return err
+	}
+	if err := re.validateBandit(rule); err != nil {
+		return err
+	}
+	if err := validateRemainder(rule); err != nil {
+		return err
+	}
+	if err := validateShard(rule); err != nil {
+		return err
+	}
+	if len(rule.BucketBy) > 0 {
+		chain, err := re.parseBucketChain(rule.BucketBy)
+		if err != nil {
+			return err
+		}
+		re.bucketChains[bucketChainKey(rule.BucketBy)] = chain
+	}
+	for _, condition := range rule.Conditions {
+		if err := re.compileCondition(condition); err != nil {
+			return err
+		}
+	}
+	if _, ok := re.exprs[rule.Expr]; rule.Expr == "" || ok {
+		return nil
+	}
+	node, err := compileExpr(rule.Expr)
+	if err != nil {
+		return err
+	}
+	re.exprs[rule.Expr] = node
+	return nil
+}
+
+func (re *RuleEngine) compilePath(rule RoutingRule) error {
+	if rule.PathPattern != "" {
+		pattern, err := compilePathPattern(rule.PathPattern)
+		if err != nil {
+			return err
+		}
+		re.pathPatterns[rule.PathPattern] = pattern
+	}
+	if rule.PathRewrite == "" {
+		return nil
+	}
+	if rule.PathPrefixRewrite != "" {
+		return fmt.Errorf("%w: pathRewrite and pathPrefixRewrite are mutually exclusive", errInvalidPathRewrite)
+	}
+	return checkPathRewrite(rule.PathRewrite, re.pathPatterns[rule.PathPattern])
+}
+
+func (re *RuleEngine) compileCondition(condition RuleCondition) error {
+	operator := strings.ToLower(condition.Operator)
+	if _, ok := re.lists[condition.Value]; !ok && (operator == "inlist" || operator == "notinlist") {
+		return fmt.Errorf("%w: %s", errUnknownList, condition.Value)
+	}
+	switch strings.ToLower(condition.Type) {
+	case "ip":
+		if operator != "in" && operator != "notin" {
+			return nil
+		}
+		networks, err := parseNetworks(condition.Value)
+		if err != nil {
+			return err
+		}
+		re.networks[condition.Value] = networks
+	case "json", "jwt":
+		if strings.EqualFold(condition.Type, "jwt") && re.jwtVerifier == nil {
+			return errJWTNotConfigured
+		}
+		steps, err := parseJSONPath(condition.Parameter)
+		if err != nil {
+			return err
+		}
+		re.jsonPaths[condition.Parameter] = steps
+	case "country", "region":
+		if re.geoIP == nil || re.geoIP.city == nil {
+			return errGeoIPNotConfigured
+		}
+	case "asn":
+		if re.geoIP == nil || re.geoIP.asn == nil {
+			return errGeoIPNotConfigured
+		}
+	case "formfile":
+		if _, _, ok := splitFormFileParameter(condition.Parameter); !ok {
+			return fmt.Errorf("%w: %q", errInvalidFormFile, condition.Parameter)
+		}
+	case "graphql":
+		if !graphqlParameters[strings.ToLower(condition.Parameter)] {
+			return fmt.Errorf("%w: %q", errInvalidGraphQLParameter, condition.Parameter)
+		}
+	case "schedule":
+		s, err := parseSchedule(condition)
+		if err != nil {
+			return err
+		}
+		re.schedules[scheduleKey(condition)] = s
+	}
+	return nil
+}
+
 // CreateConfig creates a new Config.
 func CreateConfig() *config.Config {
 	return &config.Config{}
@@ -100,7 +362,7 @@ func New(ctx context.Context, next http.Handler, cfg interface{}, name string) (
 }
 
 // NewForklift creates a new middleware.
-func NewForklift(_ context.Context, next http.Handler, cfg *config.Config, name string) (*Forklift, error) {
+func NewForklift(ctx context.Context, next http.Handler, cfg *config.Config, name string) (*Forklift, error) {
 	if cfg == nil {
 		return nil, errEmptyConfig
 	}
@@ -123,12 +385,15 @@ func NewForklift(_ context.Context, next http.Handler, cfg *config.Config, name
 
 	logger := logger.NewLogger("forklift")
 
-	ruleEngine := &RuleEngine{
-		config: cfg,
-		cache:  &sync.Map{},
-		logger: logger,
+	ruleEngine := NewRuleEngine(cfg, logger)
+	ruleEngine.name = name
+	if err := ruleEngine.compile(); err != nil {
+		return nil, err
 	}
 
+	if err := ruleEngine.watch(ctx); err != nil {
+		return nil, err
+	}
 	go ruleEngine.cleanupCache()
 
 	forklift := &Forklift{
@@ -156,8 +421,9 @@ func generateSessionID() (string, error) {
 
 // ServeHTTP implements the http.Handler interface.
 func (a *Forklift) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	req = withRequestState(req)
 	if a.config.Debug {
-		a.logger.Debugf("Received request: %s %s", req.Method, req.URL.Path)
+		a.logger.Debugf("Received request: %s %s from %s", req.Method, req.URL.Path, a.ruleEngine.clientIP(req))
 		a.logger.Debugf("Headers: %v", req.Header)
 	}
 
@@ -166,7 +432,14 @@ func (a *Forklift) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	selected := a.selectBackend(req, sessionID)
+	selected, overridden := a.overrideBackend(rw, req)
+	if !overridden {
+		selected = a.selectBackend(req, sessionID)
+		a.ruleEngine.recordConversions(req)
+		a.ruleEngine.exposeBandit(req)
+		stateOf(req).canaryArms = a.ruleEngine.canaryArms(req, selected)
+	}
+	a.writeAssignments(rw, req)
 	backend := selected.Backend
 	selectedRule := selected.Rule
 
@@ -186,11 +459,11 @@ func (a *Forklift) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	a.sendProxyRequest(rw, proxyReq)
+	a.sendProxyRequest(rw, req, proxyReq)
 }
 
 func (a *Forklift) handleSessionID(rw http.ResponseWriter, req *http.Request) string {
-	sessionID := getOrCreateSessionID(rw, req)
+	sessionID := a.getOrCreateSessionID(rw, req)
 	if sessionID == "" {
 		a.logger.Errorf("Error handling session ID")
 		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
@@ -214,20 +487,65 @@ func (a *Forklift) handleSessionID(rw http.ResponseWriter, req *http.Request) st
 type SelectedBackend struct {
 	Backend string
 	Rule    *RoutingRule
+	// Experiment and Variant are set when an experiment selected the backend.
+	Experiment string
+	Variant    string
+	// Holdout is set when the request is in the global holdout.
+	Holdout bool
+}
+
+// SelectBackend returns the backend ServeHTTP would route the request to for
+// the given session. It does not proxy the request.
+func (a *Forklift) SelectBackend(req *http.Request, sessionID string) SelectedBackend {
+	if _, ok := req.Context().Value(requestStateKey{}).(*requestState); !ok {
+		req = withRequestState(req)
+	}
+	return a.selectBackend(req, sessionID)
 }
 
 func (a *Forklift) selectBackend(req *http.Request, sessionID string) SelectedBackend {
-	matchingRules := a.getMatchingRules(req)
+	selected := a.routeBackend(req, sessionID)
+	selected.Holdout = a.ruleEngine.inHoldout(req, sessionID)
+	return selected
+}
+
+// routeBackend selects the backend of the request: an experiment variant, or
+// else the backend of the first rule group that selects one.
+func (a *Forklift) routeBackend(req *http.Request, sessionID string) SelectedBackend {
+	if selected, ok := a.selectExperiment(req, sessionID); ok {
+		return selected
+	}
+
+	idx := a.ruleEngine.index
+	scratch := idx.getScratch()
+	defer idx.putScratch(scratch)
 
-	if len(matchingRules) == 0 {
+	scratch.matched = a.getMatchingRules(req, scratch)
+	if len(scratch.matched) == 0 {
 		return a.defaultBackendSelection()
 	}
+	a.logMatchingRules(scratch.matched)
 
-	a.sortRulesByPriority(matchingRules)
-	a.logMatchingRules(matchingRules)
+	// Groups are tried in order of their highest-priority matching rule.
+	for i, position := range scratch.matched {
+		group := idx.entries[position].group
+		if groupSeen(idx, scratch.matched[:i], group) {
+			continue
+		}
+		if selected := a.processGroup(req, group, sessionID, scratch); selected.Backend != "" {
+			return selected
+		}
+	}
+	return SelectedBackend{Backend: a.config.DefaultBackend, Rule: nil}
+}
 
-	rulesByPath := a.groupRulesByPath(matchingRules)
-	return a.processRulesByPath(rulesByPath, sessionID)
+func groupSeen(idx *ruleIndex, positions []int, group int) bool {
+	for _, position := range positions {
+		if idx.entries[position].group == group {
+			return true
+		}
+	}
+	return false
 }
 
 func (a *Forklift) defaultBackendSelection() SelectedBackend {
@@ -237,87 +555,141 @@ func (a *Forklift) defaultBackendSelection() SelectedBackend {
 	return SelectedBackend{Backend: a.config.DefaultBackend, Rule: nil}
 }
 
-func (a *Forklift) sortRulesByPriority(rules []RoutingRule) {
-	sort.Slice(rules, func(i, j int) bool {
-		return rules[i].Priority > rules[j].Priority
-	})
-}
-
-func (a *Forklift) logMatchingRules(rules []RoutingRule) {
+func (a *Forklift) logMatchingRules(positions []int) {
 	if a.config.Debug {
 		a.logger.Debugf("Matching rules (sorted by priority):")
-		for _, rule := range rules {
+		now := a.ruleEngine.now()
+		for _, position := range positions {
+			entry := &a.ruleEngine.index.entries[position]
+			rule := entry.rule
 			a.logger.Debugf("  - Path: %s, Method: %s, Backend: %s, Percentage: %f, Priority: %d",
-				rule.Path, rule.Method, rule.Backend, rule.Percentage, rule.Priority)
+				rule.Path, rule.Method, rule.Backend, a.ruleEngine.rulePercentage(entry, now), rule.Priority)
+			if entry.ramp != nil {
+				a.logger.Debugf("    Ramp started %s, effective percentage: %f", rule.Ramp.Start, a.ruleEngine.rulePercentage(entry, now))
+			}
 		}
 	}
 }
 
-func (a *Forklift) groupRulesByPath(rules []RoutingRule) map[string][]RoutingRule {
-	rulesByPath := make(map[string][]RoutingRule)
-	for _, rule := range rules {
-		path := rule.Path
-		if path == "" {
-			path = rule.PathPrefix
-		}
-		rulesByPath[path] = append(rulesByPath[path], rule)
-	}
-	return rulesByPath
-}
+// processGroup selects a backend among the matching rules of one group.
+func (a *Forklift) processGroup(req *http.Request, group int, sessionID string, scratch *matchScratch) SelectedBackend {
+	idx := a.ruleEngine.index
 
-func (a *Forklift) processRulesByPath(rulesByPath map[string][]RoutingRule, sessionID string) SelectedBackend {
-	for _, rules := range rulesByPath {
-		if selected := a.processRulesForPath(rules, sessionID); selected.Backend != "" {
-			return selected
+	// Check for non-percentage based rules first
+	for _, position := range scratch.matched {
+		if entry := &idx.entries[position]; entry.group == group && !isPercentageRule(entry) {
+			if entry.shard != nil {
+				return a.selectShard(req, entry, sessionID)
+			}
+			return SelectedBackend{Backend: entry.rule.Backend, Rule: &entry.rule}
 		}
 	}
-	return SelectedBackend{Backend: a.config.DefaultBackend, Rule: nil}
-}
 
-func (a *Forklift) processRulesForPath(rules []RoutingRule, sessionID string) SelectedBackend {
-	// Check for non-percentage based rules first
-	for _, rule := range rules {
-		if rule.Percentage == 0 {
-			return SelectedBackend{Backend: rule.Backend, Rule: &rule}
+	// If we reach here, we only have percentage-based rules for this group
+	if a.ruleEngine.inHoldout(req, sessionID) {
+		a.ruleEngine.logDebugf("Request is in the holdout, skipping the percentage split")
+		return SelectedBackend{Backend: "", Rule: nil}
+	}
+	if b := idx.groups[group].bandit; b != nil {
+		if entry, ok := a.ruleEngine.stickyBanditEntry(req, b, group, scratch.matched); ok {
+			if t := idx.groups[group].srm; t != nil {
+				t.request(a.ruleEngine.now(), entry.backend)
+			}
+			a.ruleEngine.pullBandit(req, entry, true)
+			return SelectedBackend{Backend: entry.rule.Backend, Rule: &entry.rule}
 		}
 	}
+	lead := a.groupLead(group, scratch)
+	key, ok := a.bucketKey(req, lead, sessionID)
+	if !ok {
+		return SelectedBackend{Backend: "", Rule: nil}
+	}
+	selectedBackend := a.selectBackendByPercentageAndRuleHash(group, lead, key, scratch)
+	a.ruleEngine.noteSplitCanaries(req, group, scratch.matched)
 
-	// If we reach here, we only have percentage-based rules for this path
-	backendPercentages := a.calculateBackendPercentages(rules)
-	selectedBackend := a.selectBackendByPercentageAndRuleHash(sessionID, backendPercentages, rules)
-
-	for _, rule := range rules {
-		if rule.Backend == selectedBackend {
-			return SelectedBackend{Backend: selectedBackend, Rule: &rule}
+	for _, position := range scratch.matched {
+		if entry := &idx.entries[position]; entry.group == group && entry.rule.Backend == selectedBackend {
+			if entry.bandit != nil {
+				a.ruleEngine.pullBandit(req, entry, false)
+			}
+			return SelectedBackend{Backend: selectedBackend, Rule: &entry.rule}
 		}
 	}
 
 	return SelectedBackend{Backend: "", Rule: nil}
 }
 
-func (a *Forklift) calculateBackendPercentages(rules []RoutingRule) map[string]float64 {
-	backendPercentages := make(map[string]float64)
-	for _, rule := range rules {
-		backendPercentages[rule.Backend] += rule.Percentage
+// groupLead returns the highest-priority matching rule of a group, whose
+// bucketBy and hashAlgorithm the group's percentage split uses.
+func (a *Forklift) groupLead(group int, scratch *matchScratch) *indexedRule {
+	for _, position := range scratch.matched {
+		if entry := &a.ruleEngine.index.entries[position]; entry.group == group {
+			return entry
+		}
 	}
-	return backendPercentages
+	return nil
 }
 
-func (a *Forklift) selectBackendByPercentageAndRuleHash(sessionID string, backendPercentages map[string]float64, matchingRules []RoutingRule) string {
-	backends := a.sortBackends(backendPercentages)
-	hashValue := a.calculateHash(sessionID, matchingRules)
+// bucketKey returns the key a percentage split led by the rule hashes.
+func (a *Forklift) bucketKey(req *http.Request, lead *indexedRule, sessionID string) (string, bool) {
+	if lead == nil || len(lead.rule.BucketBy) == 0 {
+		return sessionID, true
+	}
+	params, _ := a.ruleEngine.pathParams(req, lead.rule)
+	return a.ruleEngine.bucketKeyOf(req, lead.bucketBy, sessionID, params)
+}
 
-	totalPercentage := 0.0
-	for _, percentage := range backendPercentages {
-		totalPercentage += percentage
+func (a *Forklift) selectBackendByPercentageAndRuleHash(group int, lead *indexedRule, key string, scratch *matchScratch) string {
+	idx := a.ruleEngine.index
+	backends := idx.groups[group].backends
+	scratch.weights = append(scratch.weights[:0], make([]float64, len(backends))...)
+	scratch.present = append(scratch.present[:0], make([]bool, len(backends))...)
+	now := a.ruleEngine.now()
+	remainder := -1
+	var total float64
+	for _, position := range scratch.matched {
+		if entry := &idx.entries[position]; entry.group == group {
+			switch {
+			case entry.rule.Remainder:
+				remainder = entry.backend
+			// A bandit weighs backends, not rules.
+			case entry.bandit == nil || !scratch.present[entry.backend]:
+				percentage := a.ruleEngine.rulePercentage(entry, now)
+				scratch.weights[entry.backend] += percentage
+				total += percentage
+			}
+			scratch.present[entry.backend] = true
+		}
+	}
+	// The remainder rule takes what the other matching rules leave.
+	if remainder >= 0 && total < maxPercentage {
+		scratch.weights[remainder] += maxPercentage - total
 	}
 
-	scaledHashValue := hashValue * percentageScale // Scale hash to 0-100 range
+	// With a hashAlgorithm, bucket b in [0, 10000) selects the first backend
+	// whose cumulative percentage covers more than b/100; otherwise the legacy
+	// hash is used.
+	bucket := -1
+	var scaledHashValue float64
+	if lead != nil && lead.hash != nil {
+		bucket = lead.hash(lead.salt, key)
+		a.ruleEngine.logDebugf("Calculated bucket: %d", bucket)
+	} else {
+		hashValue := a.calculateHash(group, key, scratch.matched)
+		scaledHashValue = hashValue * percentageScale // Scale hash to 0-100 range
+	}
 
 	var cumulativePercentage float64
-	for _, backend := range backends {
-		cumulativePercentage += backendPercentages[backend]
-		if scaledHashValue <= cumulativePercentage {
+	for i, backend := range backends {
+		if !scratch.present[i] {
+			continue
+		}
+		cumulativePercentage += scratch.weights[i]
+		if bucket >= 0 && bucket < int(math.Round(cumulativePercentage*hashModulo/maxPercentage)) ||
+			bucket < 0 && scaledHashValue <= cumulativePercentage {
+			if t := idx.groups[group].srm; t != nil {
+				t.decideSplit(now, i, scratch.weights, scratch.present)
+			}
 			if a.config.Debug {
 				a.logger.Debugf("Selected backend: %s", backend)
 			}
@@ -326,104 +698,69 @@ func (a *Forklift) selectBackendByPercentageAndRuleHash(sessionID string, backen
 	}
 
 	// If no backend was selected, return the default backend
+	if t := idx.groups[group].srm; t != nil {
+		t.decideSplit(now, len(backends), scratch.weights, scratch.present)
+	}
 	if a.config.Debug {
 		a.logger.Debugf("No backend selected, using default: %s", a.config.DefaultBackend)
 	}
 	return a.config.DefaultBackend
 }
 
-func (a *Forklift) sortBackends(backendPercentages map[string]float64) []string {
-	backends := make([]string, 0, len(backendPercentages))
-	for backend := range backendPercentages {
-		backends = append(backends, backend)
-	}
-	sort.Strings(backends)
-	return backends
-}
-
-/*
-func (a *Forklift) selectBackendFromRanges(backends []string, backendPercentages map[string]float64, hashValue float64) string {
-	cumulativeRanges := a.createCumulativeRanges(backends, backendPercentages)
-
-	totalPercentage := 0.0
-	for _, percentage := range backendPercentages {
-		totalPercentage += percentage
-	}
-
-	scaledHashValue := hashValue * (totalPercentage / maxPercentage)
-
-	var selectedBackend string
-	for _, backend := range backends {
-		if scaledHashValue <= cumulativeRanges[backend] {
-			selectedBackend = backend
-			break
-		}
-	}
-
-	if selectedBackend == "" {
-		selectedBackend = backends[len(backends)-1] // Default to the last backend if no match.
-	}
-
-	return selectedBackend
-}
-
-func (a *Forklift) createCumulativeRanges(backends []string, backendPercentages map[string]float64) map[string]float64 {
-	ranges := make(map[string]float64)
-	totalPercentage := 0.0
-	for _, backend := range backends {
-		percentage := backendPercentages[backend]
-		totalPercentage += percentage
-		ranges[backend] = totalPercentage
-	}
+// FNV-1a parameters, as used by hash/fnv.New64a.
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
 
-	if totalPercentage > maxPercentage {
-		factor := maxPercentage / totalPercentage
-		for backend := range ranges {
-			ranges[backend] *= factor
+// calculateHash hashes the bucketing key and the matching rules of the group
+// with FNV-1a. It is computed inline to avoid allocating a hash.Hash64 per
+// request.
+func (a *Forklift) calculateHash(group int, key string, positions []int) float64 {
+	h := fnvAdd(fnvOffset64, key)
+	for _, position := range positions {
+		entry := &a.ruleEngine.index.entries[position]
+		if entry.group != group {
+			continue
 		}
-	}
-
-	return ranges
-}
-*/
-
-func (a *Forklift) calculateHash(sessionID string, matchingRules []RoutingRule) float64 {
-	h := fnv.New64a()
-	a.writeToHash(h, []byte(sessionID))
-
-	for _, rule := range matchingRules {
-		if rule.AffinityToken != "" {
-			a.writeToHash(h, []byte(rule.AffinityToken))
+		if entry.rule.AffinityToken != "" {
+			h = fnvAdd(h, entry.rule.AffinityToken)
 		} else {
-			a.writeToHash(h, []byte(rule.Path), []byte(rule.Method), []byte(rule.Backend))
+			h = fnvAdd(fnvAdd(fnvAdd(h, entry.rule.Path), entry.rule.Method), entry.rule.Backend)
 		}
 	}
 
-	hashValue := float64(h.Sum64()) / float64(^uint64(0))
+	hashValue := float64(h) / float64(^uint64(0))
 	if a.config.Debug {
 		a.logger.Debugf("Calculated hash value: %f", hashValue)
 	}
 	return hashValue
 }
 
-func (a *Forklift) writeToHash(h hash.Hash64, data ...[]byte) {
-	var err error
-	for _, d := range data {
-		_, err = h.Write(d)
-		if err != nil {
-			a.logger.Errorf("Error hashing data: %v", err)
-		}
+func fnvAdd(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime64
 	}
+	return h
 }
 
-func (a *Forklift) getMatchingRules(req *http.Request) []RoutingRule {
-	matchingRules := []RoutingRule{}
-	for _, rule := range a.config.Rules {
-		if a.ruleEngine.ruleMatches(req, rule) {
-			matchingRules = append(matchingRules, rule)
+// getMatchingRules returns the positions of the active rules matching the
+// request, in evaluation order.
+func (a *Forklift) getMatchingRules(req *http.Request, scratch *matchScratch) []int {
+	idx := a.ruleEngine.index
+	scratch.candidates = idx.candidates(scratch.candidates[:0], req.URL.Path, req.Method)
+	matched := scratch.matched[:0]
+	for _, position := range scratch.candidates {
+		rule := &idx.entries[position].rule
+		if !a.ruleEngine.ruleActive(*rule) {
+			continue
+		}
+		if a.ruleEngine.ruleMatches(req, *rule) {
+			matched = append(matched, position)
 		}
 	}
-	return matchingRules
+	return matched
 }
 
 func (a *Forklift) createProxyRequest(req *http.Request, backend string, selectedRule *RoutingRule) (*http.Request, error) {
@@ -436,6 +773,7 @@ func (a *Forklift) createProxyRequest(req *http.Request, backend string, selecte
 	if err != nil {
 		return nil, err
 	}
+	proxyReq.ContentLength = req.ContentLength
 
 	// Copy headers from the original request
 	proxyReq.Header = make(http.Header)
@@ -456,6 +794,9 @@ func (a *Forklift) createProxyRequest(req *http.Request, backend string, selecte
 
 func (a *Forklift) constructBackendURL(req *http.Request, backend string, selectedRule *RoutingRule) string {
 	backendPath := req.URL.Path
+	if selectedRule != nil && selectedRule.PathRewrite != "" {
+		backendPath = a.ruleEngine.rewritePath(req, *selectedRule)
+	}
 	if selectedRule != nil && selectedRule.PathPrefixRewrite != "" {
 		// Perform path prefix rewrite
 		if selectedRule.PathPrefix != "" && strings.HasPrefix(backendPath, selectedRule.PathPrefix) {
@@ -465,17 +806,23 @@ func (a *Forklift) constructBackendURL(req *http.Request, backend string, select
 	return backend + backendPath
 }
 
-func (a *Forklift) sendProxyRequest(rw http.ResponseWriter, proxyReq *http.Request) {
+// sendProxyRequest proxies the request and counts the response in the canary
+// arms and bandit noted in the state of req. Backends that can't be reached
+// count as 502 responses.
+func (a *Forklift) sendProxyRequest(rw http.ResponseWriter, req, proxyReq *http.Request) {
 	client := &http.Client{
 		Timeout: defaultTimeout, // Default timeout for client requests
 	}
+	start := time.Now()
 	resp, err := client.Do(proxyReq)
 	if err != nil {
+		a.ruleEngine.recordResponse(req, http.StatusBadGateway, nil, time.Since(start))
 		a.logger.Errorf("Error sending request to backend: %v", err)
 		http.Error(rw, "Error sending request to backend", http.StatusBadGateway)
 		return
 	}
 	defer func() { _ = resp.Body.Close() }()
+	a.ruleEngine.recordResponse(req, resp.StatusCode, resp.Header, time.Since(start))
 
 	// Copy the response from the backend to the original response writer
 	for key, values := range resp.Header {
@@ -506,7 +853,10 @@ func (re *RuleEngine) ruleMatches(req *http.Request, rule RoutingRule) bool {
 	if !re.matchMethod(req, rule) {
 		return false
 	}
-	return re.matchConditions(req, rule)
+	if !re.matchConditions(req, rule) {
+		return false
+	}
+	return re.matchExpr(req, rule)
 }
 
 func (re *RuleEngine) matchPath(req *http.Request, rule RoutingRule) bool {
@@ -521,6 +871,12 @@ func (re *RuleEngine) matchPath(req *http.Request, rule RoutingRule) bool {
 	if rule.PathPrefix != "" {
 		re.logDebugf("Path prefix match: %s for path: %s", rule.PathPrefix, req.URL.Path)
 	}
+	params, ok := re.pathParams(req, rule)
+	if !ok {
+		re.logDebugf("Path pattern mismatch: %s for path: %s", rule.PathPattern, req.URL.Path)
+		return false
+	}
+	stateOf(req).pathParams = params
 	return true
 }
 
@@ -540,6 +896,20 @@ func (re *RuleEngine) matchConditions(req *http.Request, rule RoutingRule) bool
 	return re.checkConditions(req, rule.Conditions)
 }
 
+func (re *RuleEngine) matchExpr(req *http.Request, rule RoutingRule) bool {
+	if rule.Expr == "" {
+		return true
+	}
+	node, ok := re.exprs[rule.Expr]
+	if !ok {
+		re.logger.Warnf("Expression was not compiled: %s", rule.Expr)
+		return false
+	}
+	result := node.eval(re, req).b
+	re.logDebugf("Expression %q result: %v", rule.Expr, result)
+	return result
+}
+
 func (re *RuleEngine) logDebugf(format string, args ...interface{}) {
 	if re.config.Debug {
 		re.logger.Debugf(format, args...)
@@ -556,19 +926,35 @@ func (re *RuleEngine) checkConditions(req *http.Request, conditions []RuleCondit
 	return true
 }
 
+// conditionCheckers maps lower-cased condition types to their check functions.
+var conditionCheckers = map[string]func(re *RuleEngine, req *http.Request, condition RuleCondition) bool{
+	"header":     (*RuleEngine).checkHeader,
+	"query":      (*RuleEngine).checkQuery,
+	"cookie":     (*RuleEngine).checkCookie,
+	"form":       (*RuleEngine).checkForm,
+	"formfile":   (*RuleEngine).checkFormFile,
+	"ip":         (*RuleEngine).checkIP,
+	"tls":        (*RuleEngine).checkTLS,
+	"tlsversion": (*RuleEngine).checkTLSVersion,
+	"sni":        (*RuleEngine).checkSNI,
+	"scheme":     (*RuleEngine).checkScheme,
+	"port":       (*RuleEngine).checkPort,
+	"json":       (*RuleEngine).checkJSON,
+	"jwt":        (*RuleEngine).checkJWT,
+	"graphql":    (*RuleEngine).checkGraphQL,
+	"schedule":   (*RuleEngine).checkSchedule,
+	"param":      (*RuleEngine).checkParam,
+	"country":    (*RuleEngine).checkCountry,
+	"region":     (*RuleEngine).checkRegion,
+	"asn":        (*RuleEngine).checkASN,
+}
+
 // checkCondition checks a single condition.
 func (re *RuleEngine) checkCondition(req *http.Request, condition RuleCondition) bool {
 	result := false
-	switch strings.ToLower(condition.Type) {
-	case "header":
-		result = re.checkHeader(req, condition)
-	case "query":
-		result = re.checkQuery(req, condition)
-	case "cookie":
-		result = re.checkCookie(req, condition)
-	case "form":
-		result = re.checkForm(req, condition)
-	default:
+	if check, ok := conditionCheckers[strings.ToLower(condition.Type)]; ok {
+		result = check(re, req, condition)
+	} else {
 		re.logger.Warnf("Unknown condition type: %s", condition.Type)
 	}
 	if re.config.Debug {
@@ -577,29 +963,13 @@ func (re *RuleEngine) checkCondition(req *http.Request, condition RuleCondition)
 	return result
 }
 
-func (re *RuleEngine) checkForm(req *http.Request, condition RuleCondition) bool {
-	if err := req.ParseForm(); err != nil {
-		re.logger.Errorf("Error parsing form data: %v", err)
-		return false
-	}
-	formValue := req.PostFormValue(condition.Parameter)
-	if re.config.Debug {
-		re.logger.Debugf("Form parameter %s: %s", condition.Parameter, formValue)
-	}
-	result := compareValues(formValue, condition.Operator, condition.Value)
-	if re.config.Debug {
-		re.logger.Debugf("Form condition result: %v", result)
-	}
-	return result
-}
-
 func (re *RuleEngine) checkHeader(req *http.Request, condition RuleCondition) bool {
 	headerValues := req.Header.Values(condition.Parameter)
 	if re.config.Debug {
 		re.logger.Debugf("Header %s values: %v", condition.Parameter, headerValues)
 	}
 	for _, headerValue := range headerValues {
-		result := compareValues(strings.TrimSpace(strings.ToLower(headerValue)), condition.Operator, strings.TrimSpace(strings.ToLower(condition.Value)))
+		result := re.compareCondition(strings.TrimSpace(strings.ToLower(headerValue)), condition, strings.TrimSpace(strings.ToLower(condition.Value)))
 		if result {
 			if re.config.Debug {
 				re.logger.Debugf("Header condition result: true")
@@ -621,7 +991,7 @@ func (re *RuleEngine) checkQuery(req *http.Request, condition RuleCondition) boo
 		re.logger.Debugf("Query parameter %s: %s", condition.QueryParam, queryValue)
 		re.logger.Debugf("Comparing query value: %s %s %s", queryValue, condition.Operator, condition.Value)
 	}
-	result := compareValues(queryValue, condition.Operator, condition.Value)
+	result := re.compareCondition(queryValue, condition, condition.Value)
 	if re.config.Debug {
 		re.logger.Debugf("Query condition result: %v", result)
 	}
@@ -632,7 +1002,7 @@ func (re *RuleEngine) checkCookie(req *http.Request, condition RuleCondition) bo
 	cookies := req.Cookies()
 	for _, cookie := range cookies {
 		if cookie.Name == condition.Parameter {
-			result := compareValues(cookie.Value, condition.Operator, condition.Value)
+			result := re.compareCondition(cookie.Value, condition, condition.Value)
 			if re.config.Debug {
 				re.logger.Debugf("Cookie %s value: %s", condition.Parameter, cookie.Value)
 				re.logger.Debugf("Cookie condition result: %v", result)
@@ -658,14 +1028,31 @@ func compareValues(actual, operator, expected string) bool {
 		return strings.HasPrefix(actual, expected)
 	case "suffix":
 		return strings.HasSuffix(actual, expected)
+	case "in":
+		return listContains(expected, actual)
+	case "notin":
+		return !listContains(expected, actual)
 	case "gt":
 		actualFloat, expectedFloat := parseFloats(actual, expected)
 		return actualFloat > expectedFloat
+	case "lt":
+		actualFloat, expectedFloat := parseFloats(actual, expected)
+		return actualFloat < expectedFloat
 	default:
 		return false
 	}
 }
 
+// listContains reports whether value is one of the entries of a comma-separated list.
+func listContains(list, value string) bool {
+	for _, entry := range strings.Split(list, ",") {
+		if strings.TrimSpace(entry) == value {
+			return true
+		}
+	}
+	return false
+}
+
 // parseFloats attempts to parse two strings as float64 values.
 func parseFloats(s1, s2 string) (float64, float64) {
 	f1, _ := strconv.ParseFloat(s1, 64)
@@ -680,8 +1067,52 @@ func (re *RuleEngine) cleanupCache() {
 
 	for range ticker.C {
 		// Clear the entire cache periodically
-		re.cache = &sync.Map{}
+		re.clearCache()
+	}
+}
+
+// clearCache removes all entries from the cache. Entries are deleted in place
+// so that concurrent readers never see a half-replaced map.
+func (re *RuleEngine) clearCache() {
+	re.cache.Range(func(key, _ interface{}) bool {
+		re.cache.Delete(key)
+		return true
+	})
+}
+
+// watch starts reloading the files the rules depend on when they change.
+func (re *RuleEngine) watch(ctx context.Context) error {
+	for _, list := range re.lists {
+		list := list
+		go watchFile(ctx, list.path, list.interval, func() error {
+			if err := list.load(); err != nil {
+				return err
+			}
+			re.logListStats(list)
+			return nil
+		}, re.logger)
+	}
+	if re.geoIP == nil {
+		return nil
+	}
+	interval, err := parseReloadInterval(re.config.GeoIP.ReloadInterval)
+	if err != nil {
+		return fmt.Errorf("geoIP: reloadInterval: %w", err)
+	}
+	for _, db := range []*geoDatabase{re.geoIP.city, re.geoIP.asn} {
+		if db == nil {
+			continue
+		}
+		load := db.load
+		go watchFile(ctx, db.path, interval, func() error {
+			if err := load(); err != nil {
+				return err
+			}
+			re.geoIP.cache.invalidate()
+			return nil
+		}, re.logger)
 	}
+	return nil
 }
 
 // isValidSessionID checks if the given session ID is valid.
@@ -694,27 +1125,23 @@ func isValidSessionID(sessionID string) bool {
 }
 
 // getOrCreateSessionID retrieves the existing session ID or creates a new one.
-func getOrCreateSessionID(rw http.ResponseWriter, req *http.Request) string {
-	cookie, err := req.Cookie(sessionCookieName)
+func (a *Forklift) getOrCreateSessionID(rw http.ResponseWriter, req *http.Request) string {
+	cookies := a.ruleEngine.cookies
+	cookie, err := req.Cookie(cookies.name)
 	if err == nil && cookie.Value != "" && isValidSessionID(cookie.Value) {
 		return cookie.Value
 	}
 
 	sessionID, err := generateSessionID()
 	if err != nil {
-		// Use the logger directly
-		logger.NewLogger("forklift").Errorf("Error generating session ID: %v", err)
+		a.logger.Errorf("Error generating session ID: %v", err)
 		return ""
 	}
 
-	http.SetCookie(rw, &http.Cookie{
-		Name:     sessionCookieName,
-		Value:    sessionID,
-		Path:     "/",
-		MaxAge:   sessionCookieMaxAge,
-		HttpOnly: true,
-		Secure:   req.TLS != nil,
-		SameSite: http.SameSiteStrictMode,
+	cookies.set(rw, req, &http.Cookie{
+		Name:   cookies.name,
+		Value:  sessionID,
+		MaxAge: int(cookies.maxAge / time.Second),
 	})
 
 	return sessionID
@@ -0,0 +1,169 @@
+package forklift
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var errInvalidFormFile = errors.New("formFile parameter must look like field.filename, field.contentType or field.name")
+
+const (
+	mediaTypeURLEncoded = "application/x-www-form-urlencoded"
+	mediaTypeMultipart  = "multipart/form-data"
+	anyFormField        = "*"
+)
+
+// formFile is the metadata of a file part of a multipart form.
+type formFile struct {
+	field       string
+	filename    string
+	contentType string
+}
+
+// formFileAttributes read the attributes formFile conditions can compare.
+var formFileAttributes = map[string]func(formFile) string{
+	"name":        func(f formFile) string { return f.field },
+	"filename":    func(f formFile) string { return f.filename },
+	"contenttype": func(f formFile) string { return f.contentType },
+}
+
+// requestForm returns the form fields of the body, parsing them once per
+// request. URL-encoded and multipart bodies are parsed from the buffered body,
+// so the backend still receives it. The second result is false for other
+// content types, methods without a form body and bodies that can't be parsed.
+func (re *RuleEngine) requestForm(req *http.Request) (url.Values, bool) {
+	state := stateOf(req)
+	if state.formParsed {
+		return state.form, state.formValid
+	}
+	state.formParsed = true
+	switch req.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		re.logDebugf("%s requests have no form body", req.Method)
+		return nil, false
+	}
+
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch {
+	case err != nil:
+		re.logDebugf("Cannot parse Content-Type %q: %v", req.Header.Get("Content-Type"), err)
+	case mediaType == mediaTypeURLEncoded:
+		body, complete := re.requestBody(req)
+		if !complete {
+			return nil, false
+		}
+		if state.form, err = url.ParseQuery(string(body)); err != nil {
+			re.logger.Errorf("Error parsing form data: %v", err)
+			return nil, false
+		}
+		state.formValid = true
+	case mediaType == mediaTypeMultipart:
+		state.formValid = re.parseMultipart(req, params["boundary"])
+	default:
+		re.logDebugf("Content-Type %q does not carry form fields", mediaType)
+	}
+	return state.form, state.formValid
+}
+
+// parseMultipart collects the text fields and file metadata of a multipart
+// body. If the body exceeds MaxBodySize, the parts that fit are used and the
+// truncated part is skipped, so text fields sent before a large upload still
+// match.
+func (re *RuleEngine) parseMultipart(req *http.Request, boundary string) bool {
+	if boundary == "" {
+		re.logDebugf("Multipart body without boundary")
+		return false
+	}
+	body, complete := re.requestBody(req)
+	if body == nil {
+		return false
+	}
+
+	state := stateOf(req)
+	state.form = url.Values{}
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return true
+		}
+		if err != nil {
+			if complete {
+				re.logger.Errorf("Error parsing multipart form: %v", err)
+			}
+			return len(state.form) > 0 || len(state.formFiles) > 0
+		}
+		if part.FileName() != "" {
+			state.formFiles = append(state.formFiles, formFile{
+				field:       part.FormName(),
+				filename:    part.FileName(),
+				contentType: part.Header.Get("Content-Type"),
+			})
+			continue
+		}
+		value, err := io.ReadAll(part)
+		if err != nil {
+			re.logDebugf("Skipping truncated multipart field %s", part.FormName())
+			return true
+		}
+		state.form.Add(part.FormName(), string(value))
+	}
+}
+
+func (re *RuleEngine) checkForm(req *http.Request, condition RuleCondition) bool {
+	form, ok := re.requestForm(req)
+	if !ok {
+		return false
+	}
+	formValue := form.Get(condition.Parameter)
+	if re.config.Debug {
+		re.logger.Debugf("Form parameter %s: %s", condition.Parameter, formValue)
+	}
+	result := re.compareCondition(formValue, condition, condition.Value)
+	if re.config.Debug {
+		re.logger.Debugf("Form condition result: %v", result)
+	}
+	return result
+}
+
+// splitFormFileParameter splits a formFile parameter such as "avatar.contentType"
+// into the field name and the attribute. The field "*" selects every file.
+func splitFormFileParameter(parameter string) (string, string, bool) {
+	dot := strings.LastIndexByte(parameter, '.')
+	if dot <= 0 {
+		return "", "", false
+	}
+	attribute := strings.ToLower(parameter[dot+1:])
+	_, ok := formFileAttributes[attribute]
+	return parameter[:dot], attribute, ok
+}
+
+// checkFormFile compares an attribute of the uploaded files of a multipart
+// form. It matches if any selected file matches.
+func (re *RuleEngine) checkFormFile(req *http.Request, condition RuleCondition) bool {
+	field, attribute, ok := splitFormFileParameter(condition.Parameter)
+	if !ok {
+		re.logger.Warnf("Invalid formFile parameter: %s", condition.Parameter)
+		return false
+	}
+	if _, ok := re.requestForm(req); !ok {
+		return false
+	}
+	for _, file := range stateOf(req).formFiles {
+		if field != anyFormField && file.field != field {
+			continue
+		}
+		if re.compareCondition(formFileAttributes[attribute](file), condition, condition.Value) {
+			return true
+		}
+	}
+	re.logDebugf("No file matched formFile condition on %s", condition.Parameter)
+	return false
+}
@@ -0,0 +1,241 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/mmdb"
+)
+
+var errGeoIPNotConfigured = errors.New("country and region conditions require geoIP.database, asn conditions require geoIP.asnDatabase")
+
+// geoRecord holds the geo attributes of one IP address.
+type geoRecord struct {
+	country string
+	region  string
+	asn     string
+}
+
+// geoCacheSize is the number of IP addresses whose geo records are cached.
+const geoCacheSize = 10000
+
+// geoCache is a size-bounded cache of geo records by IP. Once full, each new
+// address evicts the oldest one, so a flood of distinct clients can't grow it.
+// Entries are tagged with the generation of the databases they were looked up
+// in, and entries of an older generation are ignored, so a lookup that
+// finishes after a reload can't cache a record of the old database.
+type geoCache struct {
+	mu         sync.Mutex
+	generation uint64
+	records    map[string]geoCacheEntry
+	// order is a ring of the cached addresses; next is the oldest once full.
+	order []string
+	next  int
+}
+
+type geoCacheEntry struct {
+	generation uint64
+	record     geoRecord
+}
+
+func newGeoCache() *geoCache {
+	return &geoCache{records: make(map[string]geoCacheEntry)}
+}
+
+// get returns the cached record of ip and the current generation, which the
+// caller passes to put with the record it looks up on a miss.
+func (c *geoCache) get(ip string) (geoRecord, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.records[ip]
+	if !ok || entry.generation != c.generation {
+		return geoRecord{}, c.generation, false
+	}
+	return entry.record, c.generation, true
+}
+
+func (c *geoCache) put(ip string, record geoRecord, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if _, ok := c.records[ip]; !ok {
+		if len(c.order) < geoCacheSize {
+			c.order = append(c.order, ip)
+		} else {
+			delete(c.records, c.order[c.next])
+			c.order[c.next] = ip
+			c.next = (c.next + 1) % geoCacheSize
+		}
+	}
+	c.records[ip] = geoCacheEntry{generation: generation, record: record}
+}
+
+// invalidate starts a new generation, when a database reloads.
+func (c *geoCache) invalidate() {
+	c.mu.Lock()
+	c.generation++
+	c.mu.Unlock()
+}
+
+// geoDatabase is a MaxMind DB file that can be swapped out while in use.
+type geoDatabase struct {
+	path   string
+	mu     sync.RWMutex
+	reader *mmdb.Reader
+}
+
+func openGeoDatabase(path string) (*geoDatabase, error) {
+	db := &geoDatabase{path: path}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *geoDatabase) load() error {
+	reader, err := mmdb.Open(db.path)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	db.reader = reader
+	db.mu.Unlock()
+	return nil
+}
+
+// lookup returns the record for ip as a map, or nil if there is none.
+func (db *geoDatabase) lookup(ip net.IP) (map[string]interface{}, error) {
+	db.mu.RLock()
+	reader := db.reader
+	db.mu.RUnlock()
+	record, found, err := reader.Lookup(ip)
+	if err != nil || !found {
+		return nil, err
+	}
+	fields, _ := record.(map[string]interface{})
+	return fields, nil
+}
+
+// geoIP resolves the country, region and ASN of client IPs.
+type geoIP struct {
+	city  *geoDatabase
+	asn   *geoDatabase
+	cache *geoCache
+}
+
+func newGeoIP(cfg config.GeoIP) (*geoIP, error) {
+	g := &geoIP{cache: newGeoCache()}
+	var err error
+	if cfg.Database != "" {
+		if g.city, err = openGeoDatabase(cfg.Database); err != nil {
+			return nil, fmt.Errorf("database: %w", err)
+		}
+	}
+	if cfg.ASNDatabase != "" {
+		if g.asn, err = openGeoDatabase(cfg.ASNDatabase); err != nil {
+			return nil, fmt.Errorf("asnDatabase: %w", err)
+		}
+	}
+	return g, nil
+}
+
+func (g *geoIP) lookup(ip net.IP) (geoRecord, error) {
+	var record geoRecord
+	if g.city != nil {
+		fields, err := g.city.lookup(ip)
+		if err != nil {
+			return record, err
+		}
+		record.country = geoString(fields, "country", "iso_code")
+		if record.country == "" {
+			record.country = geoString(fields, "registered_country", "iso_code")
+		}
+		if subdivisions, ok := fields["subdivisions"].([]interface{}); ok && len(subdivisions) > 0 {
+			if subdivision, ok := subdivisions[0].(map[string]interface{}); ok {
+				if code, ok := subdivision["iso_code"].(string); ok && record.country != "" {
+					record.region = record.country + "-" + code
+				}
+			}
+		}
+	}
+	if g.asn != nil {
+		fields, err := g.asn.lookup(ip)
+		if err != nil {
+			return record, err
+		}
+		if number, ok := fields["autonomous_system_number"].(uint64); ok {
+			record.asn = strconv.FormatUint(number, 10)
+		}
+	}
+	return record, nil
+}
+
+// geoString reads a nested string such as country.iso_code from a record.
+func geoString(fields map[string]interface{}, keys ...string) string {
+	var value interface{} = fields
+	for _, key := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = m[key]
+	}
+	s, _ := value.(string)
+	return s
+}
+
+// clientGeo returns the geo record of the resolved client IP. Lookups are
+// cached in the geo cache, which is invalidated when a database reloads.
+func (re *RuleEngine) clientGeo(req *http.Request) (geoRecord, bool) {
+	clientIP := re.clientIP(req)
+	record, generation, ok := re.geoIP.cache.get(clientIP)
+	if ok {
+		return record, true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return geoRecord{}, false
+	}
+	record, err := re.geoIP.lookup(ip)
+	if err != nil {
+		re.logger.Errorf("Error looking up %s in GeoIP database: %v", clientIP, err)
+		return geoRecord{}, false
+	}
+	re.geoIP.cache.put(clientIP, record, generation)
+	re.logDebugf("GeoIP for %s: country=%s region=%s asn=%s", clientIP, record.country, record.region, record.asn)
+	return record, true
+}
+
+func (re *RuleEngine) checkCountry(req *http.Request, condition RuleCondition) bool {
+	record, ok := re.clientGeo(req)
+	return ok && re.compareCondition(record.country, condition, strings.ToUpper(condition.Value))
+}
+
+func (re *RuleEngine) checkRegion(req *http.Request, condition RuleCondition) bool {
+	record, ok := re.clientGeo(req)
+	return ok && re.compareCondition(record.region, condition, strings.ToUpper(condition.Value))
+}
+
+func (re *RuleEngine) checkASN(req *http.Request, condition RuleCondition) bool {
+	record, ok := re.clientGeo(req)
+	return ok && re.compareCondition(record.asn, condition, normalizeASNs(condition.Value))
+}
+
+// normalizeASNs strips the optional "AS" prefix from a comma-separated list of
+// AS numbers, so "AS15169" and "15169" are equivalent.
+func normalizeASNs(value string) string {
+	asns := strings.Split(value, ",")
+	for i, asn := range asns {
+		asn = strings.ToUpper(strings.TrimSpace(asn))
+		asns[i] = strings.TrimPrefix(asn, "AS")
+	}
+	return strings.Join(asns, ",")
+}
@@ -0,0 +1,578 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	errInvalidGraphQL          = errors.New("invalid GraphQL document")
+	errInvalidGraphQLParameter = errors.New("graphql parameter must be operationName, operationType or field")
+)
+
+const (
+	maxGraphQLFragmentDepth = 16
+	graphqlQuery            = "query"
+	graphqlBOM              = "\uFEFF"
+)
+
+// graphqlParameters are the attributes graphql conditions can compare.
+var graphqlParameters = map[string]bool{
+	"operationname": true,
+	"operationtype": true,
+	"field":         true,
+}
+
+// graphqlOperation is the operation a GraphQL request executes.
+type graphqlOperation struct {
+	name   string
+	typ    string
+	fields []string
+}
+
+// graphqlSelection holds the top-level fields of a selection set and the
+// fragments it spreads.
+type graphqlSelection struct {
+	fields  []string
+	spreads []string
+}
+
+type graphqlDefinition struct {
+	name      string
+	typ       string
+	selection graphqlSelection
+}
+
+// graphqlDocument is the result of scanning a GraphQL document. Only what
+// routing needs is kept: operation names and types and top-level fields.
+type graphqlDocument struct {
+	operations []graphqlDefinition
+	fragments  map[string]graphqlSelection
+}
+
+// graphqlToken is a lexical token. Strings and numbers are reported with kind
+// 'v' and their text is not kept.
+type graphqlToken struct {
+	kind byte // 'n' name, 'p' punctuator, 'v' value, 0 end of document
+	text string
+}
+
+// graphqlScanner is a minimal GraphQL lexer and parser.
+type graphqlScanner struct {
+	src string
+	pos int
+}
+
+func isGraphQLNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isGraphQLNameChar(c byte) bool {
+	return isGraphQLNameStart(c) || (c >= '0' && c <= '9')
+}
+
+func (s *graphqlScanner) next() (graphqlToken, error) {
+	s.skipIgnored()
+	if s.pos >= len(s.src) {
+		return graphqlToken{}, nil
+	}
+	start := s.pos
+	c := s.src[s.pos]
+	switch {
+	case isGraphQLNameStart(c):
+		for s.pos < len(s.src) && isGraphQLNameChar(s.src[s.pos]) {
+			s.pos++
+		}
+		return graphqlToken{kind: 'n', text: s.src[start:s.pos]}, nil
+	case c == '"':
+		return graphqlToken{kind: 'v'}, s.skipString()
+	case c == '-' || (c >= '0' && c <= '9'):
+		s.pos++
+		for s.pos < len(s.src) && strings.IndexByte("0123456789.eE+-", s.src[s.pos]) >= 0 {
+			s.pos++
+		}
+		return graphqlToken{kind: 'v'}, nil
+	case strings.HasPrefix(s.src[s.pos:], "..."):
+		s.pos += 3
+		return graphqlToken{kind: 'p', text: "..."}, nil
+	case strings.IndexByte("!$&():=@[]{|}", c) >= 0:
+		s.pos++
+		return graphqlToken{kind: 'p', text: s.src[start:s.pos]}, nil
+	default:
+		return graphqlToken{}, fmt.Errorf("%w: unexpected %q at offset %d", errInvalidGraphQL, c, s.pos)
+	}
+}
+
+// skipIgnored skips whitespace, commas, byte order marks and comments.
+func (s *graphqlScanner) skipIgnored() {
+	for s.pos < len(s.src) {
+		switch c := s.src[s.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			s.pos++
+		case c == '#':
+			for s.pos < len(s.src) && s.src[s.pos] != '\n' && s.src[s.pos] != '\r' {
+				s.pos++
+			}
+		case strings.HasPrefix(s.src[s.pos:], graphqlBOM):
+			s.pos += len(graphqlBOM)
+		default:
+			return
+		}
+	}
+}
+
+func (s *graphqlScanner) skipString() error {
+	if strings.HasPrefix(s.src[s.pos:], `"""`) {
+		for i := s.pos + 3; i+3 <= len(s.src); i++ {
+			if s.src[i] == '\\' && strings.HasPrefix(s.src[i+1:], `"""`) {
+				i += 3
+				continue
+			}
+			if strings.HasPrefix(s.src[i:], `"""`) {
+				s.pos = i + 3
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: unterminated block string", errInvalidGraphQL)
+	}
+	for i := s.pos + 1; i < len(s.src); i++ {
+		switch s.src[i] {
+		case '\\':
+			i++
+		case '"':
+			s.pos = i + 1
+			return nil
+		case '\n', '\r':
+			return fmt.Errorf("%w: unterminated string", errInvalidGraphQL)
+		}
+	}
+	return fmt.Errorf("%w: unterminated string", errInvalidGraphQL)
+}
+
+func (s *graphqlScanner) peek() (graphqlToken, error) {
+	pos := s.pos
+	tok, err := s.next()
+	s.pos = pos
+	return tok, err
+}
+
+func (s *graphqlScanner) expect(kind byte, text string) (graphqlToken, error) {
+	tok, err := s.next()
+	if err != nil {
+		return tok, err
+	}
+	if tok.kind != kind || (text != "" && tok.text != text) {
+		return tok, fmt.Errorf("%w: unexpected token %q at offset %d", errInvalidGraphQL, tok.text, s.pos)
+	}
+	return tok, nil
+}
+
+// skipBlock skips tokens up to the punctuator that closes an already
+// consumed opening punctuator.
+func (s *graphqlScanner) skipBlock(closing string) error {
+	depth := 1
+	for depth > 0 {
+		tok, err := s.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case tok.kind == 0:
+			return fmt.Errorf("%w: missing %q", errInvalidGraphQL, closing)
+		case tok.kind == 'p' && (tok.text == "{" || tok.text == "(" || tok.text == "["):
+			depth++
+		case tok.kind == 'p' && (tok.text == "}" || tok.text == ")" || tok.text == "]"):
+			depth--
+		}
+	}
+	return nil
+}
+
+// skipDirectives skips directives such as @include(if: $x).
+func (s *graphqlScanner) skipDirectives() error {
+	for {
+		tok, err := s.peek()
+		if err != nil || tok.kind != 'p' || tok.text != "@" {
+			return err
+		}
+		_, _ = s.next()
+		if _, err := s.expect('n', ""); err != nil {
+			return err
+		}
+		if tok, err = s.peek(); err != nil {
+			return err
+		}
+		if tok.kind == 'p' && tok.text == "(" {
+			_, _ = s.next()
+			if err := s.skipBlock(")"); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// parseGraphQL scans a document for its operations and fragments.
+func parseGraphQL(query string) (*graphqlDocument, error) {
+	s := &graphqlScanner{src: query}
+	doc := &graphqlDocument{fragments: make(map[string]graphqlSelection)}
+	for {
+		tok, err := s.next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case tok.kind == 0:
+			return doc, nil
+		case tok.kind == 'p' && tok.text == "{":
+			selection, err := s.parseSelectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, graphqlDefinition{typ: graphqlQuery, selection: selection})
+		case tok.kind == 'n' && (tok.text == graphqlQuery || tok.text == "mutation" || tok.text == "subscription"):
+			op, err := s.parseOperation(tok.text)
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case tok.kind == 'n' && tok.text == "fragment":
+			name, selection, err := s.parseFragment()
+			if err != nil {
+				return nil, err
+			}
+			doc.fragments[name] = selection
+		case tok.kind == 'n':
+			// Type system definitions don't affect routing.
+			if err := s.skipDefinition(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%w: unexpected token %q at offset %d", errInvalidGraphQL, tok.text, s.pos)
+		}
+	}
+}
+
+func (s *graphqlScanner) parseOperation(typ string) (graphqlDefinition, error) {
+	op := graphqlDefinition{typ: typ}
+	tok, err := s.peek()
+	if err != nil {
+		return op, err
+	}
+	if tok.kind == 'n' {
+		_, _ = s.next()
+		op.name = tok.text
+		if tok, err = s.peek(); err != nil {
+			return op, err
+		}
+	}
+	if tok.kind == 'p' && tok.text == "(" {
+		_, _ = s.next()
+		if err := s.skipBlock(")"); err != nil {
+			return op, err
+		}
+	}
+	if err := s.skipDirectives(); err != nil {
+		return op, err
+	}
+	if _, err := s.expect('p', "{"); err != nil {
+		return op, err
+	}
+	op.selection, err = s.parseSelectionSet()
+	return op, err
+}
+
+func (s *graphqlScanner) parseFragment() (string, graphqlSelection, error) {
+	name, err := s.expect('n', "")
+	if err != nil {
+		return "", graphqlSelection{}, err
+	}
+	if _, err := s.expect('n', "on"); err != nil {
+		return "", graphqlSelection{}, err
+	}
+	if _, err := s.expect('n', ""); err != nil {
+		return "", graphqlSelection{}, err
+	}
+	if err := s.skipDirectives(); err != nil {
+		return "", graphqlSelection{}, err
+	}
+	if _, err := s.expect('p', "{"); err != nil {
+		return "", graphqlSelection{}, err
+	}
+	selection, err := s.parseSelectionSet()
+	return name.text, selection, err
+}
+
+// skipDefinition skips a definition up to and including its body, if any.
+func (s *graphqlScanner) skipDefinition() error {
+	for {
+		tok, err := s.peek()
+		if err != nil {
+			return err
+		}
+		switch {
+		case tok.kind == 0:
+			return nil
+		case tok.kind == 'n' && isGraphQLExecutableKeyword(tok.text):
+			return nil
+		case tok.kind == 'p' && (tok.text == "{" || tok.text == "("):
+			_, _ = s.next()
+			closing := "}"
+			if tok.text == "(" {
+				closing = ")"
+			}
+			if err := s.skipBlock(closing); err != nil {
+				return err
+			}
+			if closing == "}" {
+				return nil
+			}
+		default:
+			_, _ = s.next()
+		}
+	}
+}
+
+// isGraphQLExecutableKeyword reports whether name starts an operation or
+// fragment definition.
+func isGraphQLExecutableKeyword(name string) bool {
+	switch name {
+	case graphqlQuery, "mutation", "subscription", "fragment":
+		return true
+	}
+	return false
+}
+
+// parseSelectionSet reads the top-level fields of a selection set whose "{"
+// was consumed. Aliases are resolved to field names, inline fragments are
+// flattened and nested selections are skipped.
+func (s *graphqlScanner) parseSelectionSet() (graphqlSelection, error) {
+	var selection graphqlSelection
+	for {
+		tok, err := s.next()
+		if err != nil {
+			return selection, err
+		}
+		switch {
+		case tok.kind == 'p' && tok.text == "}":
+			return selection, nil
+		case tok.kind == 'p' && tok.text == "...":
+			if err := s.parseSpread(&selection); err != nil {
+				return selection, err
+			}
+		case tok.kind == 'n':
+			if err := s.parseField(&selection, tok.text); err != nil {
+				return selection, err
+			}
+		default:
+			return selection, fmt.Errorf("%w: unexpected token %q in selection set", errInvalidGraphQL, tok.text)
+		}
+	}
+}
+
+func (s *graphqlScanner) parseField(selection *graphqlSelection, name string) error {
+	tok, err := s.peek()
+	if err != nil {
+		return err
+	}
+	if tok.kind == 'p' && tok.text == ":" {
+		_, _ = s.next()
+		field, err := s.expect('n', "")
+		if err != nil {
+			return err
+		}
+		name = field.text
+	}
+	selection.fields = append(selection.fields, name)
+	if tok, err = s.peek(); err != nil {
+		return err
+	}
+	if tok.kind == 'p' && tok.text == "(" {
+		_, _ = s.next()
+		if err := s.skipBlock(")"); err != nil {
+			return err
+		}
+	}
+	if err := s.skipDirectives(); err != nil {
+		return err
+	}
+	if tok, err = s.peek(); err != nil {
+		return err
+	}
+	if tok.kind == 'p' && tok.text == "{" {
+		_, _ = s.next()
+		return s.skipBlock("}")
+	}
+	return nil
+}
+
+func (s *graphqlScanner) parseSpread(selection *graphqlSelection) error {
+	tok, err := s.peek()
+	if err != nil {
+		return err
+	}
+	if tok.kind == 'n' && tok.text != "on" {
+		_, _ = s.next()
+		selection.spreads = append(selection.spreads, tok.text)
+		return s.skipDirectives()
+	}
+	if tok.kind == 'n' {
+		_, _ = s.next()
+		if _, err := s.expect('n', ""); err != nil {
+			return err
+		}
+	}
+	if err := s.skipDirectives(); err != nil {
+		return err
+	}
+	if _, err := s.expect('p', "{"); err != nil {
+		return err
+	}
+	inline, err := s.parseSelectionSet()
+	if err != nil {
+		return err
+	}
+	selection.fields = append(selection.fields, inline.fields...)
+	selection.spreads = append(selection.spreads, inline.spreads...)
+	return nil
+}
+
+// operation returns the operation a request with the given operationName
+// executes: the named one, or the only one if no name is given.
+func (doc *graphqlDocument) operation(operationName string) (graphqlOperation, error) {
+	var selected *graphqlDefinition
+	for i := range doc.operations {
+		op := &doc.operations[i]
+		if operationName == "" && len(doc.operations) == 1 || operationName != "" && op.name == operationName {
+			selected = op
+			break
+		}
+	}
+	if selected == nil {
+		if operationName == "" {
+			return graphqlOperation{}, fmt.Errorf("%w: %d operations and no operationName", errInvalidGraphQL, len(doc.operations))
+		}
+		return graphqlOperation{}, fmt.Errorf("%w: operation %q not found", errInvalidGraphQL, operationName)
+	}
+	op := graphqlOperation{name: selected.name, typ: selected.typ}
+	op.fields = doc.collectFields(op.fields, selected.selection, make(map[string]bool), 0)
+	return op, nil
+}
+
+// collectFields adds the fields of a selection, including those of the
+// fragments it spreads.
+func (doc *graphqlDocument) collectFields(fields []string, selection graphqlSelection, seen map[string]bool, depth int) []string {
+	fields = append(fields, selection.fields...)
+	if depth >= maxGraphQLFragmentDepth {
+		return fields
+	}
+	for _, spread := range selection.spreads {
+		fragment, ok := doc.fragments[spread]
+		if !ok || seen[spread] {
+			continue
+		}
+		seen[spread] = true
+		fields = doc.collectFields(fields, fragment, seen, depth+1)
+	}
+	return fields
+}
+
+// graphqlRequest is the query and operation name sent in one request.
+type graphqlRequest struct {
+	query         string
+	operationName string
+}
+
+// graphqlRequests extracts the GraphQL requests from GET parameters, an
+// application/graphql body or a JSON body, which may hold a batch.
+func (re *RuleEngine) graphqlRequests(req *http.Request) []graphqlRequest {
+	switch {
+	case req.Method == http.MethodGet:
+		query := req.URL.Query()
+		if query.Get("query") == "" && query.Get("operationName") == "" {
+			return nil
+		}
+		return []graphqlRequest{{query: query.Get("query"), operationName: query.Get("operationName")}}
+	case hasMediaType(req, "application/graphql"):
+		body, ok := re.requestBody(req)
+		if !ok {
+			return nil
+		}
+		return []graphqlRequest{{query: string(body), operationName: req.URL.Query().Get("operationName")}}
+	default:
+		doc, ok := re.requestJSON(req)
+		if !ok {
+			return nil
+		}
+		var requests []graphqlRequest
+		batch, isBatch := doc.([]interface{})
+		if !isBatch {
+			batch = []interface{}{doc}
+		}
+		for _, element := range batch {
+			if object, ok := element.(map[string]interface{}); ok {
+				query, _ := object["query"].(string)
+				operationName, _ := object["operationName"].(string)
+				requests = append(requests, graphqlRequest{query: query, operationName: operationName})
+			}
+		}
+		return requests
+	}
+}
+
+// requestGraphQL returns the operations the request executes, parsing the
+// documents once per request. Persisted queries sent without a document only
+// carry their operation name.
+func (re *RuleEngine) requestGraphQL(req *http.Request) []graphqlOperation {
+	state := stateOf(req)
+	if state.graphqlParsed {
+		return state.graphqlOps
+	}
+	state.graphqlParsed = true
+	for _, request := range re.graphqlRequests(req) {
+		if request.query == "" {
+			state.graphqlOps = append(state.graphqlOps, graphqlOperation{name: request.operationName})
+			continue
+		}
+		doc, err := parseGraphQL(request.query)
+		if err != nil {
+			re.logDebugf("Error parsing GraphQL document: %v", err)
+			continue
+		}
+		op, err := doc.operation(request.operationName)
+		if err != nil {
+			re.logDebugf("Error selecting GraphQL operation: %v", err)
+			continue
+		}
+		re.logDebugf("GraphQL %s %s with fields %v", op.typ, op.name, op.fields)
+		state.graphqlOps = append(state.graphqlOps, op)
+	}
+	return state.graphqlOps
+}
+
+// checkGraphQL compares the operation name, operation type or top-level
+// fields of the request's GraphQL operations. It matches if any operation of a
+// batch, or any top-level field, matches.
+func (re *RuleEngine) checkGraphQL(req *http.Request, condition RuleCondition) bool {
+	parameter := strings.ToLower(condition.Parameter)
+	for _, op := range re.requestGraphQL(req) {
+		switch parameter {
+		case "operationname":
+			if re.compareCondition(op.name, condition, condition.Value) {
+				return true
+			}
+		case "operationtype":
+			if op.typ != "" && re.compareCondition(op.typ, condition, strings.ToLower(condition.Value)) {
+				return true
+			}
+		case "field":
+			for _, field := range op.fields {
+				if re.compareCondition(field, condition, condition.Value) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
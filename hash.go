@@ -0,0 +1,121 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+var (
+	errInvalidHashAlgorithm     = errors.New("hashAlgorithm must be fnv or murmur3")
+	errInvalidRuleHashAlgorithm = errors.New("hashAlgorithm must be legacy, fnv or murmur3")
+)
+
+const (
+	hashFNV     = "fnv"
+	hashMurmur3 = "murmur3"
+	// hashLegacy is the default hash of rules, over the session and the
+	// matching rules. It has no bucket function.
+	hashLegacy = "legacy"
+)
+
+// bucketHasher maps a seed and a key to a bucket in [0, hashModulo).
+type bucketHasher func(seed, key string) int
+
+var bucketHashers = map[string]bucketHasher{
+	hashFNV:     fnvBucket,
+	hashMurmur3: murmur3Bucket,
+}
+
+// parseHashAlgorithm returns the name of a hash algorithm, defaulting to fnv.
+func parseHashAlgorithm(name string) (string, error) {
+	if name == "" {
+		return hashFNV, nil
+	}
+	name = strings.ToLower(name)
+	if _, ok := bucketHashers[name]; !ok {
+		return "", fmt.Errorf("%w: %q", errInvalidHashAlgorithm, name)
+	}
+	return name, nil
+}
+
+// parseRuleHashAlgorithm returns the name of a rule's hash algorithm,
+// defaulting to legacy.
+func parseRuleHashAlgorithm(name string) (string, error) {
+	if name == "" || strings.EqualFold(name, hashLegacy) {
+		return hashLegacy, nil
+	}
+	algorithm, err := parseHashAlgorithm(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q", errInvalidRuleHashAlgorithm, name)
+	}
+	return algorithm, nil
+}
+
+// Bucket returns the bucket in [0, 10000) the algorithm ("fnv" or "murmur3")
+// assigns to a key under a seed. Services can use it to recompute the
+// assignments of experiments and of rules with a hashAlgorithm.
+func Bucket(algorithm, seed, key string) (int, error) {
+	name, err := parseHashAlgorithm(algorithm)
+	if err != nil {
+		return 0, err
+	}
+	return bucketHashers[name](seed, key), nil
+}
+
+// fnvBucket hashes "<seed>.<key>" with 64-bit FNV-1a.
+func fnvBucket(seed, key string) int {
+	h := fnvAdd(fnvAdd(fnvAdd(fnvOffset64, seed), "."), key)
+	return int(h % hashModulo)
+}
+
+// murmur3Bucket hashes "<seed>.<key>" with 32-bit MurmurHash3 and seed 0, as
+// feature-flag SDKs commonly do.
+func murmur3Bucket(seed, key string) int {
+	return int(murmur3(seed+"."+key, 0) % hashModulo)
+}
+
+// MurmurHash3 x86 32-bit constants.
+const (
+	murmur3C1 = 0xcc9e2d51
+	murmur3C2 = 0x1b873593
+)
+
+// murmur3 computes the 32-bit MurmurHash3 of the UTF-8 bytes of data.
+func murmur3(data string, seed uint32) uint32 {
+	h := seed
+	n := len(data)
+	i := 0
+	for ; i+4 <= n; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		h ^= murmur3Scramble(k)
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+	var k uint32
+	switch n - i {
+	case 3:
+		k ^= uint32(data[i+2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(data[i+1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(data[i])
+		h ^= murmur3Scramble(k)
+	}
+	h ^= uint32(n)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+func murmur3Scramble(k uint32) uint32 {
+	k *= murmur3C1
+	k = bits.RotateLeft32(k, 15)
+	return k * murmur3C2
+}
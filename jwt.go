@@ -0,0 +1,361 @@
+package forklift
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errJWTNotConfigured = errors.New("jwt conditions require a secret, public key file or JWKS file")
+	errInvalidJWT       = errors.New("invalid token")
+	errUnsupportedKey   = errors.New("unsupported key type")
+	errNoJWKSKeys       = errors.New("no usable keys in JWKS")
+)
+
+const (
+	jwtAlgHS256      = "HS256"
+	jwtAlgRS256      = "RS256"
+	jwtAlgES256      = "ES256"
+	es256KeySize     = 32
+	bearerPrefix     = "bearer "
+	defaultJWTHeader = "Authorization"
+)
+
+// jwtKey is a public key a token can be verified with.
+type jwtKey struct {
+	kid string
+	key crypto.PublicKey
+}
+
+// jwtVerifier verifies tokens locally against a shared secret or public keys.
+type jwtVerifier struct {
+	header string
+	cookie string
+	secret []byte
+	keys   []jwtKey
+	leeway time.Duration
+}
+
+func newJWTVerifier(cfg config.JWT) (*jwtVerifier, error) {
+	verifier := &jwtVerifier{header: cfg.Header, cookie: cfg.Cookie, secret: []byte(cfg.Secret)}
+	if verifier.header == "" {
+		verifier.header = defaultJWTHeader
+	}
+	if cfg.Leeway != "" {
+		leeway, err := time.ParseDuration(cfg.Leeway)
+		if err != nil {
+			return nil, fmt.Errorf("leeway: %w", err)
+		}
+		verifier.leeway = leeway
+	}
+	if cfg.PublicKeyFile != "" {
+		keys, err := loadPEMKeys(cfg.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("public key file: %w", err)
+		}
+		verifier.keys = append(verifier.keys, keys...)
+	}
+	if cfg.JWKSFile != "" {
+		keys, err := loadJWKS(cfg.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("JWKS file: %w", err)
+		}
+		verifier.keys = append(verifier.keys, keys...)
+	}
+	if len(verifier.secret) == 0 && len(verifier.keys) == 0 {
+		return nil, errJWTNotConfigured
+	}
+	return verifier, nil
+}
+
+// loadPEMKeys reads every public key and certificate in a PEM file.
+func loadPEMKeys(path string) ([]jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []jwtKey
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		var key crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, jwtKey{key: key})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no public keys found", errUnsupportedKey)
+	}
+	return keys, nil
+}
+
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	} `json:"keys"`
+}
+
+// loadJWKS reads the RSA and P-256 keys of a JSON Web Key Set file. Keys of
+// other types are skipped.
+func loadJWKS(path string) ([]jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set jwks
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	var keys []jwtKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch {
+		case k.Kty == "RSA":
+			key, err = jwkRSAKey(k.N, k.E)
+		case k.Kty == "EC" && k.Crv == "P-256":
+			key, err = jwkECKey(k.X, k.Y)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		keys = append(keys, jwtKey{kid: k.Kid, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errNoJWKSKeys
+	}
+	return keys, nil
+}
+
+func jwkRSAKey(n, e string) (*rsa.PublicKey, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	exponent, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: int(new(big.Int).SetBytes(exponent).Int64())}, nil
+}
+
+func jwkECKey(x, y string) (*ecdsa.PublicKey, error) {
+	xBytes, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	yBytes, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(xBytes), Y: new(big.Int).SetBytes(yBytes)}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("%w: point is not on P-256", errUnsupportedKey)
+	}
+	return key, nil
+}
+
+// token extracts the raw token from the configured cookie or header. Header
+// values may carry a "Bearer " prefix.
+func (v *jwtVerifier) token(req *http.Request) string {
+	if v.cookie != "" {
+		if cookie, err := req.Cookie(v.cookie); err == nil {
+			return cookie.Value
+		}
+		return ""
+	}
+	value := strings.TrimSpace(req.Header.Get(v.header))
+	if len(value) > len(bearerPrefix) && strings.EqualFold(value[:len(bearerPrefix)], bearerPrefix) {
+		value = strings.TrimSpace(value[len(bearerPrefix):])
+	}
+	return value
+}
+
+// verify checks the signature and the exp/nbf claims of a compact JWS and
+// returns its claims.
+func (v *jwtVerifier) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", errInvalidJWT)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature encoding", errInvalidJWT)
+	}
+	if !v.verifySignature(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, fmt.Errorf("%w: signature verification failed for alg %q", errInvalidJWT, header.Alg)
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.checkTimes(claims, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, target interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: encoding", errInvalidJWT)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(target); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidJWT, err)
+	}
+	return nil
+}
+
+func (v *jwtVerifier) verifySignature(alg, kid string, signed, signature []byte) bool {
+	if alg == jwtAlgHS256 {
+		if len(v.secret) == 0 {
+			return false
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+	digest := sha256.Sum256(signed)
+	for _, k := range v.keys {
+		if kid != "" && k.kid != "" && k.kid != kid {
+			continue
+		}
+		switch key := k.key.(type) {
+		case *rsa.PublicKey:
+			if alg == jwtAlgRS256 && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			if alg == jwtAlgES256 && len(signature) == 2*es256KeySize {
+				r := new(big.Int).SetBytes(signature[:es256KeySize])
+				s := new(big.Int).SetBytes(signature[es256KeySize:])
+				if ecdsa.Verify(key, digest[:], r, s) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (v *jwtVerifier) checkTimes(claims map[string]interface{}, now time.Time) error {
+	if exp, ok := numericClaim(claims, "exp"); ok && !now.Before(time.Unix(exp, 0).Add(v.leeway)) {
+		return fmt.Errorf("%w: expired", errInvalidJWT)
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(v.leeway).Before(time.Unix(nbf, 0)) {
+		return fmt.Errorf("%w: not valid yet", errInvalidJWT)
+	}
+	return nil
+}
+
+func numericClaim(claims map[string]interface{}, name string) (int64, bool) {
+	number, ok := claims[name].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	value, err := number.Float64()
+	return int64(value), err == nil
+}
+
+// requestClaims returns the claims of the request's verified token, verifying
+// it once per request. Requests without a valid token have no claims.
+func (re *RuleEngine) requestClaims(req *http.Request) (map[string]interface{}, bool) {
+	state := stateOf(req)
+	if state.jwtVerified {
+		return state.jwtClaims, state.jwtClaims != nil
+	}
+	state.jwtVerified = true
+	if re.jwtVerifier == nil {
+		return nil, false
+	}
+	token := re.jwtVerifier.token(req)
+	if token == "" {
+		re.logDebugf("No JWT found in request")
+		return nil, false
+	}
+	claims, err := re.jwtVerifier.verify(token, re.now())
+	if err != nil {
+		re.logDebugf("Rejected JWT: %v", err)
+		return nil, false
+	}
+	state.jwtClaims = claims
+	return claims, true
+}
+
+// checkJWT compares a claim of the verified token. Array claims match if any
+// element matches, so "roles contains beta" works on role lists.
+func (re *RuleEngine) checkJWT(req *http.Request, condition RuleCondition) bool {
+	steps, ok := re.jsonPaths[condition.Parameter]
+	if !ok {
+		re.logger.Warnf("JWT claim path was not compiled: %s", condition.Parameter)
+		return false
+	}
+	claims, ok := re.requestClaims(req)
+	if !ok {
+		return false
+	}
+	value, ok := selectJSON(claims, steps)
+	if !ok {
+		re.logDebugf("JWT claim %s not found", condition.Parameter)
+		return false
+	}
+	if values, isArray := value.([]interface{}); isArray {
+		for _, element := range values {
+			if re.compareCondition(jsonString(element), condition, condition.Value) {
+				return true
+			}
+		}
+		return false
+	}
+	return re.compareCondition(jsonString(value), condition, condition.Value)
+}
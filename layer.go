@@ -0,0 +1,127 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errInvalidLayer   = errors.New("invalid layer")
+	errInvalidHoldout = errors.New("invalid holdout")
+)
+
+// defaultHoldoutSalt seeds the holdout hash when no salt is configured.
+const defaultHoldoutSalt = "holdout"
+
+// layer is a compiled layer. Its experiments take consecutive bucket ranges of
+// the layer hash in configuration order, so a key is in at most one of them.
+type layer struct {
+	name     string
+	salt     string
+	bucketBy bucketChain
+	hash     bucketHasher
+	// used is the number of buckets taken by the experiments compiled so far.
+	used int
+}
+
+// holdout is the compiled global holdout. Keys hashed below buckets are held out.
+type holdout struct {
+	salt     string
+	buckets  int
+	bucketBy bucketChain
+	hash     bucketHasher
+}
+
+// compileLayers validates the layers, keyed by name in re.layers.
+func (re *RuleEngine) compileLayers() error {
+	re.layers = make(map[string]*layer, len(re.config.Layers))
+	for _, cfg := range re.config.Layers {
+		if cfg.Name == "" {
+			return fmt.Errorf("%w: name is required", errInvalidLayer)
+		}
+		if re.layers[cfg.Name] != nil {
+			return fmt.Errorf("%w: duplicate name %q", errInvalidLayer, cfg.Name)
+		}
+		l := &layer{name: cfg.Name, salt: cfg.Salt}
+		if l.salt == "" {
+			l.salt = cfg.Name
+		}
+		algorithm, err := parseHashAlgorithm(cfg.HashAlgorithm)
+		if err != nil {
+			return fmt.Errorf("layer %s: %w", cfg.Name, err)
+		}
+		l.hash = bucketHashers[algorithm]
+		if l.bucketBy, err = re.parseBucketChain(cfg.BucketBy); err != nil {
+			return fmt.Errorf("layer %s: %w", cfg.Name, err)
+		}
+		re.layers[cfg.Name] = l
+	}
+	return nil
+}
+
+// joinLayer gives the experiment the next range of its layer's buckets, sized
+// by its allocation. The experiment buckets and hashes like its layer.
+func (re *RuleEngine) joinLayer(e *experiment, cfg config.Experiment) error {
+	l, ok := re.layers[cfg.Layer]
+	if !ok {
+		return fmt.Errorf("%w %s: unknown layer %q", errInvalidExperiment, e.name, cfg.Layer)
+	}
+	if len(cfg.BucketBy) > 0 || cfg.HashAlgorithm != "" {
+		return fmt.Errorf("%w %s: bucketBy and hashAlgorithm are set on layer %s", errInvalidExperiment, e.name, l.name)
+	}
+	e.layer = l
+	e.bucketBy = l.bucketBy
+	e.hash = l.hash
+	e.layerStart = l.used
+	l.used += e.allocation
+	if l.used > hashModulo {
+		return fmt.Errorf("%w %s: allocations add up to more than 100", errInvalidLayer, l.name)
+	}
+	return nil
+}
+
+// compileHoldout validates the global holdout. re.holdout stays nil without a
+// holdout percentage.
+func (re *RuleEngine) compileHoldout() error {
+	cfg := re.config.Holdout
+	if cfg.Percentage < 0 || cfg.Percentage > maxPercentage {
+		return fmt.Errorf("%w: percentage must be between 0 and 100", errInvalidHoldout)
+	}
+	if cfg.Percentage == 0 {
+		return nil
+	}
+	h := &holdout{salt: cfg.Salt, buckets: int(math.Round(cfg.Percentage * hashModulo / maxPercentage))}
+	if h.salt == "" {
+		h.salt = defaultHoldoutSalt
+	}
+	algorithm, err := parseHashAlgorithm(cfg.HashAlgorithm)
+	if err != nil {
+		return fmt.Errorf("holdout: %w", err)
+	}
+	h.hash = bucketHashers[algorithm]
+	if h.bucketBy, err = re.parseBucketChain(cfg.BucketBy); err != nil {
+		return fmt.Errorf("holdout: %w", err)
+	}
+	re.holdout = h
+	return nil
+}
+
+// inHoldout reports whether the request is held out of every experiment and
+// percentage split. Requests without a bucketing key are not held out.
+func (re *RuleEngine) inHoldout(req *http.Request, sessionID string) bool {
+	if re.holdout == nil {
+		return false
+	}
+	state := stateOf(req)
+	if !state.holdoutChecked {
+		state.holdoutChecked = true
+		if key, ok := re.bucketKeyOf(req, re.holdout.bucketBy, sessionID, nil); ok {
+			state.heldOut = re.holdout.hash(re.holdout.salt, key) < re.holdout.buckets
+		}
+	}
+	return state.heldOut
+}
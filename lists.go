@@ -0,0 +1,253 @@
+package forklift
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errInvalidList = errors.New("invalid list")
+	errUnknownList = errors.New("unknown list")
+)
+
+const (
+	// listEntryOverhead approximates the memory a set entry needs besides its
+	// bytes: the string header and the map's share of buckets.
+	listEntryOverhead = 24
+	// listNetworkSize approximates the memory of one parsed CIDR.
+	listNetworkSize = 64
+	maxListLineSize = 64 * 1024
+)
+
+// ListStats describes a loaded targeting list.
+type ListStats struct {
+	Name     string
+	File     string
+	Entries  int
+	Networks int
+	// Bytes is an estimate of the memory the list occupies.
+	Bytes    int64
+	LoadedAt time.Time
+}
+
+// listData is one loaded version of a list file.
+type listData struct {
+	entries  map[string]struct{}
+	networks networkSet
+	stats    ListStats
+}
+
+// networkSet holds CIDRs grouped by prefix length, so that a lookup probes one
+// set per distinct prefix length instead of testing every network. Addresses
+// are kept in 16-byte form, IPv4 networks as IPv4-mapped ones.
+type networkSet struct {
+	count   int
+	lengths []networkLength
+}
+
+// networkLength holds the networks of one prefix length by masked address.
+type networkLength struct {
+	ones      int
+	mask      net.IPMask
+	addresses map[string]struct{}
+}
+
+func (s *networkSet) add(network *net.IPNet) {
+	ones, bits := network.Mask.Size()
+	ones += 8*net.IPv6len - bits
+	var group *networkLength
+	for i := range s.lengths {
+		if s.lengths[i].ones == ones {
+			group = &s.lengths[i]
+			break
+		}
+	}
+	if group == nil {
+		s.lengths = append(s.lengths, networkLength{
+			ones:      ones,
+			mask:      net.CIDRMask(ones, 8*net.IPv6len),
+			addresses: make(map[string]struct{}),
+		})
+		group = &s.lengths[len(s.lengths)-1]
+	}
+	key := string(network.IP.To16().Mask(group.mask))
+	if _, ok := group.addresses[key]; !ok {
+		group.addresses[key] = struct{}{}
+		s.count++
+	}
+}
+
+func (s *networkSet) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	for i := range s.lengths {
+		if _, ok := s.lengths[i].addresses[string(ip.Mask(s.lengths[i].mask))]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// targetList is a named list loaded from a file that can be swapped out while
+// in use.
+type targetList struct {
+	name     string
+	path     string
+	interval time.Duration
+	mu       sync.RWMutex
+	data     *listData
+}
+
+func newTargetLists(lists []config.List) (map[string]*targetList, error) {
+	targets := make(map[string]*targetList, len(lists))
+	for _, list := range lists {
+		if list.Name == "" || list.File == "" {
+			return nil, fmt.Errorf("%w: name and file are required", errInvalidList)
+		}
+		if _, ok := targets[list.Name]; ok {
+			return nil, fmt.Errorf("%w: duplicate name %q", errInvalidList, list.Name)
+		}
+		interval, err := parseReloadInterval(list.ReloadInterval)
+		if err != nil {
+			return nil, fmt.Errorf("list %s: reloadInterval: %w", list.Name, err)
+		}
+		target := &targetList{name: list.Name, path: list.File, interval: interval}
+		if err := target.load(); err != nil {
+			return nil, fmt.Errorf("list %s: %w", list.Name, err)
+		}
+		targets[list.Name] = target
+	}
+	return targets, nil
+}
+
+// load reads the list file: one entry per line, ignoring empty lines and lines
+// starting with #. IP addresses are normalized and CIDRs match every address
+// they contain. Entries match case-insensitively.
+func (l *targetList) load() error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+
+	data := &listData{entries: make(map[string]struct{})}
+	var size int64
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxListLineSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, "/") {
+			if _, network, err := net.ParseCIDR(line); err == nil {
+				data.networks.add(network)
+				continue
+			}
+		}
+		entry := normalizeListEntry(line)
+		if _, ok := data.entries[entry]; !ok {
+			data.entries[entry] = struct{}{}
+			size += int64(len(entry)) + listEntryOverhead
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	data.stats = ListStats{
+		Name:     l.name,
+		File:     l.path,
+		Entries:  len(data.entries),
+		Networks: data.networks.count,
+		Bytes:    size + int64(data.networks.count)*listNetworkSize,
+		LoadedAt: time.Now(),
+	}
+	l.mu.Lock()
+	l.data = data
+	l.mu.Unlock()
+	return nil
+}
+
+// normalizeListEntry lowercases an entry and writes IP addresses in canonical
+// form, so "::FFFF:10.0.0.1" and "10.0.0.1" are the same entry.
+func normalizeListEntry(entry string) string {
+	entry = strings.TrimSpace(entry)
+	if ip := net.ParseIP(entry); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(entry)
+}
+
+func (l *targetList) current() *listData {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.data
+}
+
+func (l *targetList) contains(value string) bool {
+	data := l.current()
+	if _, ok := data.entries[normalizeListEntry(value)]; ok {
+		return true
+	}
+	if data.networks.count == 0 {
+		return false
+	}
+	ip := net.ParseIP(strings.TrimSpace(value))
+	return ip != nil && data.networks.contains(ip)
+}
+
+// inList reports whether value is in the named list.
+func (re *RuleEngine) inList(name, value string) bool {
+	list, ok := re.lists[name]
+	if !ok {
+		re.logger.Warnf("%v: %s", errUnknownList, name)
+		return false
+	}
+	result := list.contains(value)
+	re.logDebugf("List %s contains %q: %v", name, value, result)
+	return result
+}
+
+// compareCondition compares actual with a condition. The inList and notInList
+// operators look actual up in the list named by the condition value; other
+// operators compare it with expected, the condition value as normalized by the
+// condition type.
+func (re *RuleEngine) compareCondition(actual string, condition RuleCondition, expected string) bool {
+	switch strings.ToLower(condition.Operator) {
+	case "inlist":
+		return re.inList(condition.Value, actual)
+	case "notinlist":
+		return !re.inList(condition.Value, actual)
+	default:
+		return compareValues(actual, condition.Operator, expected)
+	}
+}
+
+func (re *RuleEngine) logListStats(list *targetList) {
+	stats := list.current().stats
+	re.logger.Infof("Loaded list %s from %s: %d entries, %d networks, about %d KiB",
+		stats.Name, stats.File, stats.Entries, stats.Networks, stats.Bytes/1024)
+}
+
+// ListStats returns the size and load time of each targeting list, sorted by
+// name.
+func (a *Forklift) ListStats() []ListStats {
+	stats := make([]ListStats, 0, len(a.ruleEngine.lists))
+	for _, list := range a.ruleEngine.lists {
+		stats = append(stats, list.current().stats)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
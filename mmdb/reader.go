@@ -0,0 +1,345 @@
+// Package mmdb provides a pure-Go reader for MaxMind DB files such as GeoLite2.
+//
+// The reader loads the whole database into memory and uses no unsafe code or
+// memory mapping, so it runs under Yaegi.
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+)
+
+var (
+	// ErrInvalidDatabase is returned for files that are not valid MaxMind DB files.
+	ErrInvalidDatabase = errors.New("invalid MaxMind DB file")
+	errCorruptData     = errors.New("corrupt MaxMind DB data section")
+)
+
+// metadataMarker precedes the metadata map at the end of the file.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const (
+	dataSectionSeparatorSize = 16
+	ipv4Bits                 = 32
+	ipv6Bits                 = 128
+	maxDecodeDepth           = 64
+)
+
+// Data types of the MaxMind DB data section.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// Metadata describes a database.
+type Metadata struct {
+	DatabaseType string
+	IPVersion    int
+	NodeCount    uint
+	RecordSize   uint
+	BuildEpoch   uint64
+}
+
+// Reader looks up records in a MaxMind DB file.
+type Reader struct {
+	Metadata  Metadata
+	tree      []byte
+	data      []byte
+	ipv4Start uint
+}
+
+// Open reads the database at path into memory.
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(buf)
+}
+
+// FromBytes creates a reader for a database held in memory.
+func FromBytes(buf []byte) (*Reader, error) {
+	start := bytes.LastIndex(buf, metadataMarker)
+	if start < 0 {
+		return nil, fmt.Errorf("%w: metadata not found", ErrInvalidDatabase)
+	}
+	metadataSection := buf[start+len(metadataMarker):]
+	raw, _, err := decoder{data: metadataSection}.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: metadata: %w", ErrInvalidDatabase, err)
+	}
+	fields, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", ErrInvalidDatabase)
+	}
+
+	r := &Reader{Metadata: Metadata{
+		DatabaseType: stringField(fields, "database_type"),
+		IPVersion:    int(uintField(fields, "ip_version")),
+		NodeCount:    uint(uintField(fields, "node_count")),
+		RecordSize:   uint(uintField(fields, "record_size")),
+		BuildEpoch:   uintField(fields, "build_epoch"),
+	}}
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: unsupported record size %d", ErrInvalidDatabase, r.Metadata.RecordSize)
+	}
+
+	treeSize := r.Metadata.NodeCount * r.Metadata.RecordSize / 4
+	if treeSize+dataSectionSeparatorSize > uint(start) {
+		return nil, fmt.Errorf("%w: search tree larger than file", ErrInvalidDatabase)
+	}
+	r.tree = buf[:treeSize]
+	r.data = buf[treeSize+dataSectionSeparatorSize : start]
+
+	if r.Metadata.IPVersion == 6 {
+		node := uint(0)
+		for i := 0; i < ipv6Bits-ipv4Bits && node < r.Metadata.NodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// Lookup returns the record for ip, or false if the database has no record for it.
+func (r *Reader) Lookup(ip net.IP) (interface{}, bool, error) {
+	node, bits := uint(0), ipv6Bits
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, ipv4Bits
+		node = r.ipv4Start
+	} else if r.Metadata.IPVersion == 4 || len(ip) != net.IPv6len {
+		return nil, false, nil
+	}
+
+	nodeCount := r.Metadata.NodeCount
+	for i := 0; i < bits && node < nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	if node == nodeCount {
+		return nil, false, nil
+	}
+	if node < nodeCount {
+		return nil, false, fmt.Errorf("%w: lookup did not reach a record", ErrInvalidDatabase)
+	}
+
+	offset := node - nodeCount - dataSectionSeparatorSize
+	if offset >= uint(len(r.data)) {
+		return nil, false, fmt.Errorf("%w: record pointer out of range", ErrInvalidDatabase)
+	}
+	value, _, err := decoder{data: r.data}.decode(offset, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node.
+func (r *Reader) record(node, bit uint) uint {
+	size := r.Metadata.RecordSize
+	b := r.tree[node*size/4:]
+	switch size {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+func stringField(fields map[string]interface{}, name string) string {
+	s, _ := fields[name].(string)
+	return s
+}
+
+func uintField(fields map[string]interface{}, name string) uint64 {
+	switch v := fields[name].(type) {
+	case uint64:
+		return v
+	case int64:
+		return uint64(v)
+	default:
+		return 0
+	}
+}
+
+// decoder decodes values of the data section.
+type decoder struct {
+	data []byte
+}
+
+// decode decodes the value at offset and returns it together with the offset
+// of the next value.
+func (d decoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDecodeDepth {
+		return nil, 0, fmt.Errorf("%w: nesting too deep", errCorruptData)
+	}
+	typ, size, offset, err := d.controlByte(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == typePointer {
+		pointer, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer, depth+1)
+		return value, next, err
+	}
+	if offset+size > uint(len(d.data)) && typ != typeMap && typ != typeArray && typ != typeBool {
+		return nil, 0, fmt.Errorf("%w: value exceeds data section", errCorruptData)
+	}
+	end := offset + size
+	switch typ {
+	case typeString:
+		return string(d.data[offset:end]), end, nil
+	case typeBytes:
+		return append([]byte(nil), d.data[offset:end]...), end, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w: double of size %d", errCorruptData, size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(d.data[offset:end])), end, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w: float of size %d", errCorruptData, size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(d.data[offset:end]))), end, nil
+	case typeUint16, typeUint32, typeUint64:
+		return d.uint(offset, size), end, nil
+	case typeInt32:
+		return int64(int32(d.uint(offset, size)<<(32-8*size))) >> (32 - 8*size), end, nil
+	case typeUint128:
+		return new(big.Int).SetBytes(d.data[offset:end]), end, nil
+	case typeBool:
+		return size != 0, offset, nil
+	case typeMap:
+		return d.decodeMap(size, offset, depth)
+	case typeArray:
+		return d.decodeArray(size, offset, depth)
+	default:
+		return nil, 0, fmt.Errorf("%w: unexpected type %d", errCorruptData, typ)
+	}
+}
+
+// controlByte reads the type and payload size of the value at offset.
+func (d decoder) controlByte(offset uint) (int, uint, uint, error) {
+	if offset >= uint(len(d.data)) {
+		return 0, 0, 0, fmt.Errorf("%w: offset out of range", errCorruptData)
+	}
+	ctrl := d.data[offset]
+	offset++
+	typ := int(ctrl >> 5)
+	if typ == typeExtended {
+		if offset >= uint(len(d.data)) {
+			return 0, 0, 0, fmt.Errorf("%w: truncated extended type", errCorruptData)
+		}
+		typ = 7 + int(d.data[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1F)
+	if typ == typePointer || size < 29 {
+		return typ, size, offset, nil
+	}
+	n := size - 28
+	if offset+n > uint(len(d.data)) {
+		return 0, 0, 0, fmt.Errorf("%w: truncated size", errCorruptData)
+	}
+	extra := d.uint(offset, n)
+	switch size {
+	case 29:
+		size = 29 + uint(extra)
+	case 30:
+		size = 285 + uint(extra)
+	default:
+		size = 65821 + uint(extra)
+	}
+	return typ, size, offset + n, nil
+}
+
+// pointer decodes a pointer whose control bits were already read.
+func (d decoder) pointer(ctrl, offset uint) (uint, uint, error) {
+	n := ((ctrl >> 3) & 0x3) + 1
+	if offset+n > uint(len(d.data)) {
+		return 0, 0, fmt.Errorf("%w: truncated pointer", errCorruptData)
+	}
+	value := uint(d.uint(offset, n))
+	switch n {
+	case 1:
+		value = (ctrl&0x7)<<8 | value
+	case 2:
+		value = ((ctrl&0x7)<<16 | value) + 2048
+	case 3:
+		value = ((ctrl&0x7)<<24 | value) + 526336
+	}
+	return value, offset + n, nil
+}
+
+func (d decoder) uint(offset, size uint) uint64 {
+	var v uint64
+	for _, b := range d.data[offset : offset+size] {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func (d decoder) decodeMap(size, offset uint, depth int) (interface{}, uint, error) {
+	m := make(map[string]interface{}, size)
+	for i := uint(0); i < size; i++ {
+		key, next, err := d.decode(offset, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, 0, fmt.Errorf("%w: map key is not a string", errCorruptData)
+		}
+		value, next, err := d.decode(next, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		m[name] = value
+		offset = next
+	}
+	return m, offset, nil
+}
+
+func (d decoder) decodeArray(size, offset uint, depth int) (interface{}, uint, error) {
+	a := make([]interface{}, 0, size)
+	for i := uint(0); i < size; i++ {
+		value, next, err := d.decode(offset, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		a = append(a, value)
+		offset = next
+	}
+	return a, offset, nil
+}
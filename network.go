@@ -0,0 +1,146 @@
+package forklift
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errInvalidNetwork = errors.New("invalid IP address or CIDR")
+
+// tlsVersions maps TLS protocol versions to the values used in conditions.
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "1.0",
+	tls.VersionTLS11: "1.1",
+	tls.VersionTLS12: "1.2",
+	tls.VersionTLS13: "1.3",
+}
+
+// parseNetworks parses a comma-separated list of IP addresses and CIDRs.
+// Plain addresses are treated as single-host networks.
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%w: %q", errInvalidNetwork, entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", errInvalidNetwork, entry)
+		}
+		networks = append(networks, network)
+	}
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("%w: empty list", errInvalidNetwork)
+	}
+	return networks, nil
+}
+
+// networksContain reports whether ip is inside any of the networks.
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestScheme returns the scheme the request arrived with.
+func requestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestPort returns the destination port of the request: the local port the
+// connection was accepted on, then the port in the Host header, then the
+// default port for the scheme.
+func requestPort(req *http.Request) string {
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	if _, port, err := net.SplitHostPort(req.Host); err == nil && port != "" {
+		return port
+	}
+	if requestScheme(req) == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// checkIP matches the client IP against the CIDR list in the condition value.
+// The "in" and "notIn" operators test membership; any other operator compares
+// the textual address.
+func (re *RuleEngine) checkIP(req *http.Request, condition RuleCondition) bool {
+	clientIP := re.clientIP(req)
+	operator := strings.ToLower(condition.Operator)
+	if operator != "in" && operator != "notin" {
+		return re.compareCondition(clientIP, condition, condition.Value)
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		re.logDebugf("Client IP %q is not a valid address", clientIP)
+		return false
+	}
+	networks, ok := re.networks[condition.Value]
+	if !ok {
+		re.logger.Warnf("Network list was not compiled: %s", condition.Value)
+		return false
+	}
+	result := networksContain(networks, ip) == (operator == "in")
+	re.logDebugf("IP condition for %s %s %s: %v", clientIP, condition.Operator, condition.Value, result)
+	return result
+}
+
+func (re *RuleEngine) checkTLS(req *http.Request, condition RuleCondition) bool {
+	actual := strconv.FormatBool(req.TLS != nil)
+	return re.compareCondition(actual, condition, strings.ToLower(condition.Value))
+}
+
+func (re *RuleEngine) checkTLSVersion(req *http.Request, condition RuleCondition) bool {
+	if req.TLS == nil {
+		return false
+	}
+	version, ok := tlsVersions[req.TLS.Version]
+	if !ok {
+		re.logDebugf("Unknown TLS version: %x", req.TLS.Version)
+		return false
+	}
+	return re.compareCondition(version, condition, condition.Value)
+}
+
+func (re *RuleEngine) checkSNI(req *http.Request, condition RuleCondition) bool {
+	if req.TLS == nil {
+		return false
+	}
+	return re.compareCondition(strings.ToLower(req.TLS.ServerName), condition, strings.ToLower(condition.Value))
+}
+
+func (re *RuleEngine) checkScheme(req *http.Request, condition RuleCondition) bool {
+	return re.compareCondition(requestScheme(req), condition, strings.ToLower(condition.Value))
+}
+
+func (re *RuleEngine) checkPort(req *http.Request, condition RuleCondition) bool {
+	return re.compareCondition(requestPort(req), condition, condition.Value)
+}
@@ -0,0 +1,172 @@
+package forklift
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidOverride = errors.New("invalid variant override")
+
+const (
+	overrideParam        = "forklift_variant"
+	overrideHeader       = "X-Forklift-Variant"
+	overrideScopeRequest = "request"
+	overrideScopeSession = "session"
+	overrideTokenFields  = 4
+)
+
+// variantOverride is a verified override token.
+type variantOverride struct {
+	variant    string
+	expires    time.Time
+	pinSession bool
+	token      string
+	source     string
+}
+
+// SignVariantOverride creates an override token that routes requests to the
+// rules named variant, or to an experiment's variant named
+// "experiment:variant", until expires. With pinSession, an override passed as a
+// query parameter or header is stored in a cookie for the rest of the session.
+func SignVariantOverride(secret, variant string, expires time.Time, pinSession bool) string {
+	scope := overrideScopeRequest
+	if pinSession {
+		scope = overrideScopeSession
+	}
+	payload := variant + "." + strconv.FormatInt(expires.Unix(), 10) + "." + scope
+	return payload + "." + hmacSignature(secret, payload)
+}
+
+// hmacSignature signs payload with HMAC-SHA256, encoded as unpadded base64url.
+func hmacSignature(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseVariantOverride verifies a "<variant>.<expires>.<scope>.<signature>"
+// token. The variant may itself contain dots.
+func parseVariantOverride(secret, token string, now time.Time) (variantOverride, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) < overrideTokenFields {
+		return variantOverride{}, fmt.Errorf("%w: malformed", errInvalidOverride)
+	}
+	n := len(parts)
+	payload := strings.Join(parts[:n-1], ".")
+	if !hmac.Equal([]byte(hmacSignature(secret, payload)), []byte(parts[n-1])) {
+		return variantOverride{}, fmt.Errorf("%w: bad signature", errInvalidOverride)
+	}
+	expires, err := strconv.ParseInt(parts[n-3], 10, 64)
+	if err != nil {
+		return variantOverride{}, fmt.Errorf("%w: bad expiry", errInvalidOverride)
+	}
+	if scope := parts[n-2]; scope != overrideScopeRequest && scope != overrideScopeSession {
+		return variantOverride{}, fmt.Errorf("%w: unknown scope %q", errInvalidOverride, scope)
+	}
+	override := variantOverride{
+		variant:    strings.Join(parts[:n-3], "."),
+		expires:    time.Unix(expires, 0),
+		pinSession: parts[n-2] == overrideScopeSession,
+		token:      token,
+	}
+	if !now.Before(override.expires) {
+		return variantOverride{}, fmt.Errorf("%w: expired at %s", errInvalidOverride, override.expires.UTC().Format(time.RFC3339))
+	}
+	return override, nil
+}
+
+// requestOverride returns the override token of the request, looking at the
+// query parameter, the header and the cookie in that order.
+func requestOverride(req *http.Request) (string, string) {
+	if token := req.URL.Query().Get(overrideParam); token != "" {
+		return token, "query"
+	}
+	if token := req.Header.Get(overrideHeader); token != "" {
+		return token, "header"
+	}
+	if cookie, err := req.Cookie(overrideParam); err == nil && cookie.Value != "" {
+		return cookie.Value, "cookie"
+	}
+	return "", ""
+}
+
+// overrideBackend routes requests carrying a valid override token to the
+// highest-priority rule named after the variant whose path and method match,
+// ignoring its conditions, time window and percentage. An "experiment:variant"
+// token routes requests on the experiment's routes to that variant instead.
+// Invalid tokens are ignored and the request is routed normally.
+func (a *Forklift) overrideBackend(rw http.ResponseWriter, req *http.Request) (SelectedBackend, bool) {
+	secret := a.config.VariantOverride.Secret
+	if secret == "" {
+		return SelectedBackend{}, false
+	}
+	token, source := requestOverride(req)
+	if token == "" {
+		return SelectedBackend{}, false
+	}
+	override, err := parseVariantOverride(secret, token, a.ruleEngine.now())
+	if err != nil {
+		a.logger.Warnf("Ignoring %s override from %s: %v", source, a.ruleEngine.clientIP(req), err)
+		return SelectedBackend{}, false
+	}
+	override.source = source
+
+	if selected, ok := a.overrideExperiment(req, override); ok {
+		a.logger.Infof("Variant override %q from %s applied to %s %s, routing to %s", override.variant, override.source, req.Method, req.URL.Path, selected.Backend)
+		if override.pinSession && override.source != "cookie" {
+			a.pinOverride(rw, req, override)
+		}
+		return selected, true
+	}
+	for i := range a.ruleEngine.index.entries {
+		rule := &a.ruleEngine.index.entries[i].rule
+		if rule.Name != override.variant || !a.ruleEngine.matchPath(req, *rule) || !a.ruleEngine.matchMethod(req, *rule) {
+			continue
+		}
+		a.logger.Infof("Variant override %q from %s applied to %s %s, routing to %s", override.variant, override.source, req.Method, req.URL.Path, rule.Backend)
+		if override.pinSession && override.source != "cookie" {
+			a.pinOverride(rw, req, override)
+		}
+		return SelectedBackend{Backend: rule.Backend, Rule: rule}, true
+	}
+	a.logger.Infof("Variant override %q has no rule for %s %s", override.variant, req.Method, req.URL.Path)
+	return SelectedBackend{}, false
+}
+
+// overrideExperiment resolves an "experiment:variant" override for requests on
+// the experiment's routes, regardless of the holdout, the allocation and the
+// weights. The variant is not recorded as an assignment: the override lasts as
+// long as its token, or its pinned cookie with session scope.
+func (a *Forklift) overrideExperiment(req *http.Request, override variantOverride) (SelectedBackend, bool) {
+	name, variantName, ok := strings.Cut(override.variant, ":")
+	if !ok {
+		return SelectedBackend{}, false
+	}
+	for _, e := range a.ruleEngine.experiments {
+		if e.name != name || !e.covers(a.ruleEngine, req) {
+			continue
+		}
+		for _, variant := range e.variants {
+			if variant.Name == variantName {
+				return SelectedBackend{Backend: variant.Backend, Experiment: e.name, Variant: variant.Name}, true
+			}
+		}
+	}
+	return SelectedBackend{}, false
+}
+
+// pinOverride stores the override token in a cookie that expires with it.
+func (a *Forklift) pinOverride(rw http.ResponseWriter, req *http.Request, override variantOverride) {
+	a.ruleEngine.cookies.set(rw, req, &http.Cookie{
+		Name:    overrideParam,
+		Value:   override.token,
+		Expires: override.expires,
+	})
+}
@@ -0,0 +1,162 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var (
+	errInvalidPathPattern = errors.New("invalid path pattern")
+	errInvalidPathRewrite = errors.New("invalid path rewrite")
+)
+
+var paramNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// pathPattern is a compiled pathPattern such as "/users/{id}/orders/*" or
+// "/static/**.js". "{name}" captures one non-empty path segment, "*" matches
+// within one segment and "**" matches across segments.
+type pathPattern struct {
+	regexp *regexp.Regexp
+	names  []string
+}
+
+func compilePathPattern(pattern string) (*pathPattern, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("%w: %q must start with /", errInvalidPathPattern, pattern)
+	}
+	p := &pathPattern{}
+	var expr strings.Builder
+	expr.WriteString("^")
+	for rest := pattern; rest != ""; {
+		switch {
+		case strings.HasPrefix(rest, "**"):
+			expr.WriteString(".*")
+			rest = rest[2:]
+		case rest[0] == '*':
+			expr.WriteString("[^/]*")
+			rest = rest[1:]
+		case rest[0] == '{':
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unclosed { in %q", errInvalidPathPattern, pattern)
+			}
+			name := rest[1:end]
+			if !paramNamePattern.MatchString(name) {
+				return nil, fmt.Errorf("%w: invalid parameter name %q in %q", errInvalidPathPattern, name, pattern)
+			}
+			if p.has(name) {
+				return nil, fmt.Errorf("%w: duplicate parameter %q in %q", errInvalidPathPattern, name, pattern)
+			}
+			p.names = append(p.names, name)
+			expr.WriteString("([^/]+)")
+			rest = rest[end+1:]
+		default:
+			end := strings.IndexAny(rest, "*{")
+			if end < 0 {
+				end = len(rest)
+			}
+			if strings.Contains(rest[:end], "}") {
+				return nil, fmt.Errorf("%w: unexpected } in %q", errInvalidPathPattern, pattern)
+			}
+			expr.WriteString(regexp.QuoteMeta(rest[:end]))
+			rest = rest[end:]
+		}
+	}
+	expr.WriteString("$")
+	compiled, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidPathPattern, err)
+	}
+	p.regexp = compiled
+	return p, nil
+}
+
+func (p *pathPattern) has(name string) bool {
+	for _, n := range p.names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the captured parameters if path matches the pattern.
+func (p *pathPattern) match(path string) (map[string]string, bool) {
+	groups := p.regexp.FindStringSubmatch(path)
+	if groups == nil {
+		return nil, false
+	}
+	params := make(map[string]string, len(p.names))
+	for i, name := range p.names {
+		params[name] = groups[i+1]
+	}
+	return params, true
+}
+
+// checkPathRewrite verifies that every "{name}" in a pathRewrite template is
+// captured by the rule's path pattern.
+func checkPathRewrite(template string, pattern *pathPattern) error {
+	if !strings.HasPrefix(template, "/") {
+		return fmt.Errorf("%w: %q must start with /", errInvalidPathRewrite, template)
+	}
+	var err error
+	expandPathTemplate(template, func(name string) string {
+		if err == nil && (pattern == nil || !pattern.has(name)) {
+			err = fmt.Errorf("%w: %q uses {%s}, which the path pattern does not capture", errInvalidPathRewrite, template, name)
+		}
+		return ""
+	})
+	return err
+}
+
+// expandPathTemplate replaces each "{name}" in template with lookup(name).
+func expandPathTemplate(template string, lookup func(name string) string) string {
+	var out strings.Builder
+	for rest := template; rest != ""; {
+		start := strings.IndexByte(rest, '{')
+		end := strings.IndexByte(rest, '}')
+		if start < 0 || end < start {
+			out.WriteString(rest)
+			break
+		}
+		out.WriteString(rest[:start])
+		out.WriteString(lookup(rest[start+1 : end]))
+		rest = rest[end+1:]
+	}
+	return out.String()
+}
+
+// pathParams returns the parameters the rule's path pattern captures from the
+// request path.
+func (re *RuleEngine) pathParams(req *http.Request, rule RoutingRule) (map[string]string, bool) {
+	if rule.PathPattern == "" {
+		return nil, true
+	}
+	pattern, ok := re.pathPatterns[rule.PathPattern]
+	if !ok {
+		re.logger.Warnf("Path pattern was not compiled: %s", rule.PathPattern)
+		return nil, false
+	}
+	return pattern.match(req.URL.Path)
+}
+
+// rewritePath applies the rule's pathRewrite template to the request path.
+func (re *RuleEngine) rewritePath(req *http.Request, rule RoutingRule) string {
+	params, _ := re.pathParams(req, rule)
+	return expandPathTemplate(rule.PathRewrite, func(name string) string {
+		return params[name]
+	})
+}
+
+// checkParam compares a parameter captured by the rule's path pattern.
+func (re *RuleEngine) checkParam(req *http.Request, condition RuleCondition) bool {
+	value, ok := stateOf(req).pathParams[condition.Parameter]
+	if !ok {
+		re.logDebugf("Path parameter %s not captured", condition.Parameter)
+		return false
+	}
+	return re.compareCondition(value, condition, condition.Value)
+}
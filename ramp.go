@@ -0,0 +1,286 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidRamp = errors.New("invalid ramp")
+
+// rampStep is a compiled ramp step.
+type rampStep struct {
+	at    time.Time
+	value float64
+}
+
+// ramp is a compiled ramp: either steps or a linear ramp from start to end.
+type ramp struct {
+	start    time.Time
+	end      time.Time
+	from, to float64
+	steps    []rampStep
+	pausedAt time.Time
+	// label names the rule or variant in log messages.
+	label string
+	// stage is the last stage that was logged, or 0 before the first.
+	stage int32
+}
+
+// RampStatus is the effective percentage of a ramped rule or variant.
+type RampStatus struct {
+	// Group, Method and Backend identify a ramped rule.
+	Group   string
+	Method  string
+	Backend string
+	// Experiment and Variant identify a ramped variant.
+	Experiment string
+	Variant    string
+	// Percentage is the effective percentage now: the ramp's value, scaled
+	// down with the other ramps of an experiment, or 0 once a canary rolled
+	// the rule or variant back.
+	Percentage float64
+	// Paused is set once the ramp has reached its pausedAt time.
+	Paused bool
+}
+
+// rampConfigured reports whether a ramp is configured.
+func rampConfigured(cfg config.Ramp) bool {
+	return cfg.Start != "" || len(cfg.Steps) > 0 || cfg.End != ""
+}
+
+// compileRamp parses a ramp. It returns nil if none is configured.
+func compileRamp(cfg config.Ramp) (*ramp, error) {
+	if !rampConfigured(cfg) {
+		return nil, nil
+	}
+	start, err := time.Parse(time.RFC3339, cfg.Start)
+	if err != nil {
+		return nil, fmt.Errorf("%w: start: %w", errInvalidRamp, err)
+	}
+	r := &ramp{start: start}
+	if cfg.PausedAt != "" {
+		if r.pausedAt, err = time.Parse(time.RFC3339, cfg.PausedAt); err != nil {
+			return nil, fmt.Errorf("%w: pausedAt: %w", errInvalidRamp, err)
+		}
+	}
+
+	switch {
+	case len(cfg.Steps) > 0 && cfg.End != "":
+		return nil, fmt.Errorf("%w: steps and end are mutually exclusive", errInvalidRamp)
+	case cfg.End != "":
+		if r.end, err = time.Parse(time.RFC3339, cfg.End); err != nil {
+			return nil, fmt.Errorf("%w: end: %w", errInvalidRamp, err)
+		}
+		if !r.end.After(r.start) {
+			return nil, fmt.Errorf("%w: end must be after start", errInvalidRamp)
+		}
+		if !validRampValue(cfg.From) || !validRampValue(cfg.To) {
+			return nil, fmt.Errorf("%w: from and to must be between 0 and 100", errInvalidRamp)
+		}
+		r.from, r.to = cfg.From, cfg.To
+	case len(cfg.Steps) > 0:
+		for _, step := range cfg.Steps {
+			offset, err := parseRampOffset(step.After)
+			if err != nil {
+				return nil, fmt.Errorf("%w: step after %q: %w", errInvalidRamp, step.After, err)
+			}
+			at := start.Add(offset)
+			if n := len(r.steps); n > 0 && !at.After(r.steps[n-1].at) {
+				return nil, fmt.Errorf("%w: steps must be in increasing order", errInvalidRamp)
+			}
+			if !validRampValue(step.Value) {
+				return nil, fmt.Errorf("%w: step values must be between 0 and 100", errInvalidRamp)
+			}
+			r.steps = append(r.steps, rampStep{at: at, value: step.Value})
+		}
+	default:
+		return nil, fmt.Errorf("%w: steps or end are required", errInvalidRamp)
+	}
+	return r, nil
+}
+
+func validRampValue(value float64) bool {
+	return value >= 0 && value <= maxPercentage
+}
+
+// parseRampOffset parses a step offset such as "0s", "2h" or "1d".
+func parseRampOffset(offset string) (time.Duration, error) {
+	if offset == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(offset, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid number of days %q", days)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(offset)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("negative offset %q", offset)
+	}
+	return d, err
+}
+
+// value returns the ramp's value at now. Before the start it is 0. A paused
+// ramp keeps the value it had when it was paused.
+func (r *ramp) value(now time.Time) float64 {
+	if r.isPaused(now) {
+		now = r.pausedAt
+	}
+	if now.Before(r.start) {
+		return 0
+	}
+	if len(r.steps) == 0 {
+		if !now.Before(r.end) {
+			return r.to
+		}
+		progress := float64(now.Sub(r.start)) / float64(r.end.Sub(r.start))
+		return r.from + (r.to-r.from)*progress
+	}
+	var value float64
+	for _, step := range r.steps {
+		if now.Before(step.at) {
+			break
+		}
+		value = step.value
+	}
+	return value
+}
+
+// isPaused reports whether the ramp has reached its pausedAt time.
+func (r *ramp) isPaused(now time.Time) bool {
+	return !r.pausedAt.IsZero() && now.After(r.pausedAt)
+}
+
+// stageAt identifies the part of the ramp now falls in: before the start, each
+// step or the linear ramp and its end, paused or not. It is never 0.
+func (r *ramp) stageAt(now time.Time) int32 {
+	paused := r.isPaused(now)
+	if paused {
+		now = r.pausedAt
+	}
+	var phase int32
+	switch {
+	case now.Before(r.start):
+		phase = 1
+	case len(r.steps) > 0:
+		phase = 2
+		for _, step := range r.steps {
+			if now.Before(step.at) {
+				break
+			}
+			phase++
+		}
+	case now.Before(r.end):
+		phase = 2
+	default:
+		phase = 3
+	}
+	if paused {
+		return -phase
+	}
+	return phase
+}
+
+// observeRamp returns the ramp's value at now. The first time a ramp is used
+// and whenever it reaches a new step, its end or its pausedAt time, the
+// effective percentage is logged at info level.
+func (re *RuleEngine) observeRamp(r *ramp, now time.Time) float64 {
+	value := r.value(now)
+	stage := r.stageAt(now)
+	old := atomic.LoadInt32(&r.stage)
+	if old == stage || !atomic.CompareAndSwapInt32(&r.stage, old, stage) {
+		return value
+	}
+	switch {
+	case stage < 0:
+		re.logger.Infof("Ramp of %s is paused at %g%%", r.label, value)
+	case len(r.steps) == 0 && stage == 2:
+		re.logger.Infof("Ramp of %s is at %g%%, reaching %g%% at %s", r.label, value, r.to, r.end.Format(time.RFC3339))
+	default:
+		re.logger.Infof("Ramp of %s is at %g%%", r.label, value)
+	}
+	return value
+}
+
+// Ramps returns the effective percentage of every ramped rule and variant.
+func (a *Forklift) Ramps() []RampStatus {
+	re := a.ruleEngine
+	now := re.now()
+	var ramps []RampStatus
+	for i := range re.index.entries {
+		entry := &re.index.entries[i]
+		if entry.ramp == nil {
+			continue
+		}
+		ramps = append(ramps, RampStatus{
+			Group:      groupKey(entry.rule),
+			Method:     entry.rule.Method,
+			Backend:    entry.rule.Backend,
+			Percentage: re.rulePercentage(entry, now),
+			Paused:     entry.ramp.isPaused(now),
+		})
+	}
+	for _, e := range re.experiments {
+		if e.bounds != nil {
+			continue
+		}
+		re.observeRamps(e, now)
+		shares := make([]float64, len(e.variants))
+		e.shares(now, shares)
+		for i, r := range e.ramps {
+			if r == nil {
+				continue
+			}
+			ramps = append(ramps, RampStatus{
+				Experiment: e.name,
+				Variant:    e.variants[i].Name,
+				Percentage: shares[i],
+				Paused:     r.isPaused(now),
+			})
+		}
+	}
+	return ramps
+}
+
+// rulePercentage returns the rule's percentage at now, following its ramp or
+// bandit if it has one. A rolled back canary's rule is at 0.
+func (re *RuleEngine) rulePercentage(entry *indexedRule, now time.Time) float64 {
+	if entry.canary != nil && entry.canary.isRolledBack() {
+		return 0
+	}
+	if entry.bandit != nil {
+		return entry.bandit.weight(entry.backend, now)
+	}
+	if entry.ramp != nil {
+		return re.observeRamp(entry.ramp, now)
+	}
+	return entry.rule.Percentage
+}
+
+// peak returns the highest percentage the ramp reaches.
+func (r *ramp) peak() float64 {
+	if len(r.steps) == 0 {
+		return math.Max(r.from, r.to)
+	}
+	var peak float64
+	for _, step := range r.steps {
+		peak = math.Max(peak, step.value)
+	}
+	return peak
+}
+
+// isPercentageRule reports whether a rule takes part in a percentage split. A
+// ramped rule does, even while its ramp is at 0, and so do bandit and
+// remainder rules.
+func isPercentageRule(entry *indexedRule) bool {
+	return entry.rule.Percentage != 0 || entry.ramp != nil || entry.bandit != nil || entry.rule.Remainder
+}
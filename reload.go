@@ -0,0 +1,53 @@
+package forklift
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/daemonp/forklift/logger"
+)
+
+const defaultReloadInterval = time.Minute
+
+// parseReloadInterval parses a reload interval, falling back to the default.
+func parseReloadInterval(interval string) (time.Duration, error) {
+	if interval == "" {
+		return defaultReloadInterval, nil
+	}
+	return time.ParseDuration(interval)
+}
+
+// watchFile polls path and calls load whenever its modification time or size
+// changes, until ctx is done. Failed reloads are logged and the previously
+// loaded data stays in use.
+func watchFile(ctx context.Context, path string, interval time.Duration, load func() error, log logger.Logger) {
+	lastInfo, err := os.Stat(path)
+	if err != nil {
+		log.Warnf("Cannot watch %s: %v", path, err)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Warnf("Cannot stat %s: %v", path, err)
+			continue
+		}
+		if lastInfo != nil && info.ModTime().Equal(lastInfo.ModTime()) && info.Size() == lastInfo.Size() {
+			continue
+		}
+		lastInfo = info
+		if err := load(); err != nil {
+			log.Errorf("Error reloading %s: %v", path, err)
+			continue
+		}
+		log.Infof("Reloaded %s", path)
+	}
+}
@@ -0,0 +1,264 @@
+package forklift
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ruleIndex is the rule set compiled for matching. Rules are stored in
+// evaluation order (priority descending, then configuration order), so
+// candidate positions sort into evaluation order. Candidates are found through
+// an exact-path map and a prefix trie, each bucketed by method. The index only
+// narrows the rules down; candidates are still checked with ruleMatches.
+type ruleIndex struct {
+	entries  []indexedRule
+	groups   []ruleGroup
+	exact    map[string]*methodBuckets
+	prefixes *prefixNode
+	scratch  sync.Pool
+}
+
+// indexedRule is a rule together with its percentage group.
+type indexedRule struct {
+	rule  RoutingRule
+	group int
+	// backend is the position of the rule's backend in its group's backends.
+	backend int
+	// bucketBy is the rule's parsed bucketBy list.
+	bucketBy bucketChain
+	// hash and salt are set when the rule has a hashAlgorithm other than
+	// legacy.
+	hash bucketHasher
+	salt string
+	// ramp is the rule's compiled ramp, if it has one.
+	ramp *ramp
+	// canary is set when the rule has a canary.
+	canary *canary
+	// bandit is set when the rule is an arm of its group's bandit.
+	bandit *bandit
+	// shard is the rule's consistent-hash ring, if it has one.
+	shard *shardRing
+}
+
+// ruleGroup holds rules sharing a path, path prefix or path pattern. Matching
+// rules of one group split traffic between their backends.
+type ruleGroup struct {
+	// backends are the group's distinct backends, sorted.
+	backends []string
+	// bandit is set when the group's rules have a bandit.
+	bandit *bandit
+	// srm tests the group's percentage splits for a sample ratio mismatch.
+	srm *srmTracker
+}
+
+// methodBuckets lists the positions of rules for any method and per method.
+type methodBuckets struct {
+	any      []int
+	byMethod map[string][]int
+}
+
+func (b *methodBuckets) add(method string, position int) {
+	if method == "" {
+		b.any = append(b.any, position)
+		return
+	}
+	if b.byMethod == nil {
+		b.byMethod = make(map[string][]int)
+	}
+	b.byMethod[method] = append(b.byMethod[method], position)
+}
+
+func (b *methodBuckets) appendTo(candidates []int, method string) []int {
+	candidates = append(candidates, b.any...)
+	return append(candidates, b.byMethod[method]...)
+}
+
+// prefixNode is a node of a byte-wise trie over path prefixes. The param edge
+// stands for a "{name}" parameter and consumes one whole path segment.
+type prefixNode struct {
+	children map[byte]*prefixNode
+	param    *prefixNode
+	rules    methodBuckets
+}
+
+// matchScratch holds the per-request buffers of backend selection.
+type matchScratch struct {
+	candidates []int
+	matched    []int
+	weights    []float64
+	present    []bool
+}
+
+func newRuleIndex(rules []RoutingRule) *ruleIndex {
+	idx := &ruleIndex{exact: make(map[string]*methodBuckets), prefixes: &prefixNode{}}
+	idx.scratch.New = func() interface{} { return &matchScratch{} }
+
+	order := make([]int, len(rules))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return rules[order[i]].Priority > rules[order[j]].Priority
+	})
+
+	groupOf := make(map[string]int)
+	for position, i := range order {
+		rule := rules[i]
+		key := groupKey(rule)
+		group, ok := groupOf[key]
+		if !ok {
+			group = len(idx.groups)
+			groupOf[key] = group
+			idx.groups = append(idx.groups, ruleGroup{})
+		}
+		idx.entries = append(idx.entries, indexedRule{rule: rule, group: group})
+		idx.insert(rule, position)
+	}
+
+	for g := range idx.groups {
+		seen := make(map[string]bool)
+		for _, entry := range idx.entries {
+			if entry.group == g && !seen[entry.rule.Backend] {
+				seen[entry.rule.Backend] = true
+				idx.groups[g].backends = append(idx.groups[g].backends, entry.rule.Backend)
+			}
+		}
+		sort.Strings(idx.groups[g].backends)
+	}
+	for i := range idx.entries {
+		entry := &idx.entries[i]
+		entry.backend = sort.SearchStrings(idx.groups[entry.group].backends, entry.rule.Backend)
+	}
+	return idx
+}
+
+// groupKey is the path, path prefix or path pattern that groups rules.
+func groupKey(rule RoutingRule) string {
+	switch {
+	case rule.Path != "":
+		return rule.Path
+	case rule.PathPrefix != "":
+		return rule.PathPrefix
+	default:
+		return rule.PathPattern
+	}
+}
+
+// ruleSalt seeds the bucket hash of a rule: its affinity token, or else the
+// path, path prefix or path pattern grouping it.
+func ruleSalt(rule RoutingRule) string {
+	if rule.AffinityToken != "" {
+		return rule.AffinityToken
+	}
+	return groupKey(rule)
+}
+
+// insert files a rule under its exact path, or in the trie under its path
+// prefix or the indexable start of its path pattern, whichever is longer.
+func (idx *ruleIndex) insert(rule RoutingRule, position int) {
+	if rule.Path != "" {
+		buckets, ok := idx.exact[rule.Path]
+		if !ok {
+			buckets = &methodBuckets{}
+			idx.exact[rule.Path] = buckets
+		}
+		buckets.add(rule.Method, position)
+		return
+	}
+	node := idx.prefixes.insertLiteral(rule.PathPrefix)
+	if patternNode, depth := idx.prefixes.insertPattern(rule.PathPattern); depth > len(rule.PathPrefix) {
+		node = patternNode
+	}
+	node.rules.add(rule.Method, position)
+}
+
+func (n *prefixNode) child(c byte) *prefixNode {
+	child, ok := n.children[c]
+	if !ok {
+		if n.children == nil {
+			n.children = make(map[byte]*prefixNode)
+		}
+		child = &prefixNode{}
+		n.children[c] = child
+	}
+	return child
+}
+
+func (n *prefixNode) insertLiteral(literal string) *prefixNode {
+	for i := 0; i < len(literal); i++ {
+		n = n.child(literal[i])
+	}
+	return n
+}
+
+// insertPattern walks a path pattern into the trie up to its first wildcard.
+// Parameters spanning a whole segment become parameter edges; anything else
+// ends the walk. It returns the node reached and how many pattern bytes it
+// covers.
+func (n *prefixNode) insertPattern(pattern string) (*prefixNode, int) {
+	i := 0
+	for i < len(pattern) {
+		switch pattern[i] {
+		case '*':
+			return n, i
+		case '{':
+			end := strings.IndexByte(pattern[i:], '}') + i
+			if pattern[i-1] != '/' || (end+1 < len(pattern) && pattern[end+1] != '/') {
+				return n, i
+			}
+			if n.param == nil {
+				n.param = &prefixNode{}
+			}
+			n = n.param
+			i = end + 1
+		default:
+			n = n.child(pattern[i])
+			i++
+		}
+	}
+	return n, i
+}
+
+// candidates appends the positions of the rules that may match path and
+// method, in evaluation order.
+func (idx *ruleIndex) candidates(candidates []int, path, method string) []int {
+	if buckets, ok := idx.exact[path]; ok {
+		candidates = buckets.appendTo(candidates, method)
+	}
+	candidates = idx.prefixes.collect(candidates, path, 0, method)
+	sort.Ints(candidates)
+	return candidates
+}
+
+// collect appends the rules of every node the path passes through, following
+// both literal and parameter edges.
+func (n *prefixNode) collect(candidates []int, path string, i int, method string) []int {
+	for n != nil {
+		candidates = n.rules.appendTo(candidates, method)
+		if n.param != nil && i < len(path) && path[i] != '/' {
+			end := strings.IndexByte(path[i:], '/')
+			if end < 0 {
+				end = len(path)
+			} else {
+				end += i
+			}
+			candidates = n.param.collect(candidates, path, end, method)
+		}
+		if i == len(path) {
+			break
+		}
+		n = n.children[path[i]]
+		i++
+	}
+	return candidates
+}
+
+func (idx *ruleIndex) getScratch() *matchScratch {
+	scratch, _ := idx.scratch.Get().(*matchScratch)
+	return scratch
+}
+
+func (idx *ruleIndex) putScratch(scratch *matchScratch) {
+	idx.scratch.Put(scratch)
+}
@@ -0,0 +1,212 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidSchedule   = errors.New("invalid schedule")
+	errInvalidTimeWindow = errors.New("invalid time window")
+)
+
+const minutesPerDay = 24 * 60
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// minuteRange is a half-open range of minutes since midnight. Ranges with
+// start > end wrap around midnight.
+type minuteRange struct {
+	start, end int
+}
+
+// schedule is a compiled schedule condition.
+type schedule struct {
+	location *time.Location
+	days     [7]bool
+	hours    []minuteRange
+}
+
+// contains reports whether t falls on one of the schedule's days and inside one
+// of its hour ranges, both evaluated in the schedule's timezone. The part of a
+// range that wraps past midnight belongs to the day the range started on, so
+// "fri 22:00-06:00" covers early Saturday and not early Friday.
+func (s *schedule) contains(t time.Time) bool {
+	local := t.In(s.location)
+	today := local.Weekday()
+	if len(s.hours) == 0 {
+		return s.days[today]
+	}
+	yesterday := (today + 6) % 7
+	minute := local.Hour()*60 + local.Minute()
+	for _, r := range s.hours {
+		if r.start <= r.end {
+			if s.days[today] && minute >= r.start && minute < r.end {
+				return true
+			}
+			continue
+		}
+		if s.days[today] && minute >= r.start || s.days[yesterday] && minute < r.end {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleKey identifies a schedule condition by its configuration.
+func scheduleKey(condition RuleCondition) string {
+	return condition.Timezone + "|" + strings.Join(condition.Days, ",") + "|" + strings.Join(condition.Hours, ",")
+}
+
+func parseSchedule(condition RuleCondition) (*schedule, error) {
+	location := time.UTC
+	if condition.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(condition.Timezone); err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidSchedule, err)
+		}
+	}
+	s := &schedule{location: location}
+	if len(condition.Days) == 0 {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, entry := range condition.Days {
+		if err := s.addDays(entry); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range condition.Hours {
+		r, err := parseMinuteRange(entry)
+		if err != nil {
+			return nil, err
+		}
+		s.hours = append(s.hours, r)
+	}
+	return s, nil
+}
+
+// addDays adds a day ("mon") or an inclusive day range ("mon-fri", "fri-mon").
+func (s *schedule) addDays(entry string) error {
+	from, to, isRange := strings.Cut(strings.ToLower(strings.TrimSpace(entry)), "-")
+	first, ok := weekdays[truncateDay(from)]
+	if !ok {
+		return fmt.Errorf("%w: unknown day %q", errInvalidSchedule, entry)
+	}
+	last := first
+	if isRange {
+		if last, ok = weekdays[truncateDay(to)]; !ok {
+			return fmt.Errorf("%w: unknown day %q", errInvalidSchedule, entry)
+		}
+	}
+	for day := first; ; day = (day + 1) % 7 {
+		s.days[day] = true
+		if day == last {
+			return nil
+		}
+	}
+}
+
+func truncateDay(day string) string {
+	day = strings.TrimSpace(day)
+	if len(day) > 3 {
+		return day[:3]
+	}
+	return day
+}
+
+// parseMinuteRange parses "HH:MM-HH:MM". An end of "24:00" means midnight.
+func parseMinuteRange(entry string) (minuteRange, error) {
+	from, to, ok := strings.Cut(entry, "-")
+	if !ok {
+		return minuteRange{}, fmt.Errorf("%w: hour range %q must look like 09:00-17:00", errInvalidSchedule, entry)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return minuteRange{}, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return minuteRange{}, err
+	}
+	if start == end {
+		return minuteRange{}, fmt.Errorf("%w: empty hour range %q", errInvalidSchedule, entry)
+	}
+	return minuteRange{start: start % minutesPerDay, end: end}, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight, up to "24:00".
+func parseClock(s string) (int, error) {
+	hours, minutes, ok := strings.Cut(strings.TrimSpace(s), ":")
+	hour, hourErr := strconv.Atoi(hours)
+	minute, minuteErr := strconv.Atoi(minutes)
+	if !ok || hourErr != nil || minuteErr != nil || len(hours) > 2 || len(minutes) != 2 ||
+		strings.Trim(hours+minutes, "0123456789") != "" || minute > 59 || hour*60+minute > minutesPerDay {
+		return 0, fmt.Errorf("%w: invalid time of day %q", errInvalidSchedule, s)
+	}
+	return hour*60 + minute, nil
+}
+
+// parseTimeWindow parses the activeFrom and activeUntil bounds of a rule.
+func parseTimeWindow(from, until string) (time.Time, time.Time, error) {
+	var start, end time.Time
+	var err error
+	if from != "" {
+		if start, err = time.Parse(time.RFC3339, from); err != nil {
+			return start, end, fmt.Errorf("%w: activeFrom: %w", errInvalidTimeWindow, err)
+		}
+	}
+	if until != "" {
+		if end, err = time.Parse(time.RFC3339, until); err != nil {
+			return start, end, fmt.Errorf("%w: activeUntil: %w", errInvalidTimeWindow, err)
+		}
+	}
+	if !start.IsZero() && !end.IsZero() && !end.After(start) {
+		return start, end, fmt.Errorf("%w: activeUntil must be after activeFrom", errInvalidTimeWindow)
+	}
+	return start, end, nil
+}
+
+// ruleActive reports whether the rule's activeFrom/activeUntil window contains
+// the current time.
+func (re *RuleEngine) ruleActive(rule RoutingRule) bool {
+	if rule.ActiveFrom == "" && rule.ActiveUntil == "" {
+		return true
+	}
+	now := re.now()
+	if start, ok := re.times[rule.ActiveFrom]; ok && now.Before(start) {
+		re.logDebugf("Rule for %s%s is not active before %s", rule.Path, rule.PathPrefix, rule.ActiveFrom)
+		return false
+	}
+	if end, ok := re.times[rule.ActiveUntil]; ok && !now.Before(end) {
+		re.logDebugf("Rule for %s%s expired at %s", rule.Path, rule.PathPrefix, rule.ActiveUntil)
+		return false
+	}
+	return true
+}
+
+func (re *RuleEngine) checkSchedule(_ *http.Request, condition RuleCondition) bool {
+	s, ok := re.schedules[scheduleKey(condition)]
+	if !ok {
+		re.logger.Warnf("Schedule was not compiled: %s", scheduleKey(condition))
+		return false
+	}
+	return s.contains(re.now())
+}
+
+// SetClock replaces the clock used for time windows, schedules and token
+// expiry. It is meant for tests and must be called before serving requests.
+func (a *Forklift) SetClock(now func() time.Time) {
+	a.ruleEngine.now = now
+}
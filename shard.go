@@ -0,0 +1,140 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidShard = errors.New("invalid shard")
+
+const (
+	defaultVirtualNodes = 160
+	maxVirtualNodes     = 10000
+)
+
+// shardRing is a consistent-hash ring. Each backend owns the arcs ending at
+// its virtual nodes, so removing a backend only moves the keys it owned, and
+// adding one only takes keys from the others.
+type shardRing struct {
+	backends []string
+	// points are the virtual nodes in ascending order, and owners the
+	// position of each point's backend.
+	points []uint64
+	owners []int
+}
+
+// shardConfigured reports whether a shard is configured.
+func shardConfigured(cfg config.Shard) bool {
+	return len(cfg.Backends) > 0 || cfg.VirtualNodes != 0
+}
+
+// validateShard checks a rule's shard settings.
+func validateShard(rule RoutingRule) error {
+	if !shardConfigured(rule.Shard) {
+		return nil
+	}
+	if rule.Backend == "" {
+		return fmt.Errorf("%w: backend is required as the fallback for requests without a bucketing key", errInvalidShard)
+	}
+	if rule.Percentage != 0 || rampConfigured(rule.Ramp) || banditConfigured(rule.Bandit) || rule.Remainder || canaryConfigured(rule.Canary) {
+		return fmt.Errorf("%w: shard is mutually exclusive with percentage, ramp, bandit, remainder and canary", errInvalidShard)
+	}
+	_, err := newShardRing(rule.Shard)
+	return err
+}
+
+// newShardRing builds the ring of a shard. It returns nil if none is configured.
+func newShardRing(cfg config.Shard) (*shardRing, error) {
+	if !shardConfigured(cfg) {
+		return nil, nil
+	}
+	if len(cfg.Backends) == 0 {
+		return nil, fmt.Errorf("%w: backends are required", errInvalidShard)
+	}
+	nodes := cfg.VirtualNodes
+	if nodes < 0 || nodes > maxVirtualNodes {
+		return nil, fmt.Errorf("%w: virtualNodes must be between 0 and %d", errInvalidShard, maxVirtualNodes)
+	}
+	if nodes == 0 {
+		nodes = defaultVirtualNodes
+	}
+	r := &shardRing{backends: cfg.Backends}
+	seen := make(map[string]bool, len(cfg.Backends))
+	for owner, backend := range cfg.Backends {
+		if backend == "" || seen[backend] {
+			return nil, fmt.Errorf("%w: backends must be distinct and not empty", errInvalidShard)
+		}
+		seen[backend] = true
+		for v := 0; v < nodes; v++ {
+			r.points = append(r.points, ringHash(backend+"#"+strconv.Itoa(v)))
+			r.owners = append(r.owners, owner)
+		}
+	}
+	// Ties are broken by backend, so the ring doesn't depend on the order of
+	// the backends.
+	sort.Sort(r)
+	return r, nil
+}
+
+func (r *shardRing) Len() int { return len(r.points) }
+
+func (r *shardRing) Less(i, j int) bool {
+	if r.points[i] != r.points[j] {
+		return r.points[i] < r.points[j]
+	}
+	return r.backends[r.owners[i]] < r.backends[r.owners[j]]
+}
+
+func (r *shardRing) Swap(i, j int) {
+	r.points[i], r.points[j] = r.points[j], r.points[i]
+	r.owners[i], r.owners[j] = r.owners[j], r.owners[i]
+}
+
+// backend returns the backend owning the key: that of the first point at or
+// after the key's hash, wrapping around the ring.
+func (r *shardRing) backend(key string) string {
+	h := ringHash(key)
+	lo, hi := 0, len(r.points)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if r.points[mid] < h {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo == len(r.points) {
+		lo = 0
+	}
+	return r.backends[r.owners[lo]]
+}
+
+// ringHash places a string on the ring: 64-bit FNV-1a, finished with the
+// MurmurHash3 fmix64 mixer so that similar strings spread evenly.
+func ringHash(s string) uint64 {
+	h := fnvAdd(fnvOffset64, s)
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// selectShard routes the request to the shard owning its bucketing key, or to
+// the rule's backend if the request has none.
+func (a *Forklift) selectShard(req *http.Request, entry *indexedRule, sessionID string) SelectedBackend {
+	key, ok := a.bucketKey(req, entry, sessionID)
+	if !ok {
+		a.ruleEngine.logDebugf("No shard key, routing to %s", entry.rule.Backend)
+		return SelectedBackend{Backend: entry.rule.Backend, Rule: &entry.rule}
+	}
+	backend := entry.shard.backend(key)
+	a.ruleEngine.logDebugf("Shard key maps to %s", backend)
+	return SelectedBackend{Backend: backend, Rule: &entry.rule}
+}
@@ -0,0 +1,280 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errInvalidSplit = errors.New("invalid split")
+
+// Allocation is the effective percentage split of a rule group for a method
+// and a set of rule conditions, as it would be if all of its rules matched.
+type Allocation struct {
+	// Group is the path, path prefix or path pattern of the group's rules.
+	Group string
+	// Method is the method the split applies to, or empty for every method.
+	Method string
+	// Conditions describes the conditions of the split's conditional rules, or
+	// is empty when none of its rules have conditions.
+	Conditions string
+	// Shares holds the percentage of each backend, including the unallocated
+	// share of the remainder.
+	Shares map[string]float64
+	// Remainder is the backend of the unallocated share: the group's remainder
+	// rule, or else the default backend.
+	Remainder string
+}
+
+// split is the percentage rules of a group that can match a request together:
+// those for the method and those for any method, with the same conditions or
+// none.
+type split struct {
+	group      int
+	method     string
+	conditions string
+	positions  []int
+}
+
+// splits returns the splits of the groups with percentage rules, for each
+// method and set of conditions.
+func (idx *ruleIndex) splits() []split {
+	var splits []split
+	for _, s := range idx.methodSplits() {
+		splits = append(splits, idx.conditionSplits(s)...)
+	}
+	return splits
+}
+
+// methodSplits returns a split for each method the percentage rules of a group
+// name, or a single one for any method. Rules for different methods never
+// match the same request.
+func (idx *ruleIndex) methodSplits() []split {
+	var splits []split
+	for g := range idx.groups {
+		var any []int
+		var methods []string
+		byMethod := make(map[string][]int)
+		for position := range idx.entries {
+			entry := &idx.entries[position]
+			if entry.group != g || !isPercentageRule(entry) {
+				continue
+			}
+			method := entry.rule.Method
+			if method == "" {
+				any = append(any, position)
+				continue
+			}
+			if _, ok := byMethod[method]; !ok {
+				methods = append(methods, method)
+			}
+			byMethod[method] = append(byMethod[method], position)
+		}
+		if len(methods) == 0 && len(any) > 0 {
+			splits = append(splits, split{group: g, positions: any})
+		}
+		sort.Strings(methods)
+		for _, method := range methods {
+			positions := append(append([]int(nil), any...), byMethod[method]...)
+			splits = append(splits, split{group: g, method: method, positions: positions})
+		}
+	}
+	return splits
+}
+
+// conditionSplits divides a method split by the conditions of its rules. Rules
+// with identical conditions form a split, together with the rules without
+// conditions, which match alongside any of them. Rules with different
+// conditions may exclude each other, such as one per device type, so they are
+// not counted together.
+func (idx *ruleIndex) conditionSplits(s split) []split {
+	var common []int
+	var labels []string
+	byConditions := make(map[string][]int)
+	for _, position := range s.positions {
+		label := conditionsLabel(idx.entries[position].rule)
+		if label == "" {
+			common = append(common, position)
+			continue
+		}
+		if _, ok := byConditions[label]; !ok {
+			labels = append(labels, label)
+		}
+		byConditions[label] = append(byConditions[label], position)
+	}
+	if len(labels) == 0 {
+		return []split{s}
+	}
+	splits := make([]split, 0, len(labels))
+	for _, label := range labels {
+		positions := append(append([]int(nil), common...), byConditions[label]...)
+		splits = append(splits, split{group: s.group, method: s.method, conditions: label, positions: positions})
+	}
+	return splits
+}
+
+// conditionsLabel describes the conditions and expression of a rule, or
+// returns an empty string when it has neither.
+func conditionsLabel(rule RoutingRule) string {
+	parts := make([]string, 0, len(rule.Conditions)+1)
+	for _, condition := range rule.Conditions {
+		var fields []string
+		for _, field := range []string{
+			condition.Type, condition.Parameter, condition.QueryParam, condition.Operator, condition.Value,
+			strings.Join(condition.Days, ","), strings.Join(condition.Hours, ","), condition.Timezone,
+		} {
+			if field != "" {
+				fields = append(fields, field)
+			}
+		}
+		parts = append(parts, strings.Join(fields, " "))
+	}
+	if rule.Expr != "" {
+		parts = append(parts, "expr "+rule.Expr)
+	}
+	return strings.Join(parts, " and ")
+}
+
+// validateSplits checks that the percentages of each split add up to at most
+// 100, counting ramps at their peak, and warns about splits that leave a share
+// to the default backend. It then logs the effective allocations.
+func (re *RuleEngine) validateSplits() error {
+	idx := re.index
+	for _, ms := range idx.methodSplits() {
+		splits := idx.conditionSplits(ms)
+		if total, _ := idx.splitTotal(ms); total > maxPercentage && len(splits) > 1 && idx.groups[ms.group].bandit == nil {
+			re.logger.Warnf("Percentages for %s add up to %g%% across rules with different conditions; they are checked for each set of conditions, so make sure no request matches several of them",
+				splitLabel(groupKey(idx.entries[ms.positions[0]].rule), ms.method), total)
+		}
+		for _, s := range splits {
+			if err := re.validateSplit(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateSplit checks and logs a single split.
+func (re *RuleEngine) validateSplit(s split) error {
+	idx := re.index
+	name := conditionalLabel(groupKey(idx.entries[s.positions[0]].rule), s.method, s.conditions)
+	// Bandit weights always add up to 100 and are only known once traffic
+	// arrives.
+	if idx.groups[s.group].bandit != nil {
+		re.logger.Infof("Allocation of %s is set by its bandit", name)
+		return nil
+	}
+	total, remainders := idx.splitTotal(s)
+	if remainders > 1 {
+		return fmt.Errorf("%w %s: only one rule can be the remainder", errInvalidSplit, name)
+	}
+	if total > maxPercentage {
+		return fmt.Errorf("%w %s: percentages add up to %g%%", errInvalidSplit, name, total)
+	}
+	if total < maxPercentage && remainders == 0 {
+		re.logger.Warnf("Percentages for %s add up to %g%%, the remaining %g%% goes to the default backend %s; declare a remainder rule to make this explicit",
+			name, total, maxPercentage-total, re.config.DefaultBackend)
+	}
+	re.logger.Infof("Allocation of %s", formatAllocation(re.allocation(s, re.now())))
+	return nil
+}
+
+// splitTotal returns the sum of the percentages of a split, counting ramps at
+// their peak, and its number of remainder rules.
+func (idx *ruleIndex) splitTotal(s split) (float64, int) {
+	var total float64
+	remainders := 0
+	for _, position := range s.positions {
+		entry := &idx.entries[position]
+		switch {
+		case entry.rule.Remainder:
+			remainders++
+		case entry.ramp != nil:
+			total += entry.ramp.peak()
+		default:
+			total += entry.rule.Percentage
+		}
+	}
+	return total, remainders
+}
+
+// validateRemainder checks that a remainder rule has no share of its own.
+func validateRemainder(rule RoutingRule) error {
+	if rule.Remainder && (rule.Percentage != 0 || rampConfigured(rule.Ramp) || banditConfigured(rule.Bandit)) {
+		return fmt.Errorf("%w: remainder is mutually exclusive with percentage, ramp and bandit", errInvalidSplit)
+	}
+	return nil
+}
+
+// allocation returns the effective allocation of a split at now.
+func (re *RuleEngine) allocation(s split, now time.Time) Allocation {
+	idx := re.index
+	allocation := Allocation{
+		Group:      groupKey(idx.entries[s.positions[0]].rule),
+		Method:     s.method,
+		Conditions: s.conditions,
+		Shares:     make(map[string]float64),
+		Remainder:  re.config.DefaultBackend,
+	}
+	var total float64
+	for _, position := range s.positions {
+		entry := &idx.entries[position]
+		if entry.rule.Remainder {
+			allocation.Remainder = entry.rule.Backend
+			continue
+		}
+		// A bandit weighs backends, not rules.
+		if _, ok := allocation.Shares[entry.rule.Backend]; ok && entry.bandit != nil {
+			continue
+		}
+		percentage := re.rulePercentage(entry, now)
+		allocation.Shares[entry.rule.Backend] += percentage
+		total += percentage
+	}
+	if total < maxPercentage {
+		allocation.Shares[allocation.Remainder] += maxPercentage - total
+	}
+	return allocation
+}
+
+// Allocations returns the effective allocation of every rule group with a
+// percentage split, for each method and set of conditions its rules name.
+func (a *Forklift) Allocations() []Allocation {
+	now := a.ruleEngine.now()
+	splits := a.ruleEngine.index.splits()
+	allocations := make([]Allocation, 0, len(splits))
+	for _, s := range splits {
+		allocations = append(allocations, a.ruleEngine.allocation(s, now))
+	}
+	return allocations
+}
+
+func splitLabel(group, method string) string {
+	if method != "" {
+		return method + " " + group
+	}
+	return group
+}
+
+func conditionalLabel(group, method, conditions string) string {
+	if conditions != "" {
+		return splitLabel(group, method) + " when " + conditions
+	}
+	return splitLabel(group, method)
+}
+
+func formatAllocation(allocation Allocation) string {
+	backends := make([]string, 0, len(allocation.Shares))
+	for backend := range allocation.Shares {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+	shares := make([]string, 0, len(backends))
+	for _, backend := range backends {
+		shares = append(shares, fmt.Sprintf("%s %g%%", backend, allocation.Shares[backend]))
+	}
+	return conditionalLabel(allocation.Group, allocation.Method, allocation.Conditions) + ": " + strings.Join(shares, ", ")
+}
@@ -0,0 +1,388 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daemonp/forklift/logger"
+)
+
+var errInvalidSampleRatio = errors.New("invalid sampleRatio")
+
+const (
+	defaultSRMWindow       = time.Hour
+	defaultSRMMinDecisions = 1000
+	defaultSRMPValue       = 0.001
+	// srmSlots is the number of slots the window is divided into.
+	srmSlots = 10
+	// srmCheckInterval is how often a tracker is tested at most.
+	srmCheckInterval = time.Second
+)
+
+// SampleRatio is the outcome of the sample ratio mismatch test of an
+// experiment or a rule group over the window.
+type SampleRatio struct {
+	// Experiment is set for experiments, Group for rule groups.
+	Experiment string
+	Group      string
+	// Decisions counts the assignments made by hashing, per variant or
+	// backend. Requests also counts the requests of sticky assignments.
+	Decisions map[string]int
+	Requests  map[string]int
+	// Expected is the number of decisions each variant or backend should have
+	// got under the configured split.
+	Expected   map[string]float64
+	ChiSquared float64
+	PValue     float64
+	// Mismatch is set when the window has enough decisions and PValue is below
+	// the significance level.
+	Mismatch bool
+}
+
+// srmSlot counts the decisions of one slot of the window, per cell.
+type srmSlot struct {
+	epoch     int64
+	decisions []int
+	requests  []int
+	// expected sums the share each decision gave each cell.
+	expected []float64
+}
+
+// srmTracker counts the decisions of an experiment or a rule group and tests
+// them for a sample ratio mismatch. The cells of an experiment are its
+// variants; those of a rule group are its backends, and the default backend
+// for the unallocated share unless it is one of them.
+type srmTracker struct {
+	experiment string
+	group      string
+	cells      []string
+	// unallocated is the cell of a rule group's unallocated share.
+	unallocated  int
+	width        time.Duration
+	minDecisions int
+	pValue       float64
+	logger       logger.Logger
+
+	mu      sync.Mutex
+	slots   [srmSlots]srmSlot
+	checked time.Time
+	// shares is a buffer for the expected shares of a decision.
+	shares   []float64
+	mismatch int32
+}
+
+// compileSampleRatios sets up a tracker for every experiment and every rule
+// group with a percentage split.
+func (re *RuleEngine) compileSampleRatios() error {
+	cfg := re.config.SampleRatio
+	if cfg.Disabled {
+		return nil
+	}
+	width := defaultSRMWindow
+	if cfg.Window != "" {
+		d, err := time.ParseDuration(cfg.Window)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("%w: window %q", errInvalidSampleRatio, cfg.Window)
+		}
+		width = d
+	}
+	width /= srmSlots
+	minDecisions := cfg.MinDecisions
+	if minDecisions < 0 {
+		return fmt.Errorf("%w: minDecisions must not be negative", errInvalidSampleRatio)
+	}
+	if minDecisions == 0 {
+		minDecisions = defaultSRMMinDecisions
+	}
+	pValue := cfg.PValue
+	if pValue < 0 || pValue >= 1 {
+		return fmt.Errorf("%w: pValue must be between 0 and 1", errInvalidSampleRatio)
+	}
+	if pValue == 0 {
+		pValue = defaultSRMPValue
+	}
+	newTracker := func(cells []string) *srmTracker {
+		t := &srmTracker{
+			cells:        cells,
+			width:        width,
+			minDecisions: minDecisions,
+			pValue:       pValue,
+			logger:       re.logger,
+			shares:       make([]float64, len(cells)),
+		}
+		for i := range t.slots {
+			t.slots[i] = srmSlot{
+				decisions: make([]int, len(cells)),
+				requests:  make([]int, len(cells)),
+				expected:  make([]float64, len(cells)),
+			}
+		}
+		return t
+	}
+
+	for _, e := range re.experiments {
+		cells := make([]string, len(e.variants))
+		for i, variant := range e.variants {
+			cells[i] = variant.Name
+		}
+		e.srm = newTracker(cells)
+		e.srm.experiment = e.name
+	}
+	idx := re.index
+	for g := range idx.groups {
+		for i := range idx.entries {
+			if entry := &idx.entries[i]; entry.group == g && isPercentageRule(entry) {
+				backends := idx.groups[g].backends
+				unallocated := len(backends)
+				for i, backend := range backends {
+					if backend == re.config.DefaultBackend {
+						unallocated = i
+					}
+				}
+				cells := append([]string(nil), backends...)
+				if unallocated == len(backends) {
+					cells = append(cells, re.config.DefaultBackend)
+				}
+				idx.groups[g].srm = newTracker(cells)
+				idx.groups[g].srm.group = groupKey(entry.rule)
+				idx.groups[g].srm.unallocated = unallocated
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (t *srmTracker) epoch(now time.Time) int64 {
+	return now.UnixNano() / int64(t.width)
+}
+
+// slot returns the current slot. The caller holds t.mu.
+func (t *srmTracker) slot(now time.Time) *srmSlot {
+	epoch := t.epoch(now)
+	slot := &t.slots[epoch%srmSlots]
+	if slot.epoch != epoch {
+		slot.epoch = epoch
+		for i := range t.cells {
+			slot.decisions[i], slot.requests[i], slot.expected[i] = 0, 0, 0
+		}
+	}
+	return slot
+}
+
+// request counts a request of a sticky assignment to the cell.
+func (t *srmTracker) request(now time.Time, cell int) {
+	t.mu.Lock()
+	t.slot(now).requests[cell]++
+	t.mu.Unlock()
+}
+
+// decideVariant counts an assignment to the experiment's variant.
+func (t *srmTracker) decideVariant(now time.Time, e *experiment, variant int) {
+	t.mu.Lock()
+	e.shares(now, t.shares)
+	t.decide(now, variant)
+	t.mu.Unlock()
+	t.check(now)
+}
+
+// decideSplit counts a percentage split of a rule group to the backend at
+// position cell, or to the unallocated share if cell is len(weights), given
+// the percentage of each present backend.
+func (t *srmTracker) decideSplit(now time.Time, cell int, weights []float64, present []bool) {
+	t.mu.Lock()
+	unallocated := maxPercentage
+	for i := range t.shares {
+		t.shares[i] = 0
+	}
+	for i := range weights {
+		if present[i] {
+			t.shares[i] = weights[i]
+			unallocated -= weights[i]
+		}
+	}
+	t.shares[t.unallocated] += math.Max(0, unallocated)
+	if cell == len(weights) {
+		cell = t.unallocated
+	}
+	t.decide(now, cell)
+	t.mu.Unlock()
+	t.check(now)
+}
+
+// decide counts a decision with the shares in t.shares. The caller holds t.mu.
+func (t *srmTracker) decide(now time.Time, cell int) {
+	var total float64
+	for _, share := range t.shares {
+		total += share
+	}
+	if total <= 0 {
+		return
+	}
+	slot := t.slot(now)
+	slot.decisions[cell]++
+	slot.requests[cell]++
+	for i, share := range t.shares {
+		slot.expected[i] += share / total
+	}
+}
+
+// check tests the window at most once per srmCheckInterval, and logs when a
+// mismatch appears or goes away.
+func (t *srmTracker) check(now time.Time) {
+	t.mu.Lock()
+	if now.Sub(t.checked) < srmCheckInterval {
+		t.mu.Unlock()
+		return
+	}
+	t.checked = now
+	t.mu.Unlock()
+
+	result := t.test(now)
+	switch {
+	case result.Mismatch && atomic.CompareAndSwapInt32(&t.mismatch, 0, 1):
+		t.logger.Warnf("Sample ratio mismatch in %s: %s (chi-squared %.1f, p = %.2g)", t, formatSampleRatio(t.cells, result), result.ChiSquared, result.PValue)
+	case !result.Mismatch && atomic.CompareAndSwapInt32(&t.mismatch, 1, 0):
+		t.logger.Infof("Sample ratio mismatch in %s is gone: %s", t, formatSampleRatio(t.cells, result))
+	}
+}
+
+// test runs a chi-squared test of the decisions in the window against the
+// expected ones.
+func (t *srmTracker) test(now time.Time) SampleRatio {
+	result := SampleRatio{
+		Experiment: t.experiment,
+		Group:      t.group,
+		Decisions:  make(map[string]int, len(t.cells)),
+		Requests:   make(map[string]int, len(t.cells)),
+		Expected:   make(map[string]float64, len(t.cells)),
+		PValue:     1,
+	}
+	decisions := make([]int, len(t.cells))
+	expected := make([]float64, len(t.cells))
+	epoch := t.epoch(now)
+	var total int
+	t.mu.Lock()
+	for i := range t.slots {
+		slot := &t.slots[i]
+		if slot.epoch > epoch || slot.epoch <= epoch-srmSlots {
+			continue
+		}
+		for j, cell := range t.cells {
+			decisions[j] += slot.decisions[j]
+			expected[j] += slot.expected[j]
+			result.Requests[cell] += slot.requests[j]
+			total += slot.decisions[j]
+		}
+	}
+	t.mu.Unlock()
+
+	cells := 0
+	for j, cell := range t.cells {
+		result.Decisions[cell] += decisions[j]
+		result.Expected[cell] += expected[j]
+		if expected[j] > 0 {
+			d := float64(decisions[j]) - expected[j]
+			result.ChiSquared += d * d / expected[j]
+			cells++
+		}
+	}
+	if cells > 1 {
+		result.PValue = chiSquaredSurvival(result.ChiSquared, cells-1)
+	}
+	result.Mismatch = total >= t.minDecisions && result.PValue < t.pValue
+	return result
+}
+
+func (t *srmTracker) String() string {
+	if t.experiment != "" {
+		return "experiment " + t.experiment
+	}
+	return "rules for " + t.group
+}
+
+func formatSampleRatio(cells []string, result SampleRatio) string {
+	counts := make([]string, 0, len(cells))
+	for _, cell := range cells {
+		counts = append(counts, fmt.Sprintf("%s %d of %.0f expected", cell, result.Decisions[cell], result.Expected[cell]))
+	}
+	return strings.Join(counts, ", ")
+}
+
+// SampleRatios returns the outcome of the sample ratio mismatch test of every
+// experiment and every rule group with a percentage split.
+func (a *Forklift) SampleRatios() []SampleRatio {
+	now := a.ruleEngine.now()
+	var results []SampleRatio
+	for _, e := range a.ruleEngine.experiments {
+		if e.srm != nil {
+			results = append(results, e.srm.test(now))
+		}
+	}
+	for _, group := range a.ruleEngine.index.groups {
+		if group.srm != nil {
+			results = append(results, group.srm.test(now))
+		}
+	}
+	return results
+}
+
+// chiSquaredSurvival returns the probability that a chi-squared variable with
+// df degrees of freedom is at least x.
+func chiSquaredSurvival(x float64, df int) float64 {
+	if x <= 0 {
+		return 1
+	}
+	return upperGamma(float64(df)/2, x/2)
+}
+
+// upperGamma returns the regularized upper incomplete gamma function Q(a, x),
+// from its series below a+1 and from its continued fraction above.
+func upperGamma(a, x float64) float64 {
+	const (
+		iterations = 500
+		epsilon    = 1e-15
+		tiny       = 1e-300
+	)
+	lgamma, _ := math.Lgamma(a)
+	prefix := math.Exp(-x + a*math.Log(x) - lgamma)
+	if x < a+1 {
+		term := 1 / a
+		sum := term
+		for n := 1; n < iterations; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if term < sum*epsilon {
+				break
+			}
+		}
+		return math.Max(0, 1-sum*prefix)
+	}
+	// Modified Lentz's method.
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for n := 1; n < iterations; n++ {
+		an := -float64(n) * (float64(n) - a)
+		b += 2
+		if d = an*d + b; math.Abs(d) < tiny {
+			d = tiny
+		}
+		if c = b + an/c; math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < epsilon {
+			break
+		}
+	}
+	return prefix * h
+}
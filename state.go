@@ -0,0 +1,66 @@
+package forklift
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// requestState holds values derived from a request while it is being routed,
+// so that they are computed at most once per request.
+type requestState struct {
+	clientIP         string
+	clientIPResolved bool
+
+	pathParams map[string]string
+
+	body         []byte
+	bodyRead     bool
+	bodyComplete bool
+
+	form       url.Values
+	formFiles  []formFile
+	formParsed bool
+	formValid  bool
+
+	json        interface{}
+	jsonDecoded bool
+	jsonValid   bool
+
+	jwtClaims   map[string]interface{}
+	jwtVerified bool
+
+	graphqlOps    []graphqlOperation
+	graphqlParsed bool
+
+	assignments        map[string]string
+	assignmentsChanged bool
+
+	heldOut        bool
+	holdoutChecked bool
+
+	// splitCanaries are the rule canaries of the percentage splits the request
+	// went through.
+	splitCanaries []*canary
+	// canaryArms, bandit and banditArm say what the response is counted in.
+	canaryArms []*canaryArm
+	bandit     *bandit
+	banditArm  int
+	banditNew  bool
+}
+
+type requestStateKey struct{}
+
+// withRequestState attaches a fresh requestState to the request.
+func withRequestState(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestStateKey{}, &requestState{}))
+}
+
+// stateOf returns the state attached to the request. Requests without state get
+// a throwaway one, so callers never need to check for nil.
+func stateOf(req *http.Request) *requestState {
+	if state, ok := req.Context().Value(requestStateKey{}).(*requestState); ok {
+		return state
+	}
+	return &requestState{}
+}
@@ -0,0 +1,153 @@
+package forklift
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidAssignments      = errors.New("invalid assignment cookie")
+	errInvalidAssignmentMaxAge = errors.New("stickyAssignments maxAge must be a positive duration")
+)
+
+const (
+	assignmentCookieName = "forklift_assignments"
+)
+
+// encodeAssignments encodes an experiment to variant map as the signed cookie
+// value "<base64url(payload)>.<signature>". The payload lists
+// "experiment:variant" entries, sorted and separated by commas, with both
+// names query-escaped.
+func encodeAssignments(secret string, assignments map[string]string) string {
+	entries := make([]string, 0, len(assignments))
+	for experiment, variant := range assignments {
+		entries = append(entries, url.QueryEscape(experiment)+":"+url.QueryEscape(variant))
+	}
+	sort.Strings(entries)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(strings.Join(entries, ",")))
+	return payload + "." + hmacSignature(secret, payload)
+}
+
+// decodeAssignments verifies and decodes an assignment cookie value.
+func decodeAssignments(secret, value string) (map[string]string, error) {
+	payload, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed", errInvalidAssignments)
+	}
+	if !hmac.Equal([]byte(hmacSignature(secret, payload)), []byte(signature)) {
+		return nil, fmt.Errorf("%w: bad signature", errInvalidAssignments)
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidAssignments, err)
+	}
+	assignments := make(map[string]string)
+	if len(decoded) == 0 {
+		return assignments, nil
+	}
+	for _, entry := range strings.Split(string(decoded), ",") {
+		experiment, variant, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: malformed entry", errInvalidAssignments)
+		}
+		if experiment, err = url.QueryUnescape(experiment); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidAssignments, err)
+		}
+		if variant, err = url.QueryUnescape(variant); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidAssignments, err)
+		}
+		assignments[experiment] = variant
+	}
+	return assignments, nil
+}
+
+// requestAssignments returns the sticky assignments of the request's cookie,
+// decoding it once per request. Missing, tampered or malformed cookies yield
+// no assignments.
+func (re *RuleEngine) requestAssignments(req *http.Request) map[string]string {
+	state := stateOf(req)
+	if state.assignments != nil {
+		return state.assignments
+	}
+	state.assignments = make(map[string]string)
+	cookie, err := req.Cookie(assignmentCookieName)
+	if err != nil || cookie.Value == "" {
+		return state.assignments
+	}
+	assignments, err := decodeAssignments(re.config.StickyAssignments.Secret, cookie.Value)
+	if err != nil {
+		re.logger.Warnf("Ignoring assignment cookie from %s: %v", re.clientIP(req), err)
+		return state.assignments
+	}
+	state.assignments = assignments
+	return assignments
+}
+
+// stickyVariant returns the position of the variant the request's cookie
+// assigns for the experiment, if sticky assignments are enabled and the
+// variant still exists.
+func (re *RuleEngine) stickyVariant(req *http.Request, e *experiment) (int, bool) {
+	if re.config.StickyAssignments.Secret == "" {
+		return 0, false
+	}
+	name, ok := re.requestAssignments(req)[e.name]
+	if !ok {
+		return 0, false
+	}
+	for i, variant := range e.variants {
+		if variant.Name != name {
+			continue
+		}
+		if e.rolledBack(i) {
+			re.logDebugf("Variant %s of experiment %s was rolled back, reassigning", name, e.name)
+			return 0, false
+		}
+		return i, true
+	}
+	re.logDebugf("Variant %s of experiment %s no longer exists, reassigning", name, e.name)
+	return 0, false
+}
+
+// recordAssignment stores a new assignment of an experiment or bandit, to be
+// written by writeAssignments.
+func (re *RuleEngine) recordAssignment(req *http.Request, name, value string) {
+	if re.config.StickyAssignments.Secret == "" {
+		return
+	}
+	state := stateOf(req)
+	re.requestAssignments(req)[name] = value
+	state.assignmentsChanged = true
+}
+
+// writeAssignments sets the assignment cookie if the request got a new
+// assignment. Assignments of experiments and bandits that no longer exist are
+// dropped.
+func (a *Forklift) writeAssignments(rw http.ResponseWriter, req *http.Request) {
+	state := stateOf(req)
+	if !state.assignmentsChanged {
+		return
+	}
+	assignments := make(map[string]string, len(state.assignments))
+	for _, e := range a.ruleEngine.experiments {
+		if variant, ok := state.assignments[e.name]; ok {
+			assignments[e.name] = variant
+		}
+	}
+	for name, value := range state.assignments {
+		if a.ruleEngine.knownBanditAssignment(name) {
+			assignments[name] = value
+		}
+	}
+	a.ruleEngine.cookies.set(rw, req, &http.Cookie{
+		Name:   assignmentCookieName,
+		Value:  encodeAssignments(a.config.StickyAssignments.Secret, assignments),
+		MaxAge: int(a.ruleEngine.assignmentMaxAge / time.Second),
+	})
+}
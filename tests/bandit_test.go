@@ -0,0 +1,190 @@
+package tests
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+var banditStart = time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC)
+
+// banditConfig returns a configuration with a rule on /headline for each
+// backend, all with the bandit.
+func banditConfig(t *testing.T, bandit config.Bandit, backends ...string) *config.Config {
+	t.Helper()
+	defaultServer := createMockServer("Default Backend")
+	t.Cleanup(defaultServer.Close)
+	cfg := &config.Config{
+		DefaultBackend:    defaultServer.URL,
+		StickyAssignments: config.StickyAssignments{Secret: "secret"},
+	}
+	for _, backend := range backends {
+		cfg.Rules = append(cfg.Rules, config.RoutingRule{Path: "/headline", Backend: backend, Bandit: bandit})
+	}
+	return cfg
+}
+
+// banditShare returns the percentage of 2000 new sessions routed to backend.
+func banditShare(handler *forklift.Forklift, backend string) float64 {
+	var n int
+	for i := 1000; i < 3000; i++ {
+		if handler.SelectBackend(httptest.NewRequest("GET", "/headline", nil), canarySession(i)).Backend == backend {
+			n++
+		}
+	}
+	return float64(n) / 20
+}
+
+func TestBanditStatusReward(t *testing.T) {
+	goodServer := createMockServer("Good Backend")
+	defer goodServer.Close()
+	badServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("Bad Backend"))
+	}))
+	defer badServer.Close()
+
+	bandit := config.Bandit{Strategy: "epsilonGreedy", Reward: "status", UpdateInterval: "1s"}
+	handler := newForklift(t, banditConfig(t, bandit, goodServer.URL, badServer.URL), banditStart)
+	if share := banditShare(handler, badServer.URL); math.Abs(share-50) > 4 {
+		t.Errorf("Expected an even split before any reward, got %.1f%% on the bad backend", share)
+	}
+
+	// A session on the bad backend keeps it once the weights shift.
+	session := canarySession(0)
+	for i := 1; handler.SelectBackend(httptest.NewRequest("GET", "/headline", nil), session).Backend != badServer.URL; i++ {
+		session = canarySession(i)
+	}
+	assigned := responseCookie(serveSession(t, handler, "/headline", session), assignmentCookie)
+	if assigned == nil {
+		t.Fatal("Expected an assignment cookie")
+	}
+
+	serveSessions(t, handler, "/headline", 200)
+	handler.SetClock(func() time.Time { return banditStart.Add(2 * time.Second) })
+	if share := banditShare(handler, badServer.URL); math.Abs(share-5) > 2 {
+		t.Errorf("Expected the bad backend to keep epsilon/2 = 5%%, got %.1f%%", share)
+	}
+	rr := serveSession(t, handler, "/headline", session, assigned)
+	if body := strings.TrimSpace(rr.Body.String()); body != "Bad Backend" {
+		t.Errorf("Expected the assigned session to stay on its backend, got %q", body)
+	}
+}
+
+func TestBanditHeaderReward(t *testing.T) {
+	rewarded := func(reward, body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("X-Reward", reward)
+			_, _ = w.Write([]byte(body))
+		}))
+	}
+	losingServer := rewarded("0", "Losing Backend")
+	defer losingServer.Close()
+	winningServer := rewarded("1", "Winning Backend")
+	defer winningServer.Close()
+
+	bandit := config.Bandit{Strategy: "thompson", Reward: "header:X-Reward", MaxWeight: 80, UpdateInterval: "1s"}
+	handler := newForklift(t, banditConfig(t, bandit, losingServer.URL, winningServer.URL), banditStart)
+	rr := serveSession(t, handler, "/headline", canarySession(0))
+	if rr.Header().Get("X-Reward") != "" {
+		t.Error("Expected the reward header to be removed from the response")
+	}
+
+	serveSessions(t, handler, "/headline", 200)
+	handler.SetClock(func() time.Time { return banditStart.Add(2 * time.Second) })
+	if share := banditShare(handler, winningServer.URL); math.Abs(share-80) > 3 {
+		t.Errorf("Expected the winning backend to be capped at 80%%, got %.1f%%", share)
+	}
+}
+
+func TestBanditConversionReward(t *testing.T) {
+	aServer := createMockServer("Headline A")
+	defer aServer.Close()
+	bServer := createMockServer("Headline B")
+	defer bServer.Close()
+
+	bandit := config.Bandit{Strategy: "epsilonGreedy", Epsilon: 20, Reward: "conversion:/signup", UpdateInterval: "1s"}
+	handler := newForklift(t, banditConfig(t, bandit, aServer.URL, bServer.URL), banditStart)
+
+	// Every session shown headline B signs up, twice; nobody shown A does.
+	for i := 0; i < 200; i++ {
+		session := canarySession(i)
+		rr := serveSession(t, handler, "/headline", session)
+		assigned := responseCookie(rr, assignmentCookie)
+		if strings.TrimSpace(rr.Body.String()) != "Headline B" {
+			continue
+		}
+		rr = serveSession(t, handler, "/signup", session, assigned)
+		if converted := responseCookie(rr, assignmentCookie); converted != nil {
+			serveSession(t, handler, "/signup", session, converted)
+		} else {
+			t.Fatal("Expected the conversion to be recorded in the assignment cookie")
+		}
+	}
+
+	handler.SetClock(func() time.Time { return banditStart.Add(2 * time.Second) })
+	if share := banditShare(handler, bServer.URL); math.Abs(share-90) > 3 {
+		t.Errorf("Expected the converting headline to get 90%%, got %.1f%%", share)
+	}
+}
+
+func TestBanditValidation(t *testing.T) {
+	valid := config.Bandit{Strategy: "thompson", Reward: "status"}
+	tests := []struct {
+		name   string
+		secret string
+		rules  []config.RoutingRule
+	}{
+		{name: "unknown strategy", secret: "s", rules: []config.RoutingRule{
+			{Path: "/h", Backend: "http://a", Bandit: config.Bandit{Strategy: "ucb", Reward: "status"}},
+			{Path: "/h", Backend: "http://b", Bandit: config.Bandit{Strategy: "ucb", Reward: "status"}},
+		}},
+		{name: "unknown reward", secret: "s", rules: []config.RoutingRule{
+			{Path: "/h", Backend: "http://a", Bandit: config.Bandit{Strategy: "thompson", Reward: "clicks"}},
+			{Path: "/h", Backend: "http://b", Bandit: config.Bandit{Strategy: "thompson", Reward: "clicks"}},
+		}},
+		{name: "invalid update interval", secret: "s", rules: []config.RoutingRule{
+			{Path: "/h", Backend: "http://a", Bandit: config.Bandit{Strategy: "thompson", Reward: "status", UpdateInterval: "often"}},
+			{Path: "/h", Backend: "http://b", Bandit: config.Bandit{Strategy: "thompson", Reward: "status", UpdateInterval: "often"}},
+		}},
+		{name: "no secret", rules: []config.RoutingRule{
+			{Path: "/h", Backend: "http://a", Bandit: valid},
+			{Path: "/h", Backend: "http://b", Bandit: valid},
+		}},
+		{name: "percentage and bandit", secret: "s", rules: []config.RoutingRule{
+			{Path: "/h", Backend: "http://a", Percentage: 50, Bandit: valid},
+			{Path: "/h", Backend: "http://b", Bandit: valid},
+		}},
+		{name: "single backend", secret: "s", rules: []config.RoutingRule{
+			{Path: "/h", Backend: "http://a", Bandit: valid},
+		}},
+		{name: "mixed with a percentage rule", secret: "s", rules: []config.RoutingRule{
+			{Path: "/h", Backend: "http://a", Bandit: valid},
+			{Path: "/h", Backend: "http://b", Bandit: valid},
+			{Path: "/h", Backend: "http://c", Percentage: 10},
+		}},
+		{name: "unreachable minWeight", secret: "s", rules: []config.RoutingRule{
+			{Path: "/h", Backend: "http://a", Bandit: config.Bandit{Strategy: "thompson", Reward: "status", MinWeight: 60}},
+			{Path: "/h", Backend: "http://b", Bandit: config.Bandit{Strategy: "thompson", Reward: "status", MinWeight: 60}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend:    "http://default",
+				StickyAssignments: config.StickyAssignments{Secret: tt.secret},
+				Rules:             tt.rules,
+			}
+			if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
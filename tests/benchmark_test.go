@@ -0,0 +1,68 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// benchmarkRules generates n rules mixing exact paths, prefixes, path patterns,
+// methods, conditions and percentage splits.
+func benchmarkRules(n int) []config.RoutingRule {
+	rules := make([]config.RoutingRule, 0, n)
+	for i := 0; len(rules) < n; i++ {
+		switch i % 4 {
+		case 0:
+			rules = append(rules, config.RoutingRule{
+				Path: fmt.Sprintf("/api/v1/resource%d", i), Method: "GET", Backend: "http://exact", Priority: i % 10,
+			})
+		case 1:
+			rules = append(rules, config.RoutingRule{
+				PathPrefix: fmt.Sprintf("/service%d/", i), Backend: "http://prefix",
+				Conditions: []config.RuleCondition{{Type: "header", Parameter: "X-Tier", Operator: "eq", Value: "gold"}},
+			})
+		case 2:
+			rules = append(rules, config.RoutingRule{
+				PathPattern: fmt.Sprintf("/tenants/{tenant}/app%d/*", i), Backend: "http://pattern",
+			})
+		default:
+			rules = append(rules,
+				config.RoutingRule{Path: fmt.Sprintf("/split%d", i), Backend: "http://split-a", Percentage: 50},
+				config.RoutingRule{Path: fmt.Sprintf("/split%d", i), Backend: "http://split-b", Percentage: 50},
+			)
+		}
+	}
+	return rules[:n]
+}
+
+func BenchmarkSelectBackend(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		cfg := &config.Config{DefaultBackend: "http://default", Rules: benchmarkRules(n)}
+		handler, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "bench")
+		if err != nil {
+			b.Fatal(err)
+		}
+		requests := []*http.Request{
+			httptest.NewRequest(http.MethodGet, "/api/v1/resource4", nil),
+			httptest.NewRequest(http.MethodGet, "/service5/orders", nil),
+			httptest.NewRequest(http.MethodGet, "/tenants/acme/app6/settings", nil),
+			httptest.NewRequest(http.MethodGet, "/split7", nil),
+			httptest.NewRequest(http.MethodGet, "/unknown", nil),
+		}
+		requests[1].Header.Set("X-Tier", "gold")
+
+		b.Run(fmt.Sprintf("rules=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if selected := handler.SelectBackend(requests[i%len(requests)], "session"); selected.Backend == "" {
+					b.Fatal("No backend selected")
+				}
+			}
+		})
+	}
+}
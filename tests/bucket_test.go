@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestExperimentBucketBy(t *testing.T) {
+	experiment := checkoutExperiment(100)
+	experiment.BucketBy = []string{"header:X-Tenant+header:X-User-ID", "jwt:sub", "cookie:uid", "session"}
+	cfg := &config.Config{
+		DefaultBackend: "http://default",
+		JWT:            config.JWT{Secret: jwtTestSecret},
+		Experiments:    []config.Experiment{experiment},
+	}
+	handler, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	variantOf := func(session string, prepare func(req *http.Request)) string {
+		req := httptest.NewRequest("GET", "/checkout", nil)
+		prepare(req)
+		return handler.SelectBackend(req, session).Variant
+	}
+
+	variants := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		token := signJWT(t, "HS256", "", map[string]interface{}{"sub": user}, hs256(jwtTestSecret))
+		byCookie := variantOf("device-a", func(req *http.Request) { req.AddCookie(&http.Cookie{Name: "uid", Value: user}) })
+		byJWT := variantOf("device-b", func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) })
+		if byCookie != byJWT {
+			t.Fatalf("%s: expected the same variant on both devices, got %s and %s", user, byCookie, byJWT)
+		}
+		variants[byCookie] = true
+
+		composite := func(req *http.Request) {
+			req.Header.Set("X-Tenant", "acme")
+			req.Header.Set("X-User-ID", user)
+		}
+		if a, b := variantOf("device-a", composite), variantOf("device-b", composite); a != b {
+			t.Fatalf("%s: expected the composite key to ignore the session, got %s and %s", user, a, b)
+		}
+	}
+	if len(variants) != 2 {
+		t.Errorf("Expected users in both variants, got %v", variants)
+	}
+
+	// Without any user key, the session is used.
+	for i := 0; i < 50; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		partial := func(req *http.Request) { req.Header.Set("X-User-ID", "user-1") }
+		if a, b := variantOf(session, partial), variantOf(session, func(*http.Request) {}); a != b {
+			t.Fatalf("%s: expected an incomplete composite key to fall back to the session, got %s and %s", session, a, b)
+		}
+	}
+}
+
+func TestRuleBucketBy(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://default",
+		Rules: []config.RoutingRule{
+			{PathPattern: "/tenants/{tenant}/reports", Backend: "http://v1", Percentage: 50, BucketBy: []string{"param:tenant"}},
+			{PathPattern: "/tenants/{tenant}/reports", Backend: "http://v2", Percentage: 50, BucketBy: []string{"param:tenant"}},
+			{PathPrefix: "/api/", Backend: "http://api-v2", Percentage: 100, BucketBy: []string{"header:X-User-ID"}},
+		},
+	}
+	handler, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backends := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/tenants/t%d/reports", i), nil)
+		first := handler.SelectBackend(req, "session-a").Backend
+		if second := handler.SelectBackend(req, "session-b").Backend; first != second {
+			t.Fatalf("Tenant t%d: expected every session on the same backend, got %s and %s", i, first, second)
+		}
+		backends[first] = true
+	}
+	if !backends["http://v1"] || !backends["http://v2"] {
+		t.Errorf("Expected tenants on both backends, got %v", backends)
+	}
+
+	req := httptest.NewRequest("GET", "/api/items", nil)
+	if got := handler.SelectBackend(req, "session-a").Backend; got != "http://default" {
+		t.Errorf("Expected requests without a bucketing key to skip the split, got %s", got)
+	}
+	req.Header.Set("X-User-ID", "42")
+	if got := handler.SelectBackend(req, "session-a").Backend; got != "http://api-v2" {
+		t.Errorf("Expected the split to apply with a bucketing key, got %s", got)
+	}
+}
+
+func TestBucketByValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		bucketBy []string
+	}{
+		{name: "unknown source", bucketBy: []string{"device:id"}},
+		{name: "header without name", bucketBy: []string{"header:"}},
+		{name: "ip with name", bucketBy: []string{"ip:v4"}},
+		{name: "jwt without verifier", bucketBy: []string{"jwt:sub"}},
+		{name: "invalid composite", bucketBy: []string{"header:X-Tenant+"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://default",
+				Rules:          []config.RoutingRule{{Path: "/", Backend: "http://v2", Percentage: 50, BucketBy: tt.bucketBy}},
+			}
+			if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+				t.Error("Expected an error for an invalid rule bucketBy")
+			}
+			experiment := checkoutExperiment(100)
+			experiment.BucketBy = tt.bucketBy
+			cfg = &config.Config{DefaultBackend: "http://default", Experiments: []config.Experiment{experiment}}
+			if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+				t.Error("Expected an error for an invalid experiment bucketBy")
+			}
+		})
+	}
+}
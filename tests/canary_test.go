@@ -0,0 +1,311 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+var canaryStart = time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC)
+
+// canaryName returns a middleware name no other test run uses. Rollbacks are
+// remembered per middleware name for the lifetime of the process.
+func canaryName(t *testing.T) string {
+	return fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+}
+
+// canarySession returns the i-th session ID. ServeHTTP only accepts base64
+// session cookies.
+func canarySession(i int) string {
+	return base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("session-%d", i)))
+}
+
+// serveSession sends a request to path in the session, with extra cookies.
+func serveSession(t *testing.T, handler http.Handler, path, session string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	req := createTestRequest(t, "GET", path, nil, nil)
+	req.AddCookie(&http.Cookie{Name: "forklift_id", Value: session})
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+// serveSessions sends a request to path for each of n sessions.
+func serveSessions(t *testing.T, handler http.Handler, path string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		serveSession(t, handler, path, canarySession(i))
+	}
+}
+
+// backendsOf returns the backends 200 sessions are routed to.
+func backendsOf(handler *forklift.Forklift, path string) map[string]bool {
+	backends := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		backends[handler.SelectBackend(httptest.NewRequest("GET", path, nil), canarySession(i)).Backend] = true
+	}
+	return backends
+}
+
+func TestRuleCanaryRollback(t *testing.T) {
+	stableServer := createMockServer("Stable Backend")
+	defer stableServer.Close()
+	healthyServer := createMockServer("Healthy Backend")
+	defer healthyServer.Close()
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failingServer.Close()
+	alerts := make(chan map[string]interface{}, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&alert)
+		alerts <- alert
+	}))
+	defer webhook.Close()
+
+	canary := config.Canary{Window: "1m", MinRequests: 20, MaxErrorRateIncrease: 5, Webhook: webhook.URL}
+	cfg := &config.Config{
+		DefaultBackend: stableServer.URL,
+		Rules: []config.RoutingRule{
+			{Path: "/search", Backend: failingServer.URL, Percentage: 50, Canary: canary},
+			{Path: "/healthy", Backend: healthyServer.URL, Percentage: 50, Canary: canary},
+		},
+	}
+	name := canaryName(t)
+	handler := newNamedForklift(t, name, cfg, canaryStart)
+
+	serveSessions(t, handler, "/search", 100)
+	serveSessions(t, handler, "/healthy", 100)
+	if backends := backendsOf(handler, "/search"); !backends[failingServer.URL] {
+		t.Fatal("Expected the canary to keep its share until it is checked")
+	}
+
+	// Canaries are checked at most once a second.
+	handler.SetClock(func() time.Time { return canaryStart.Add(2 * time.Second) })
+	serveSessions(t, handler, "/search", 1)
+	serveSessions(t, handler, "/healthy", 1)
+	if backends := backendsOf(handler, "/search"); backends[failingServer.URL] || !backends[stableServer.URL] {
+		t.Errorf("Expected the failing canary to be rolled back, got %v", backends)
+	}
+	if backends := backendsOf(handler, "/healthy"); !backends[healthyServer.URL] {
+		t.Errorf("Expected the healthy canary to keep its share, got %v", backends)
+	}
+
+	select {
+	case alert := <-alerts:
+		if alert["backend"] != failingServer.URL || alert["rule"] != "/search" || alert["middleware"] != name {
+			t.Errorf("Unexpected alert %v", alert)
+		}
+		if alert["errorRate"] != 100.0 || alert["controlErrorRate"] != 0.0 {
+			t.Errorf("Expected error rates of 100 and 0, got %v", alert)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected a webhook alert")
+	}
+
+	// The rollback survives a reload until resetAt re-enables the canary.
+	handler = newNamedForklift(t, name, cfg, canaryStart)
+	if backends := backendsOf(handler, "/search"); backends[failingServer.URL] {
+		t.Error("Expected the rollback to survive a reload")
+	}
+	if backends := backendsOf(handler, "/healthy"); !backends[healthyServer.URL] {
+		t.Error("Expected the healthy canary to survive a reload")
+	}
+	cfg.Rules[0].Canary.ResetAt = canaryStart.Add(time.Hour).Format(time.RFC3339)
+	handler = newNamedForklift(t, name, cfg, canaryStart)
+	if backends := backendsOf(handler, "/search"); !backends[failingServer.URL] {
+		t.Error("Expected resetAt to re-enable the canary")
+	}
+}
+
+func TestRuleCanaryControlIsSameSplit(t *testing.T) {
+	// The search service is down for everyone, while other pages are fine.
+	stableServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/search" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer stableServer.Close()
+	canaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer canaryServer.Close()
+
+	handler := newNamedForklift(t, canaryName(t), &config.Config{
+		DefaultBackend: stableServer.URL,
+		Rules: []config.RoutingRule{{
+			Path: "/search", Backend: canaryServer.URL, Percentage: 50,
+			Canary: config.Canary{Window: "1m", MinRequests: 20, MaxErrorRateIncrease: 5},
+		}},
+	}, canaryStart)
+
+	serveSessions(t, handler, "/search", 100)
+	serveSessions(t, handler, "/static/app.js", 300)
+	handler.SetClock(func() time.Time { return canaryStart.Add(2 * time.Second) })
+	serveSessions(t, handler, "/search", 1)
+
+	// Compared with the default backend's /search responses only, the canary
+	// is no worse.
+	if backends := backendsOf(handler, "/search"); !backends[canaryServer.URL] {
+		t.Errorf("Expected the canary to keep its share, got %v", backends)
+	}
+}
+
+func TestCanaryStateFile(t *testing.T) {
+	stableServer := createMockServer("Stable Backend")
+	defer stableServer.Close()
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failingServer.Close()
+
+	dir := t.TempDir()
+	cfg := &config.Config{
+		DefaultBackend:  stableServer.URL,
+		CanaryStateFile: filepath.Join(dir, "canaries.json"),
+		Rules: []config.RoutingRule{{
+			Path: "/search", Backend: failingServer.URL, Percentage: 50,
+			Canary: config.Canary{Window: "1m", MinRequests: 20, MaxErrorRateIncrease: 5},
+		}},
+	}
+	name := canaryName(t)
+	handler := newNamedForklift(t, name, cfg, canaryStart)
+	serveSessions(t, handler, "/search", 100)
+	handler.SetClock(func() time.Time { return canaryStart.Add(2 * time.Second) })
+	serveSessions(t, handler, "/search", 1)
+	if backends := backendsOf(handler, "/search"); backends[failingServer.URL] {
+		t.Fatal("Expected the failing canary to be rolled back")
+	}
+
+	// A restarted process only knows about the rollback from the file. A new
+	// middleware name stands in for the restart, as rollbacks are also kept in
+	// memory for the lifetime of the process.
+	state, err := os.ReadFile(cfg.CanaryStateFile)
+	if err != nil {
+		t.Fatalf("Expected the rollback to be saved: %v", err)
+	}
+	restarted := canaryName(t)
+	cfg.CanaryStateFile = filepath.Join(dir, "restarted.json")
+	if err := os.WriteFile(cfg.CanaryStateFile, []byte(strings.ReplaceAll(string(state), name, restarted)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if backends := backendsOf(newNamedForklift(t, restarted, cfg, canaryStart), "/search"); backends[failingServer.URL] {
+		t.Error("Expected the rollback to survive a restart")
+	}
+
+	// A state file that can't be read fails closed.
+	cfg.CanaryStateFile = filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(cfg.CanaryStateFile, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, canaryName(t)); err == nil {
+		t.Error("Expected an error for a corrupt state file")
+	}
+}
+
+func TestExperimentCanaryLatency(t *testing.T) {
+	controlServer := createMockServer("Control Backend")
+	defer controlServer.Close()
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer slowServer.Close()
+
+	cfg := &config.Config{
+		DefaultBackend:    "http://default",
+		StickyAssignments: config.StickyAssignments{Secret: "secret"},
+		Experiments: []config.Experiment{{
+			Name:       "search",
+			Allocation: 100,
+			Variants: []config.ExperimentVariant{
+				{Name: "control", Backend: controlServer.URL, Weight: 50},
+				{Name: "treatment", Backend: slowServer.URL, Weight: 50},
+			},
+			Routes: []config.ExperimentRoute{{Path: "/search"}},
+			Canary: config.Canary{MinRequests: 20, MaxLatencyIncrease: 50},
+		}},
+	}
+	name := canaryName(t)
+	handler := newNamedForklift(t, name, cfg, canaryStart)
+
+	// Remember the sticky assignment of a user in treatment.
+	treated := canarySession(0)
+	for i := 1; handler.SelectBackend(httptest.NewRequest("GET", "/search", nil), treated).Variant != "treatment"; i++ {
+		treated = canarySession(i)
+	}
+	assigned := responseCookie(serveSession(t, handler, "/search", treated), assignmentCookie)
+	if assigned == nil {
+		t.Fatal("Expected an assignment cookie")
+	}
+
+	serveSessions(t, handler, "/search", 100)
+	handler.SetClock(func() time.Time { return canaryStart.Add(2 * time.Second) })
+	serveSessions(t, handler, "/search", 1)
+
+	for i := 0; i < 200; i++ {
+		if got := handler.SelectBackend(httptest.NewRequest("GET", "/search", nil), canarySession(i)); got.Variant != "control" {
+			t.Fatalf("Expected every session on control after the rollback, got %q", got.Variant)
+		}
+	}
+	rr := serveSession(t, handler, "/search", treated, assigned)
+	if body := strings.TrimSpace(rr.Body.String()); body != "Control Backend" || responseCookie(rr, assignmentCookie) == nil {
+		t.Errorf("Expected users assigned to the rolled back variant to be reassigned, got %q", body)
+	}
+
+	restored := newNamedForklift(t, name, cfg, canaryStart)
+	if got := restored.SelectBackend(httptest.NewRequest("GET", "/search", nil), treated); got.Variant != "control" {
+		t.Errorf("Expected the rollback to survive a reload, got %q", got.Variant)
+	}
+}
+
+func TestCanaryValidation(t *testing.T) {
+	canary := config.Canary{MaxErrorRateIncrease: 5}
+	tests := []struct {
+		name       string
+		rule       config.RoutingRule
+		experiment *config.Experiment
+	}{
+		{name: "rule without percentage", rule: config.RoutingRule{Canary: canary}},
+		{name: "no threshold", rule: config.RoutingRule{Percentage: 10, Canary: config.Canary{MinRequests: 10}}},
+		{name: "negative threshold", rule: config.RoutingRule{Percentage: 10, Canary: config.Canary{MaxLatencyIncrease: -1}}},
+		{name: "invalid window", rule: config.RoutingRule{Percentage: 10, Canary: config.Canary{Window: "soon", MaxErrorRateIncrease: 5}}},
+		{name: "invalid resetAt", rule: config.RoutingRule{Percentage: 10, Canary: config.Canary{ResetAt: "now", MaxErrorRateIncrease: 5}}},
+		{name: "control is the canary", rule: config.RoutingRule{Percentage: 10, Canary: config.Canary{Control: "http://v2", MaxErrorRateIncrease: 5}}},
+		{name: "unknown control variant", experiment: &config.Experiment{
+			Name: "search", Allocation: 100,
+			Variants: []config.ExperimentVariant{{Name: "a", Backend: "http://a", Weight: 1}, {Name: "b", Backend: "http://b", Weight: 1}},
+			Routes:   []config.ExperimentRoute{{Path: "/search"}},
+			Canary:   config.Canary{Control: "c", MaxErrorRateIncrease: 5},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://v1"}
+			if tt.experiment != nil {
+				cfg.Experiments = []config.Experiment{*tt.experiment}
+			} else {
+				tt.rule.Path, tt.rule.Backend = "/", "http://v2"
+				cfg.Rules = []config.RoutingRule{tt.rule}
+			}
+			if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "canary-validation"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
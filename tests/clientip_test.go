@@ -0,0 +1,102 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestTrustedProxyClientIP(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	officeServer := createMockServer("Office Backend")
+	defer officeServer.Close()
+
+	newMiddleware := func(clientIP config.ClientIP) http.Handler {
+		return createMiddleware(t, &config.Config{
+			DefaultBackend: defaultServer.URL,
+			ClientIP:       clientIP,
+			Rules: []config.RoutingRule{{
+				PathPrefix: "/",
+				Backend:    officeServer.URL,
+				Conditions: []config.RuleCondition{{Type: "ip", Operator: "in", Value: "10.0.0.0/8"}},
+			}},
+		})
+	}
+
+	xff := newMiddleware(config.ClientIP{TrustedProxies: []string{"192.168.0.0/16"}})
+	xffDepth := newMiddleware(config.ClientIP{TrustedProxies: []string{"192.168.0.0/16"}, Depth: 1})
+	realIP := newMiddleware(config.ClientIP{Header: "X-Real-IP", TrustedProxies: []string{"192.168.0.1"}})
+	forwarded := newMiddleware(config.ClientIP{Header: "Forwarded", TrustedProxies: []string{"192.168.0.0/16"}})
+
+	tests := []struct {
+		name       string
+		middleware http.Handler
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{
+			name: "client behind trusted proxy", middleware: xff, remoteAddr: "192.168.1.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "10.1.1.1"}, expected: "Office Backend",
+		},
+		{
+			name: "header from untrusted peer is ignored", middleware: xff, remoteAddr: "198.51.100.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "10.1.1.1"}, expected: "Default Backend",
+		},
+		{
+			name: "spoofed entry left of an untrusted hop is ignored", middleware: xff, remoteAddr: "192.168.1.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "10.1.1.1, 198.51.100.7"}, expected: "Default Backend",
+		},
+		{
+			name: "chain of trusted proxies is walked", middleware: xff, remoteAddr: "192.168.1.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "10.1.1.1, 192.168.2.2"}, expected: "Office Backend",
+		},
+		{
+			name: "depth limits the walk", middleware: xffDepth, remoteAddr: "192.168.1.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "10.1.1.1, 192.168.2.2"}, expected: "Default Backend",
+		},
+		{
+			name: "X-Real-IP from trusted proxy", middleware: realIP, remoteAddr: "192.168.0.1:1234",
+			headers: map[string]string{"X-Real-IP": "10.2.2.2"}, expected: "Office Backend",
+		},
+		{
+			name: "X-Real-IP from untrusted peer", middleware: realIP, remoteAddr: "192.168.0.2:1234",
+			headers: map[string]string{"X-Real-IP": "10.2.2.2"}, expected: "Default Backend",
+		},
+		{
+			name: "Forwarded header", middleware: forwarded, remoteAddr: "192.168.1.1:1234",
+			headers: map[string]string{"Forwarded": `for=198.51.100.3, for="10.3.3.3:4711";proto=https`}, expected: "Office Backend",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := createTestRequest(t, "GET", "/", tt.headers, nil)
+			req.RemoteAddr = tt.remoteAddr
+			rr := httptest.NewRecorder()
+			tt.middleware.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, body)
+			}
+		})
+	}
+}
+
+func TestInvalidClientIPConfigIsRejected(t *testing.T) {
+	for _, clientIP := range []config.ClientIP{
+		{TrustedProxies: []string{"not-an-ip"}},
+		{Header: "X-Client", TrustedProxies: []string{"10.0.0.1"}},
+	} {
+		cfg := &config.Config{DefaultBackend: "http://localhost", ClientIP: clientIP}
+		if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+			t.Errorf("Expected client IP config %+v to be rejected", clientIP)
+		}
+	}
+}
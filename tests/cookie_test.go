@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestSessionCookie(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+
+	serve := func(cookie config.SessionCookie, clientIP config.ClientIP, headers map[string]string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		handler := createMiddleware(t, &config.Config{DefaultBackend: defaultServer.URL, SessionCookie: cookie, ClientIP: clientIP})
+		req := createTestRequest(t, "GET", "/", headers, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name     string
+		cookie   config.SessionCookie
+		clientIP config.ClientIP
+		headers  map[string]string
+		want     []string
+		notWant  []string
+	}{
+		{
+			name:    "defaults",
+			want:    []string{"forklift_id=", "Path=/", "Max-Age=2592000", "HttpOnly", "SameSite=Strict"},
+			notWant: []string{"Secure", "Domain=", "Partitioned"},
+		},
+		{
+			name:     "auto secure behind a TLS proxy",
+			clientIP: config.ClientIP{TrustedProxies: []string{"192.0.2.0/24"}},
+			headers:  map[string]string{"X-Forwarded-Proto": "https, http"},
+			want:     []string{"forklift_id=", "Secure"},
+		},
+		{
+			name:    "forwarded proto without trusted proxies",
+			headers: map[string]string{"X-Forwarded-Proto": "https"},
+			notWant: []string{"Secure"},
+		},
+		{
+			name:     "forwarded proto from an untrusted peer",
+			clientIP: config.ClientIP{TrustedProxies: []string{"10.0.0.0/8"}},
+			headers:  map[string]string{"X-Forwarded-Proto": "https"},
+			notWant:  []string{"Secure"},
+		},
+		{
+			name: "custom attributes",
+			cookie: config.SessionCookie{
+				Name: "ab_session", Domain: ".example.com", Path: "/shop", MaxAge: "2h",
+				SameSite: "none", Secure: "always", Partitioned: true,
+			},
+			want: []string{"ab_session=", "Domain=example.com", "Path=/shop", "Max-Age=7200", "SameSite=None", "Secure", "Partitioned"},
+		},
+		{
+			name:   "sameSite none defaults to secure",
+			cookie: config.SessionCookie{SameSite: "none"},
+			want:   []string{"SameSite=None", "Secure"},
+		},
+		{
+			name:    "never secure",
+			cookie:  config.SessionCookie{Secure: "never", SameSite: "lax"},
+			headers: map[string]string{"X-Forwarded-Proto": "https"},
+			want:    []string{"SameSite=Lax"},
+			notWant: []string{"Secure"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := serve(tt.cookie, tt.clientIP, tt.headers).Header().Get("Set-Cookie")
+			for _, want := range tt.want {
+				if !strings.Contains(header, want) {
+					t.Errorf("Expected %q in %q", want, header)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(header, notWant) {
+					t.Errorf("Expected no %q in %q", notWant, header)
+				}
+			}
+		})
+	}
+
+	// An existing session cookie under the configured name is reused.
+	rr := serve(config.SessionCookie{Name: "ab_session"}, config.ClientIP{}, nil, &http.Cookie{Name: "ab_session", Value: "c2Vzc2lvbi0x"})
+	if header := rr.Header().Get("Set-Cookie"); header != "" {
+		t.Errorf("Expected the session cookie to be reused, got %q", header)
+	}
+	rr = serve(config.SessionCookie{Name: "ab_session"}, config.ClientIP{}, nil, &http.Cookie{Name: "forklift_id", Value: "c2Vzc2lvbi0x"})
+	if responseCookie(rr, "ab_session") == nil {
+		t.Error("Expected a new ab_session cookie when only forklift_id is sent")
+	}
+}
+
+func TestSessionCookieValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie config.SessionCookie
+	}{
+		{name: "invalid name", cookie: config.SessionCookie{Name: "ab session"}},
+		{name: "assignment cookie name", cookie: config.SessionCookie{Name: "forklift_assignments"}},
+		{name: "invalid domain", cookie: config.SessionCookie{Domain: "example..com"}},
+		{name: "relative path", cookie: config.SessionCookie{Path: "shop"}},
+		{name: "invalid maxAge", cookie: config.SessionCookie{MaxAge: "500ms"}},
+		{name: "invalid sameSite", cookie: config.SessionCookie{SameSite: "sometimes"}},
+		{name: "invalid secure", cookie: config.SessionCookie{Secure: "yes"}},
+		{name: "sameSite none without secure", cookie: config.SessionCookie{SameSite: "none", Secure: "never"}},
+		{name: "partitioned without secure", cookie: config.SessionCookie{Partitioned: true, Secure: "never"}},
+		{name: "sameSite none with auto secure", cookie: config.SessionCookie{SameSite: "none", Secure: "auto"}},
+		{name: "partitioned with auto secure", cookie: config.SessionCookie{Partitioned: true, Secure: "auto"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://default", SessionCookie: tt.cookie}
+			if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
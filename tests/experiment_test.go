@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func checkoutExperiment(allocation float64) config.Experiment {
+	return config.Experiment{
+		Name:       "checkout-redesign",
+		Salt:       "2024-q3",
+		Allocation: allocation,
+		Variants: []config.ExperimentVariant{
+			{Name: "control", Backend: "http://checkout-v1", Weight: 50},
+			{Name: "treatment", Backend: "http://checkout-v2", Weight: 50},
+		},
+		Routes: []config.ExperimentRoute{
+			{Path: "/checkout"},
+			{PathPrefix: "/cart/", Method: "GET"},
+			{PathPattern: "/orders/{id}"},
+		},
+	}
+}
+
+func newExperimentForklift(t *testing.T, experiments ...config.Experiment) *forklift.Forklift {
+	t.Helper()
+	cfg := &config.Config{
+		DefaultBackend: "http://default",
+		Rules:          []config.RoutingRule{{PathPrefix: "/", Backend: "http://rules"}},
+		Experiments:    experiments,
+	}
+	handler, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+func TestExperimentAssignmentIsConsistentAcrossRoutes(t *testing.T) {
+	handler := newExperimentForklift(t, checkoutExperiment(100))
+
+	counts := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		first := handler.SelectBackend(httptest.NewRequest("POST", "/checkout", nil), session)
+		if first.Experiment != "checkout-redesign" || first.Variant == "" {
+			t.Fatalf("Expected an experiment assignment, got %+v", first)
+		}
+		counts[first.Variant]++
+		for _, req := range []*http.Request{
+			httptest.NewRequest("GET", "/cart/items", nil),
+			httptest.NewRequest("DELETE", "/orders/42", nil),
+			httptest.NewRequest("POST", "/checkout", nil),
+		} {
+			if got := handler.SelectBackend(req, session); got.Variant != first.Variant || got.Backend != first.Backend {
+				t.Fatalf("%s %s: expected variant %s, got %+v", req.Method, req.URL.Path, first.Variant, got)
+			}
+		}
+	}
+	for _, variant := range []string{"control", "treatment"} {
+		if counts[variant] < 900 || counts[variant] > 1100 {
+			t.Errorf("Expected about 1000 sessions in %s, got %d", variant, counts[variant])
+		}
+	}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/cart/items", nil),
+		httptest.NewRequest("GET", "/account", nil),
+	} {
+		if got := handler.SelectBackend(req, "session-1"); got.Experiment != "" || got.Backend != "http://rules" {
+			t.Errorf("%s %s: expected the rules to route uncovered requests, got %+v", req.Method, req.URL.Path, got)
+		}
+	}
+}
+
+func TestExperimentAllocation(t *testing.T) {
+	small := newExperimentForklift(t, checkoutExperiment(20))
+	large := newExperimentForklift(t, checkoutExperiment(60))
+	none := newExperimentForklift(t, checkoutExperiment(0))
+
+	var enrolledSmall, enrolledLarge int
+	for i := 0; i < 2000; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		req := httptest.NewRequest("GET", "/checkout", nil)
+		s := small.SelectBackend(req, session)
+		l := large.SelectBackend(req, session)
+		if s.Experiment != "" {
+			enrolledSmall++
+			if s.Variant != l.Variant {
+				t.Fatalf("Raising the allocation moved %s from %s to %q", session, s.Variant, l.Variant)
+			}
+		} else if s.Backend != "http://rules" {
+			t.Fatalf("Expected sessions outside the allocation to follow the rules, got %+v", s)
+		}
+		if l.Experiment != "" {
+			enrolledLarge++
+		}
+		if n := none.SelectBackend(req, session); n.Experiment != "" {
+			t.Fatalf("Expected no enrollment with allocation 0, got %+v", n)
+		}
+	}
+	if enrolledSmall < 320 || enrolledSmall > 480 {
+		t.Errorf("Expected about 400 sessions enrolled at 20%%, got %d", enrolledSmall)
+	}
+	if enrolledLarge < 1080 || enrolledLarge > 1320 {
+		t.Errorf("Expected about 1200 sessions enrolled at 60%%, got %d", enrolledLarge)
+	}
+}
+
+func TestExperimentValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(e *config.Experiment)
+	}{
+		{name: "missing name", modify: func(e *config.Experiment) { e.Name = "" }},
+		{name: "allocation above 100", modify: func(e *config.Experiment) { e.Allocation = 120 }},
+		{name: "no variants", modify: func(e *config.Experiment) { e.Variants = nil }},
+		{name: "no routes", modify: func(e *config.Experiment) { e.Routes = nil }},
+		{name: "route without path", modify: func(e *config.Experiment) { e.Routes = []config.ExperimentRoute{{Method: "GET"}} }},
+		{name: "duplicate variant", modify: func(e *config.Experiment) { e.Variants[1].Name = "control" }},
+		{name: "variant without backend", modify: func(e *config.Experiment) { e.Variants[0].Backend = "" }},
+		{name: "negative weight", modify: func(e *config.Experiment) { e.Variants[0].Weight = -1 }},
+		{name: "zero weights", modify: func(e *config.Experiment) { e.Variants[0].Weight, e.Variants[1].Weight = 0, 0 }},
+		{name: "invalid path pattern", modify: func(e *config.Experiment) { e.Routes = []config.ExperimentRoute{{PathPattern: "/orders/{id"}} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := checkoutExperiment(100)
+			tt.modify(&e)
+			cfg := &config.Config{DefaultBackend: "http://default", Experiments: []config.Experiment{e}}
+			if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+
+	cfg := &config.Config{DefaultBackend: "http://default", Experiments: []config.Experiment{checkoutExperiment(100), checkoutExperiment(50)}}
+	if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Error("Expected an error for duplicate experiment names")
+	}
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestExpressionRules(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	canaryServer := createMockServer("Canary Backend")
+	defer canaryServer.Close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL,
+		Rules: []config.RoutingRule{
+			{
+				PathPrefix: "/shop",
+				Backend:    canaryServer.URL,
+				Expr:       `(header("X-Beta") == "1" || cookie("segment") == "beta") && !(query("legacy") == "true")`,
+			},
+			{
+				Path:    "/version",
+				Backend: canaryServer.URL,
+				Expr:    `header("X-App-Version") >= 2.5 && method != "DELETE" && matches(path, "^/ver")`,
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		headers  map[string]string
+		cookies  []*http.Cookie
+		expected string
+	}{
+		{name: "header branch of or", method: "GET", path: "/shop", headers: map[string]string{"X-Beta": "1"}, expected: "Canary Backend"},
+		{name: "cookie branch of or", method: "GET", path: "/shop/cart", cookies: []*http.Cookie{{Name: "segment", Value: "beta"}}, expected: "Canary Backend"},
+		{name: "negated query", method: "GET", path: "/shop?legacy=true", headers: map[string]string{"X-Beta": "1"}, expected: "Default Backend"},
+		{name: "neither branch", method: "GET", path: "/shop", expected: "Default Backend"},
+		{name: "numeric comparison", method: "GET", path: "/version", headers: map[string]string{"X-App-Version": "3"}, expected: "Canary Backend"},
+		{name: "numeric comparison below", method: "GET", path: "/version", headers: map[string]string{"X-App-Version": "2.4"}, expected: "Default Backend"},
+		{name: "non-numeric header", method: "GET", path: "/version", headers: map[string]string{"X-App-Version": "beta"}, expected: "Default Backend"},
+		{name: "method excluded", method: "DELETE", path: "/version", headers: map[string]string{"X-App-Version": "3"}, expected: "Default Backend"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := createTestRequest(t, tt.method, tt.path, tt.headers, nil)
+			for _, cookie := range tt.cookies {
+				req.AddCookie(cookie)
+			}
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, body)
+			}
+		})
+	}
+}
+
+func TestInvalidExpressionsAreRejected(t *testing.T) {
+	invalid := []string{
+		`header("X") ==`,
+		`header("X")`,
+		`header("X") && true`,
+		`unknown("X") == "a"`,
+		`header(1) == "a"`,
+		`true == "a"`,
+		`matches(path, "[")`,
+		`matches(path, header("X"))`,
+		`(path == "/"`,
+		`path == "/" extra`,
+	}
+
+	for _, expr := range invalid {
+		t.Run(expr, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost",
+				Rules:          []config.RoutingRule{{Path: "/", Backend: "http://localhost", Expr: expr}},
+			}
+			if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+				t.Errorf("Expected expression %q to be rejected", expr)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift/config"
+)
+
+// multipartBody builds a multipart form with text fields followed by one file.
+func multipartBody(t *testing.T, fields map[string]string, field, filename, contentType string, size int) (*bytes.Buffer, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if field != "" {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name=%q; filename=%q`, field, filename))
+		header.Set("Content-Type", contentType)
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write(bytes.Repeat([]byte("x"), size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf, writer.FormDataContentType()
+}
+
+func TestMultipartFormConditions(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	uploadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "Upload Backend %d", len(body))
+	}))
+	defer uploadServer.Close()
+	proServer := createMockServer("Pro Backend")
+	defer proServer.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL,
+		MaxBodySize:    1024,
+		Rules: []config.RoutingRule{
+			{
+				Path: "/upload", Method: "POST", Backend: uploadServer.URL, Priority: 2,
+				Conditions: []config.RuleCondition{
+					{Type: "form", Parameter: "plan", Operator: "eq", Value: "pro"},
+					{Type: "formFile", Parameter: "avatar.contentType", Operator: "prefix", Value: "image/"},
+				},
+			},
+			{
+				Path: "/upload", Method: "POST", Backend: proServer.URL, Priority: 1,
+				Conditions: []config.RuleCondition{{Type: "form", Parameter: "plan", Operator: "eq", Value: "pro"}},
+			},
+		},
+	})
+
+	tests := []struct {
+		name        string
+		fields      map[string]string
+		file        string
+		filename    string
+		contentType string
+		size        int
+		expected    string
+	}{
+		{
+			name: "text field and image", fields: map[string]string{"plan": "pro"},
+			file: "avatar", filename: "me.png", contentType: "image/png", size: 100,
+		},
+		{
+			name: "upload larger than the limit", fields: map[string]string{"plan": "pro"},
+			file: "avatar", filename: "me.png", contentType: "image/png", size: 4096,
+		},
+		{
+			name: "other content type", fields: map[string]string{"plan": "pro"},
+			file: "avatar", filename: "cv.pdf", contentType: "application/pdf", size: 100, expected: "Pro Backend",
+		},
+		{
+			name: "other file field", fields: map[string]string{"plan": "pro"},
+			file: "banner", filename: "me.png", contentType: "image/png", size: 100, expected: "Pro Backend",
+		},
+		{name: "text fields only", fields: map[string]string{"plan": "pro"}, expected: "Pro Backend"},
+		{name: "no match", fields: map[string]string{"plan": "free"}, expected: "Default Backend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := multipartBody(t, tt.fields, tt.file, tt.filename, tt.contentType, tt.size)
+			expected := tt.expected
+			if expected == "" {
+				expected = fmt.Sprintf("Upload Backend %d", body.Len())
+			}
+			req := createTestRequest(t, "POST", "/upload", map[string]string{"Content-Type": contentType}, nil)
+			req.Body = io.NopCloser(body)
+			req.ContentLength = int64(body.Len())
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if got := strings.TrimSpace(rr.Body.String()); got != expected {
+				t.Errorf("Expected body %q, got %q", expected, got)
+			}
+		})
+	}
+}
+
+func TestFormConditionsOnUnsupportedBodies(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	matchServer := createMockServer("Match Backend")
+	defer matchServer.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL,
+		Rules: []config.RoutingRule{{
+			Path: "/", Backend: matchServer.URL,
+			Conditions: []config.RuleCondition{{Type: "form", Parameter: "plan", Operator: "notin", Value: "free"}},
+		}},
+	})
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		expected    string
+	}{
+		{name: "url-encoded", method: "POST", contentType: "application/x-www-form-urlencoded", body: "plan=pro", expected: "Match Backend"},
+		{name: "malformed url-encoded", method: "POST", contentType: "application/x-www-form-urlencoded", body: "plan=%zz", expected: "Default Backend"},
+		{name: "JSON body", method: "POST", contentType: "application/json", body: `{"plan":"pro"}`, expected: "Default Backend"},
+		{name: "missing boundary", method: "POST", contentType: "multipart/form-data", body: "plan=pro", expected: "Default Backend"},
+		{name: "GET request", method: "GET", expected: "Default Backend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := createTestRequest(t, tt.method, "/", nil, nil)
+			if tt.body != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+				req.Body = io.NopCloser(strings.NewReader(tt.body))
+				req.ContentLength = int64(len(tt.body))
+			}
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if got := strings.TrimSpace(rr.Body.String()); got != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// mmdbNetwork is a network and its record in a test MaxMind DB.
+type mmdbNetwork struct {
+	cidr   string
+	record map[string]interface{}
+}
+
+// writeTestMMDB writes a minimal IPv6 MaxMind DB with 32-bit records.
+func writeTestMMDB(t *testing.T, path string, networks []mmdbNetwork) {
+	t.Helper()
+	type child struct {
+		kind  int // 0 empty, 1 node, 2 data
+		value int
+	}
+	nodes := [][2]child{{}}
+	var data bytes.Buffer
+	var offsets []int
+
+	for i, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		ip := ipNet.IP.To16()
+		if ipNet.IP.To4() != nil {
+			ip = append(make(net.IP, 12), ipNet.IP.To4()...)
+			ones += 96
+		}
+		node := 0
+		for bit := 0; bit < ones; bit++ {
+			b := (ip[bit/8] >> (7 - uint(bit%8))) & 1
+			if bit == ones-1 {
+				nodes[node][b] = child{kind: 2, value: i}
+				break
+			}
+			if nodes[node][b].kind != 1 {
+				nodes = append(nodes, [2]child{})
+				nodes[node][b] = child{kind: 1, value: len(nodes) - 1}
+			}
+			node = nodes[node][b].value
+		}
+		offsets = append(offsets, data.Len())
+		encodeMMDB(t, &data, network.record)
+	}
+
+	var file bytes.Buffer
+	for _, node := range nodes {
+		for _, c := range node {
+			value := uint32(len(nodes))
+			switch c.kind {
+			case 1:
+				value = uint32(c.value)
+			case 2:
+				value = uint32(len(nodes) + 16 + offsets[c.value])
+			}
+			_ = binary.Write(&file, binary.BigEndian, value)
+		}
+	}
+	file.Write(make([]byte, 16))
+	file.Write(data.Bytes())
+	file.WriteString("\xab\xcd\xefMaxMind.com")
+	encodeMMDB(t, &file, map[string]interface{}{
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(32),
+		"ip_version":                  uint16(6),
+		"database_type":               "Forklift-Test",
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"languages":                   []interface{}{"en"},
+	})
+	if err := os.WriteFile(path, file.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func encodeMMDB(t *testing.T, buf *bytes.Buffer, value interface{}) {
+	t.Helper()
+	writeUint := func(typ byte, v uint64) {
+		var payload []byte
+		for ; v > 0; v >>= 8 {
+			payload = append([]byte{byte(v)}, payload...)
+		}
+		if typ > 7 {
+			buf.WriteByte(byte(len(payload)))
+			buf.WriteByte(typ - 7)
+		} else {
+			buf.WriteByte(typ<<5 | byte(len(payload)))
+		}
+		buf.Write(payload)
+	}
+	switch v := value.(type) {
+	case string:
+		buf.WriteByte(2<<5 | byte(len(v)))
+		buf.WriteString(v)
+	case uint16:
+		writeUint(5, uint64(v))
+	case uint32:
+		writeUint(6, uint64(v))
+	case uint64:
+		writeUint(9, v)
+	case []interface{}:
+		buf.WriteByte(byte(len(v)))
+		buf.WriteByte(11 - 7)
+		for _, element := range v {
+			encodeMMDB(t, buf, element)
+		}
+	case map[string]interface{}:
+		buf.WriteByte(7<<5 | byte(len(v)))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			encodeMMDB(t, buf, key)
+			encodeMMDB(t, buf, v[key])
+		}
+	default:
+		t.Fatalf("Unsupported MMDB test value %T", value)
+	}
+}
+
+func cityRecord(country, subdivision string) map[string]interface{} {
+	return map[string]interface{}{
+		"country":      map[string]interface{}{"iso_code": country},
+		"subdivisions": []interface{}{map[string]interface{}{"iso_code": subdivision}},
+	}
+}
+
+func TestGeoIPConditions(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	euServer := createMockServer("EU Backend")
+	defer euServer.Close()
+	californiaServer := createMockServer("California Backend")
+	defer californiaServer.Close()
+	cloudServer := createMockServer("Cloud Backend")
+	defer cloudServer.Close()
+
+	dir := t.TempDir()
+	cityDB := filepath.Join(dir, "city.mmdb")
+	asnDB := filepath.Join(dir, "asn.mmdb")
+	writeTestMMDB(t, cityDB, []mmdbNetwork{
+		{cidr: "81.2.69.0/24", record: cityRecord("GB", "ENG")},
+		{cidr: "2a02:d000::/29", record: cityRecord("DE", "BE")},
+		{cidr: "8.8.0.0/16", record: cityRecord("US", "CA")},
+	})
+	writeTestMMDB(t, asnDB, []mmdbNetwork{
+		{cidr: "35.190.0.0/16", record: map[string]interface{}{"autonomous_system_number": uint32(15169)}},
+	})
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL,
+		GeoIP:          config.GeoIP{Database: cityDB, ASNDatabase: asnDB, ReloadInterval: "10ms"},
+		Rules: []config.RoutingRule{
+			{
+				PathPrefix: "/", Backend: euServer.URL, Priority: 3,
+				Conditions: []config.RuleCondition{{Type: "country", Operator: "in", Value: "gb, de, fr"}},
+			},
+			{
+				PathPrefix: "/", Backend: californiaServer.URL, Priority: 2,
+				Conditions: []config.RuleCondition{{Type: "region", Operator: "eq", Value: "US-CA"}},
+			},
+			{
+				PathPrefix: "/", Backend: cloudServer.URL, Priority: 1,
+				Conditions: []config.RuleCondition{{Type: "asn", Operator: "in", Value: "AS16509, AS15169"}},
+			},
+		},
+	})
+
+	route := func(remoteAddr string) string {
+		req := createTestRequest(t, "GET", "/", nil, nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		expected   string
+	}{
+		{name: "IPv4 country", remoteAddr: "81.2.69.160:1000", expected: "EU Backend"},
+		{name: "IPv6 country", remoteAddr: "[2a02:d000::1]:1000", expected: "EU Backend"},
+		{name: "region", remoteAddr: "8.8.8.8:1000", expected: "California Backend"},
+		{name: "ASN", remoteAddr: "35.190.1.1:1000", expected: "Cloud Backend"},
+		{name: "unknown address", remoteAddr: "192.0.2.1:1000", expected: "Default Backend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if body := route(tt.remoteAddr); body != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, body)
+			}
+		})
+	}
+
+	t.Run("database reload", func(t *testing.T) {
+		writeTestMMDB(t, cityDB, []mmdbNetwork{{cidr: "81.2.69.0/24", record: cityRecord("US", "CA")}})
+		future := time.Now().Add(time.Hour)
+		if err := os.Chtimes(cityDB, future, future); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for route("81.2.69.160:1000") != "California Backend" {
+			if time.Now().After(deadline) {
+				t.Fatal("Database was not reloaded")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestGeoIPConditionWithoutDatabaseIsRejected(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost",
+		Rules: []config.RoutingRule{{
+			Path:       "/",
+			Backend:    "http://localhost",
+			Conditions: []config.RuleCondition{{Type: "country", Operator: "eq", Value: "US"}},
+		}},
+	}
+	if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Error("Expected a country condition without a database to be rejected")
+	}
+}
@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestGraphQLConditions(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	mutationServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "Mutation Backend %d", len(body))
+	}))
+	defer mutationServer.Close()
+	searchServer := createMockServer("Search Backend")
+	defer searchServer.Close()
+	namedServer := createMockServer("Named Backend")
+	defer namedServer.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL,
+		Rules: []config.RoutingRule{
+			{
+				Path: "/graphql", Backend: mutationServer.URL, Priority: 3,
+				Conditions: []config.RuleCondition{
+					{Type: "graphql", Parameter: "operationType", Operator: "eq", Value: "mutation"},
+					{Type: "graphql", Parameter: "field", Operator: "eq", Value: "createOrder"},
+				},
+			},
+			{
+				Path: "/graphql", Backend: searchServer.URL, Priority: 2,
+				Conditions: []config.RuleCondition{{Type: "graphql", Parameter: "field", Operator: "prefix", Value: "search"}},
+			},
+			{
+				Path: "/graphql", Backend: namedServer.URL, Priority: 1,
+				Conditions: []config.RuleCondition{{Type: "graphql", Parameter: "operationName", Operator: "in", Value: "GetCart,Checkout"}},
+			},
+		},
+	})
+
+	mutation := `{"query":"mutation Place($input: OrderInput!) { order: createOrder(input: $input) { id } }","variables":{"input":{}}}`
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		query       url.Values
+		expected    string
+	}{
+		{name: "aliased mutation field", method: "POST", contentType: "application/json", body: mutation, expected: fmt.Sprintf("Mutation Backend %d", len(mutation))},
+		{
+			name: "query with the mutation's field name", method: "POST", contentType: "application/json",
+			body: `{"query":"query { createOrder { id } }"}`, expected: "Default Backend",
+		},
+		{
+			name: "shorthand query", method: "POST", contentType: "application/json",
+			body: `{"query":"{ searchProducts(term: \"}{\") { id } }"}`, expected: "Search Backend",
+		},
+		{
+			name: "fields in fragments", method: "POST", contentType: "application/json",
+			body: `{"query":"query Q { ...Root ... on Query { me { id } } } fragment Root on Query { searchUsers { id } }"}`, expected: "Search Backend",
+		},
+		{
+			name: "operation selected by name", method: "POST", contentType: "application/json",
+			body: `{"query":"query Other { searchAll } query GetCart { cart { id } }","operationName":"GetCart"}`, expected: "Named Backend",
+		},
+		{
+			name: "ambiguous document", method: "POST", contentType: "application/json",
+			body: `{"query":"query Other { searchAll } query GetCart { cart { id } }"}`, expected: "Default Backend",
+		},
+		{
+			name: "batch", method: "POST", contentType: "application/json",
+			body: `[{"query":"query A { me { id } }"},{"query":"query B { searchAll }"}]`, expected: "Search Backend",
+		},
+		{
+			name: "persisted query", method: "POST", contentType: "application/json",
+			body: `{"operationName":"Checkout","extensions":{"persistedQuery":{"version":1}}}`, expected: "Named Backend",
+		},
+		{
+			name: "application/graphql body", method: "POST", contentType: "application/graphql",
+			body: "# comment {\nquery GetCart { cart { id } }", expected: "Named Backend",
+		},
+		{
+			name: "GET request", method: "GET",
+			query: url.Values{"query": {"query Find { searchProducts { id } }"}}, expected: "Search Backend",
+		},
+		{
+			name: "invalid document", method: "POST", contentType: "application/json",
+			body: `{"query":"query GetCart { cart { id }"}`, expected: "Default Backend",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/graphql"
+			if tt.query != nil {
+				path += "?" + tt.query.Encode()
+			}
+			req := createTestRequest(t, tt.method, path, nil, nil)
+			if tt.body != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+				req.Body = io.NopCloser(strings.NewReader(tt.body))
+				req.ContentLength = int64(len(tt.body))
+			}
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if got := strings.TrimSpace(rr.Body.String()); got != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestGraphQLConditionValidation(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		Rules: []config.RoutingRule{{
+			Path: "/graphql", Backend: "http://localhost:8081",
+			Conditions: []config.RuleCondition{{Type: "graphql", Parameter: "variables", Operator: "eq", Value: "x"}},
+		}},
+	}
+	if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Error("Expected an error for an unknown graphql parameter")
+	}
+}
@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// Test vectors for the documented bucketing schemes, computed with an
+// independent implementation.
+func TestBucketVectors(t *testing.T) {
+	tests := []struct {
+		seed    string
+		key     string
+		murmur3 int
+		fnv     int
+	}{
+		{seed: "checkout-redesign", key: "user-1", murmur3: 5939, fnv: 7402},
+		{seed: "checkout-redesign", key: "user-2", murmur3: 9770, fnv: 9191},
+		{seed: "2024-q3", key: "42", murmur3: 6276, fnv: 4428},
+		{seed: "2024-q3.allocation", key: "42", murmur3: 1070, fnv: 3148},
+		{seed: "exp", key: "é", murmur3: 4385, fnv: 5022},
+		{seed: "", key: "abc", murmur3: 5801, fnv: 5775},
+	}
+	for _, tt := range tests {
+		t.Run(tt.seed+"."+tt.key, func(t *testing.T) {
+			for algorithm, expected := range map[string]int{"murmur3": tt.murmur3, "fnv": tt.fnv} {
+				got, err := forklift.Bucket(algorithm, tt.seed, tt.key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != expected {
+					t.Errorf("%s: expected bucket %d, got %d", algorithm, expected, got)
+				}
+			}
+		})
+	}
+
+	if _, err := forklift.Bucket("sha1", "seed", "key"); err == nil {
+		t.Error("Expected an error for an unknown algorithm")
+	}
+}
+
+func TestExperimentAssignmentCanBeRecomputed(t *testing.T) {
+	experiment := checkoutExperiment(40)
+	experiment.HashAlgorithm = "murmur3"
+	experiment.Variants[0].Weight = 25
+	experiment.Variants[1].Weight = 75
+	handler := newExperimentForklift(t, experiment)
+
+	for i := 0; i < 500; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		allocation, _ := forklift.Bucket("murmur3", "2024-q3.allocation", session)
+		variant, _ := forklift.Bucket("murmur3", "2024-q3", session)
+		expected := ""
+		switch {
+		case allocation >= 4000:
+		case variant < 2500:
+			expected = "control"
+		default:
+			expected = "treatment"
+		}
+		if got := handler.SelectBackend(httptest.NewRequest("GET", "/checkout", nil), session); got.Variant != expected {
+			t.Fatalf("%s: expected variant %q, got %q", session, expected, got.Variant)
+		}
+	}
+}
+
+func TestRuleHashAlgorithm(t *testing.T) {
+	newSplit := func(algorithm string) (*config.Config, *forklift.Forklift) {
+		cfg := &config.Config{
+			DefaultBackend: "http://default",
+			Rules: []config.RoutingRule{
+				{Path: "/split", Backend: "http://a", Percentage: 30, HashAlgorithm: algorithm, AffinityToken: "split-2024"},
+				{Path: "/split", Backend: "http://b", Percentage: 70, HashAlgorithm: algorithm, AffinityToken: "split-2024"},
+			},
+		}
+		handler, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg, handler
+	}
+	for _, algorithm := range []string{"murmur3", "fnv"} {
+		_, handler := newSplit(algorithm)
+		for i := 0; i < 500; i++ {
+			session := fmt.Sprintf("session-%d", i)
+			bucket, _ := forklift.Bucket(algorithm, "split-2024", session)
+			expected := "http://b"
+			if bucket < 3000 {
+				expected = "http://a"
+			}
+			if got := handler.SelectBackend(httptest.NewRequest("GET", "/split", nil), session).Backend; got != expected {
+				t.Fatalf("%s: %s in bucket %d: expected %s, got %s", algorithm, session, bucket, expected, got)
+			}
+		}
+	}
+
+	// legacy is the default and has no bucket function.
+	_, legacy := newSplit("legacy")
+	_, unset := newSplit("")
+	for i := 0; i < 100; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		got := legacy.SelectBackend(httptest.NewRequest("GET", "/split", nil), session).Backend
+		if want := unset.SelectBackend(httptest.NewRequest("GET", "/split", nil), session).Backend; got != want {
+			t.Fatalf("%s: expected legacy to be the default, got %s and %s", session, got, want)
+		}
+	}
+	if _, err := forklift.Bucket("legacy", "seed", "key"); err == nil {
+		t.Error("Expected an error for the legacy rule hash")
+	}
+
+	cfg, _ := newSplit("murmur3")
+	cfg.Rules[0].HashAlgorithm = "crc32"
+	if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Error("Expected an error for an unknown rule hashAlgorithm")
+	} else if !strings.Contains(err.Error(), `"crc32"`) {
+		t.Errorf("Expected the error to name the bad hashAlgorithm, got %v", err)
+	}
+	experiment := checkoutExperiment(100)
+	experiment.HashAlgorithm = "crc32"
+	cfg = &config.Config{DefaultBackend: "http://default", Experiments: []config.Experiment{experiment}}
+	if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Error("Expected an error for an unknown experiment hashAlgorithm")
+	}
+	cfg.Experiments[0].HashAlgorithm = "legacy"
+	if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Error("Expected an error for the legacy hash on an experiment")
+	}
+}
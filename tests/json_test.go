@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestJSONBodyConditions(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	premiumServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte("Premium Backend: " + string(body)))
+	}))
+	defer premiumServer.Close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL,
+		MaxBodySize:    256,
+		Rules: []config.RoutingRule{
+			{
+				Path:     "/checkout",
+				Method:   "POST",
+				Backend:  premiumServer.URL,
+				Priority: 2,
+				Conditions: []config.RuleCondition{
+					{Type: "json", Parameter: "$.cart.total", Operator: "gt", Value: "100"},
+				},
+			},
+			{
+				Path:     "/checkout",
+				Method:   "POST",
+				Backend:  premiumServer.URL,
+				Priority: 1,
+				Conditions: []config.RuleCondition{
+					{Type: "json", Parameter: "items[1].sku", Operator: "prefix", Value: "PRO-"},
+					{Type: "json", Parameter: "$['account']['plan']", Operator: "eq", Value: "enterprise"},
+				},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		expected    string
+	}{
+		{
+			name: "number above threshold", contentType: "application/json",
+			body: `{"cart":{"total":150.5}}`, expected: `Premium Backend: {"cart":{"total":150.5}}`,
+		},
+		{
+			name: "number below threshold", contentType: "application/json",
+			body: `{"cart":{"total":99}}`, expected: "Default Backend",
+		},
+		{
+			name: "array index and bracket keys", contentType: "application/vnd.api+json; charset=utf-8",
+			body:     `{"items":[{"sku":"A"},{"sku":"PRO-1"}],"account":{"plan":"enterprise"}}`,
+			expected: `Premium Backend: {"items":[{"sku":"A"},{"sku":"PRO-1"}],"account":{"plan":"enterprise"}}`,
+		},
+		{
+			name: "index out of range", contentType: "application/json",
+			body: `{"items":[{"sku":"PRO-1"}],"account":{"plan":"enterprise"}}`, expected: "Default Backend",
+		},
+		{
+			name: "malformed JSON", contentType: "application/json",
+			body: `{"cart":{"total":150`, expected: "Default Backend",
+		},
+		{
+			name: "not JSON", contentType: "text/plain",
+			body: `{"cart":{"total":150}}`, expected: "Default Backend",
+		},
+		{
+			name: "body over size limit", contentType: "application/json",
+			body: `{"cart":{"total":150},"padding":"` + strings.Repeat("x", 300) + `"}`, expected: "Default Backend",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/checkout", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, body)
+			}
+		})
+	}
+}
+
+func TestInvalidJSONPathIsRejected(t *testing.T) {
+	for _, path := range []string{"$.", "items[", "items[-1]", "$.a..b"} {
+		cfg := &config.Config{
+			DefaultBackend: "http://localhost",
+			Rules: []config.RoutingRule{{
+				Path:       "/",
+				Backend:    "http://localhost",
+				Conditions: []config.RuleCondition{{Type: "json", Parameter: path, Operator: "eq", Value: "x"}},
+			}},
+		}
+		if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+			t.Errorf("Expected JSON path %q to be rejected", path)
+		}
+	}
+}
+
+func TestBodyConditionsKeepBodyIntact(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	echoServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer echoServer.Close()
+
+	// Each request is checked against both a form and a json condition before
+	// it reaches the echo backend.
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL,
+		Rules: []config.RoutingRule{
+			{
+				Path: "/orders", Method: "POST", Backend: defaultServer.URL, Priority: 3,
+				Conditions: []config.RuleCondition{{Type: "form", Parameter: "plan", Operator: "eq", Value: "free"}},
+			},
+			{
+				Path: "/orders", Method: "POST", Backend: defaultServer.URL, Priority: 2,
+				Conditions: []config.RuleCondition{{Type: "json", Parameter: "plan", Operator: "eq", Value: "free"}},
+			},
+			{
+				Path: "/orders", Method: "POST", Backend: echoServer.URL, Priority: 1,
+				Conditions: []config.RuleCondition{{Type: "form", Parameter: "plan", Operator: "eq", Value: "pro"}},
+			},
+			{
+				Path: "/orders", Method: "POST", Backend: echoServer.URL,
+				Conditions: []config.RuleCondition{{Type: "json", Parameter: "plan", Operator: "eq", Value: "pro"}},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{name: "form body", contentType: "application/x-www-form-urlencoded", body: "plan=pro&seats=3&note=a%20b"},
+		{name: "JSON body", contentType: "application/json", body: `{"plan":"pro","seats":3}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if rr.Body.String() != tt.body {
+				t.Errorf("Expected the backend to receive %q, got %q", tt.body, rr.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package tests
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+const jwtTestSecret = "test-secret"
+
+func signJWT(t *testing.T, alg, kid string, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret string) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func TestJWTConditionsHS256(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	betaServer := createMockServer("Beta Backend")
+	defer betaServer.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL,
+		JWT:            config.JWT{Secret: jwtTestSecret},
+		Rules: []config.RoutingRule{{
+			PathPrefix: "/",
+			Backend:    betaServer.URL,
+			Conditions: []config.RuleCondition{
+				{Type: "jwt", Parameter: "roles", Operator: "eq", Value: "beta"},
+				{Type: "jwt", Parameter: "org.plan", Operator: "eq", Value: "premium"},
+			},
+		}},
+	})
+
+	now := time.Now().Unix()
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":   "user-1",
+			"roles": []string{"admin", "beta"},
+			"org":   map[string]string{"plan": "premium"},
+			"exp":   now + 3600,
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		expected string
+	}{
+		{name: "valid token", token: signJWT(t, "HS256", "", claims(nil), hs256(jwtTestSecret)), expected: "Beta Backend"},
+		{name: "missing role", token: signJWT(t, "HS256", "", claims(map[string]interface{}{"roles": []string{"admin"}}), hs256(jwtTestSecret)), expected: "Default Backend"},
+		{name: "wrong secret", token: signJWT(t, "HS256", "", claims(nil), hs256("forged")), expected: "Default Backend"},
+		{name: "expired", token: signJWT(t, "HS256", "", claims(map[string]interface{}{"exp": now - 10}), hs256(jwtTestSecret)), expected: "Default Backend"},
+		{name: "not valid yet", token: signJWT(t, "HS256", "", claims(map[string]interface{}{"nbf": now + 600}), hs256(jwtTestSecret)), expected: "Default Backend"},
+		{name: "alg none", token: signJWT(t, "none", "", claims(nil), func([]byte) []byte { return nil }), expected: "Default Backend"},
+		{name: "no token", token: "", expected: "Default Backend"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := createTestRequest(t, "GET", "/", map[string]string{"Authorization": "Bearer " + tt.token}, nil)
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, body)
+			}
+		})
+	}
+}
+
+func TestJWTConditionsPublicKeys(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	premiumServer := createMockServer("Premium Backend")
+	defer premiumServer.Close()
+
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemFile := filepath.Join(dir, "public.pem")
+	if err := os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(dir, "jwks.json")
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"EC","crv":"P-256","kid":"ec-1","x":%q,"y":%q}]}`,
+		base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+		base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))))
+	if err := os.WriteFile(jwksFile, []byte(jwks), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL,
+		JWT:            config.JWT{Cookie: "session_token", PublicKeyFile: pemFile, JWKSFile: jwksFile},
+		Rules: []config.RoutingRule{{
+			PathPrefix: "/",
+			Backend:    premiumServer.URL,
+			Conditions: []config.RuleCondition{{Type: "jwt", Parameter: "plan", Operator: "eq", Value: "premium"}},
+		}},
+	})
+
+	rs256 := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+	es256 := func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	premium := map[string]interface{}{"plan": "premium"}
+
+	tests := []struct {
+		name     string
+		token    string
+		expected string
+	}{
+		{name: "RS256 from PEM", token: signJWT(t, "RS256", "", premium, rs256), expected: "Premium Backend"},
+		{name: "ES256 from JWKS", token: signJWT(t, "ES256", "ec-1", premium, es256), expected: "Premium Backend"},
+		{name: "ES256 with unknown kid", token: signJWT(t, "ES256", "ec-2", premium, es256), expected: "Default Backend"},
+		{name: "HS256 signed with the public key", token: signJWT(t, "HS256", "", premium, hs256(string(der))), expected: "Default Backend"},
+		{name: "RS256 with other claim", token: signJWT(t, "RS256", "", map[string]interface{}{"plan": "free"}, rs256), expected: "Default Backend"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := createTestRequest(t, "GET", "/", nil, nil)
+			req.AddCookie(&http.Cookie{Name: "session_token", Value: tt.token})
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, body)
+			}
+		})
+	}
+}
+
+func TestJWTConditionWithoutKeyIsRejected(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost",
+		Rules: []config.RoutingRule{{
+			Path:       "/",
+			Backend:    "http://localhost",
+			Conditions: []config.RuleCondition{{Type: "jwt", Parameter: "sub", Operator: "eq", Value: "x"}},
+		}},
+	}
+	if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Error("Expected a jwt condition without a key to be rejected")
+	}
+}
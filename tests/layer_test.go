@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func layerExperiment(name, layer string, allocation float64) config.Experiment {
+	return config.Experiment{
+		Name:       name,
+		Layer:      layer,
+		Allocation: allocation,
+		Variants: []config.ExperimentVariant{
+			{Name: "control", Backend: "http://" + name + "-control", Weight: 1},
+			{Name: "treatment", Backend: "http://" + name + "-treatment", Weight: 1},
+		},
+		Routes: []config.ExperimentRoute{{PathPrefix: "/"}},
+	}
+}
+
+func TestLayerExperimentsAreMutuallyExclusive(t *testing.T) {
+	ranking := layerExperiment("ranking", "search", 30)
+	ranking.Routes = []config.ExperimentRoute{{Path: "/search"}}
+	handler := newForklift(t, &config.Config{
+		DefaultBackend: "http://default",
+		Layers:         []config.Layer{{Name: "search"}},
+		Experiments:    []config.Experiment{ranking, layerExperiment("snippets", "search", 50)},
+	})
+
+	counts := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		selected := handler.SelectBackend(httptest.NewRequest("GET", "/search", nil), session)
+		counts[selected.Experiment]++
+
+		// Only snippets covers /results, and users of ranking stay out of it.
+		other := handler.SelectBackend(httptest.NewRequest("GET", "/results", nil), session)
+		if other.Experiment != "" && other.Experiment != selected.Experiment {
+			t.Fatalf("%s is in %q and in %q", session, selected.Experiment, other.Experiment)
+		}
+	}
+	for experiment, expected := range map[string]float64{"ranking": 30, "snippets": 50, "": 20} {
+		if got := float64(counts[experiment]) / 20; math.Abs(got-expected) > 3 {
+			t.Errorf("Expected about %.0f%% in %q, got %.1f%%", expected, experiment, got)
+		}
+	}
+}
+
+func TestGlobalHoldout(t *testing.T) {
+	experiment := layerExperiment("search", "", 100)
+	experiment.Routes = []config.ExperimentRoute{{Path: "/search"}}
+	handler := newForklift(t, &config.Config{
+		DefaultBackend: "http://default",
+		Holdout:        config.Holdout{Percentage: 10},
+		Rules:          []config.RoutingRule{{Path: "/checkout", Backend: "http://v2", Percentage: 100}},
+		Experiments:    []config.Experiment{experiment},
+	})
+
+	var heldOut int
+	for i := 0; i < 2000; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		search := handler.SelectBackend(httptest.NewRequest("GET", "/search", nil), session)
+		checkout := handler.SelectBackend(httptest.NewRequest("GET", "/checkout", nil), session)
+		if search.Holdout != checkout.Holdout {
+			t.Fatalf("%s is held out on one page only", session)
+		}
+		if !search.Holdout {
+			continue
+		}
+		heldOut++
+		if search.Experiment != "" || search.Backend != "http://search-control" {
+			t.Errorf("Expected %s to get the control variant without being enrolled, got %+v", session, search)
+		}
+		if checkout.Backend != "http://default" {
+			t.Errorf("Expected %s to skip the percentage split, got %s", session, checkout.Backend)
+		}
+	}
+	if got := float64(heldOut) / 20; math.Abs(got-10) > 2 {
+		t.Errorf("Expected about 10%% held out, got %.1f%%", got)
+	}
+}
+
+func TestHoldoutGetsCanaryControl(t *testing.T) {
+	experiment := layerExperiment("search", "", 100)
+	experiment.Canary = config.Canary{Control: "treatment", MaxErrorRateIncrease: 5}
+	handler := newForklift(t, &config.Config{
+		DefaultBackend: "http://default",
+		Holdout:        config.Holdout{Percentage: 50},
+		Experiments:    []config.Experiment{experiment},
+	})
+
+	for i := 0; i < 100; i++ {
+		selected := handler.SelectBackend(httptest.NewRequest("GET", "/search", nil), fmt.Sprintf("session-%d", i))
+		if selected.Holdout && selected.Backend != "http://search-treatment" {
+			t.Errorf("Expected held out users to get the canary control, got %+v", selected)
+		}
+	}
+}
+
+func TestLayerValidation(t *testing.T) {
+	withBucketBy := layerExperiment("a", "search", 10)
+	withBucketBy.BucketBy = []string{"header:X-User-ID"}
+	tests := []struct {
+		name string
+		cfg  config.Config
+	}{
+		{name: "unnamed layer", cfg: config.Config{Layers: []config.Layer{{}}}},
+		{name: "duplicate layer", cfg: config.Config{Layers: []config.Layer{{Name: "search"}, {Name: "search"}}}},
+		{name: "invalid layer hash", cfg: config.Config{Layers: []config.Layer{{Name: "search", HashAlgorithm: "md5"}}}},
+		{name: "unknown layer", cfg: config.Config{Experiments: []config.Experiment{layerExperiment("a", "search", 10)}}},
+		{name: "overallocated layer", cfg: config.Config{
+			Layers:      []config.Layer{{Name: "search"}},
+			Experiments: []config.Experiment{layerExperiment("a", "search", 60), layerExperiment("b", "search", 50)},
+		}},
+		{name: "bucketBy on a layer experiment", cfg: config.Config{
+			Layers:      []config.Layer{{Name: "search"}},
+			Experiments: []config.Experiment{withBucketBy},
+		}},
+		{name: "holdout above 100", cfg: config.Config{Holdout: config.Holdout{Percentage: 120}}},
+		{name: "invalid holdout bucketBy", cfg: config.Config{Holdout: config.Holdout{Percentage: 5, BucketBy: []string{"shoe:size"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.DefaultBackend = "http://default"
+			if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), &cfg, "test"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestTargetingLists(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	betaServer := createMockServer("Beta Backend")
+	defer betaServer.Close()
+	officeServer := createMockServer("Office Backend")
+	defer officeServer.Close()
+
+	dir := t.TempDir()
+	cohort := filepath.Join(dir, "beta-cohort.txt")
+	offices := filepath.Join(dir, "offices.txt")
+	blocked := filepath.Join(dir, "blocked.txt")
+	writeFile(t, cohort, "# beta users\nuser-1\nUser-2\n\nuser-3\n")
+	writeFile(t, offices, "203.0.113.0/24\n2001:db8::1\n198.51.100.128/25\n2001:db8:1::/48\n198.51.100.200/25\n")
+	writeFile(t, blocked, "user-3\n")
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL,
+		Lists: []config.List{
+			{Name: "beta-cohort", File: cohort, ReloadInterval: "10ms"},
+			{Name: "offices", File: offices},
+			{Name: "blocked", File: blocked},
+		},
+		Rules: []config.RoutingRule{
+			{
+				Path: "/", Backend: officeServer.URL, Priority: 2,
+				Conditions: []config.RuleCondition{{Type: "ip", Operator: "inList", Value: "offices"}},
+			},
+			{
+				Path: "/", Backend: betaServer.URL, Priority: 1,
+				Conditions: []config.RuleCondition{
+					{Type: "header", Parameter: "X-User-Id", Operator: "inList", Value: "beta-cohort"},
+					{Type: "header", Parameter: "X-User-Id", Operator: "notInList", Value: "blocked"},
+				},
+			},
+		},
+	}
+	handler, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatalf("Failed to create Forklift middleware: %v", err)
+	}
+
+	route := func(remoteAddr, userID string) string {
+		req := createTestRequest(t, "GET", "/", nil, nil)
+		req.RemoteAddr = remoteAddr
+		if userID != "" {
+			req.Header.Set("X-User-Id", userID)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		userID     string
+		expected   string
+	}{
+		{name: "user in list", remoteAddr: "192.0.2.1:1000", userID: "user-1", expected: "Beta Backend"},
+		{name: "case-insensitive entry", remoteAddr: "192.0.2.1:1000", userID: "user-2", expected: "Beta Backend"},
+		{name: "user in blocked list", remoteAddr: "192.0.2.1:1000", userID: "user-3", expected: "Default Backend"},
+		{name: "user not in list", remoteAddr: "192.0.2.1:1000", userID: "user-4", expected: "Default Backend"},
+		{name: "comment is not an entry", remoteAddr: "192.0.2.1:1000", userID: "# beta users", expected: "Default Backend"},
+		{name: "IP in listed CIDR", remoteAddr: "203.0.113.9:1000", expected: "Office Backend"},
+		{name: "listed IPv6 address", remoteAddr: "[2001:DB8:0::1]:1000", expected: "Office Backend"},
+		{name: "IP in a narrower CIDR", remoteAddr: "198.51.100.200:1000", expected: "Office Backend"},
+		{name: "IP outside a narrower CIDR", remoteAddr: "198.51.100.5:1000", expected: "Default Backend"},
+		{name: "IP in listed IPv6 CIDR", remoteAddr: "[2001:db8:1:ffff::5]:1000", expected: "Office Backend"},
+		{name: "IPv4-mapped IP in listed CIDR", remoteAddr: "[::ffff:203.0.113.9]:1000", expected: "Office Backend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if body := route(tt.remoteAddr, tt.userID); body != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, body)
+			}
+		})
+	}
+
+	t.Run("stats", func(t *testing.T) {
+		stats := handler.ListStats()
+		if len(stats) != 3 || stats[0].Name != "beta-cohort" || stats[0].Entries != 3 || stats[2].Networks != 3 {
+			t.Fatalf("Unexpected list stats: %+v", stats)
+		}
+		if stats[0].Bytes <= 0 {
+			t.Errorf("Expected a memory estimate, got %d", stats[0].Bytes)
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		writeFile(t, cohort, "user-4\n")
+		future := time.Now().Add(time.Hour)
+		if err := os.Chtimes(cohort, future, future); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for route("192.0.2.1:1000", "user-4") != "Beta Backend" {
+			if time.Now().After(deadline) {
+				t.Fatal("List was not reloaded")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if body := route("192.0.2.1:1000", "user-1"); body != "Default Backend" {
+			t.Errorf("Expected removed entry to stop matching, got %q", body)
+		}
+	})
+}
+
+func TestUnknownListsAreRejected(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost",
+		Rules: []config.RoutingRule{{
+			Path:       "/",
+			Backend:    "http://localhost",
+			Conditions: []config.RuleCondition{{Type: "header", Parameter: "X-User-Id", Operator: "inList", Value: "missing"}},
+		}},
+	}
+	if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Error("Expected a condition on an unknown list to be rejected")
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestNetworkConditions(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	canaryServer := createMockServer("Canary Backend")
+	defer canaryServer.Close()
+	stableServer := createMockServer("Stable Backend")
+	defer stableServer.Close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL,
+		Rules: []config.RoutingRule{
+			{
+				PathPrefix: "/",
+				Backend:    stableServer.URL,
+				Priority:   3,
+				Conditions: []config.RuleCondition{
+					{Type: "ip", Operator: "in", Value: "203.0.113.0/24, 2001:db8:bad::/48"},
+				},
+			},
+			{
+				PathPrefix: "/",
+				Backend:    canaryServer.URL,
+				Priority:   2,
+				Conditions: []config.RuleCondition{
+					{Type: "ip", Operator: "in", Value: "10.0.0.0/8,fd00::/8,192.0.2.7"},
+				},
+			},
+			{
+				Path:     "/secure",
+				Backend:  canaryServer.URL,
+				Priority: 1,
+				Conditions: []config.RuleCondition{
+					{Type: "tls", Operator: "eq", Value: "true"},
+					{Type: "tlsVersion", Operator: "gt", Value: "1.2"},
+					{Type: "sni", Operator: "suffix", Value: ".example.com"},
+					{Type: "scheme", Operator: "eq", Value: "https"},
+					{Type: "port", Operator: "eq", Value: "8443"},
+				},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	tests := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		host       string
+		tls        *tls.ConnectionState
+		expected   string
+	}{
+		{name: "office IPv4 network", path: "/", remoteAddr: "10.1.2.3:5555", expected: "Canary Backend"},
+		{name: "office IPv6 network", path: "/", remoteAddr: "[fd12::1]:5555", expected: "Canary Backend"},
+		{name: "single office address", path: "/", remoteAddr: "192.0.2.7:5555", expected: "Canary Backend"},
+		{name: "abusive IPv4 subnet", path: "/", remoteAddr: "203.0.113.9:5555", expected: "Stable Backend"},
+		{name: "abusive IPv6 subnet", path: "/", remoteAddr: "[2001:db8:bad::1]:5555", expected: "Stable Backend"},
+		{name: "other client", path: "/", remoteAddr: "198.51.100.1:5555", expected: "Default Backend"},
+		{
+			name: "TLS 1.3 with matching SNI and port", path: "/secure", remoteAddr: "198.51.100.1:5555", host: "shop.example.com:8443",
+			tls: &tls.ConnectionState{Version: tls.VersionTLS13, ServerName: "shop.example.com"}, expected: "Canary Backend",
+		},
+		{
+			name: "TLS 1.2 is too old", path: "/secure", remoteAddr: "198.51.100.1:5555", host: "shop.example.com:8443",
+			tls: &tls.ConnectionState{Version: tls.VersionTLS12, ServerName: "shop.example.com"}, expected: "Default Backend",
+		},
+		{
+			name: "wrong port", path: "/secure", remoteAddr: "198.51.100.1:5555", host: "shop.example.com",
+			tls: &tls.ConnectionState{Version: tls.VersionTLS13, ServerName: "shop.example.com"}, expected: "Default Backend",
+		},
+		{name: "plain HTTP", path: "/secure", remoteAddr: "198.51.100.1:5555", host: "shop.example.com:8443", expected: "Default Backend"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := createTestRequest(t, "GET", tt.path, nil, nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Host = tt.host
+			req.TLS = tt.tls
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, body)
+			}
+		})
+	}
+}
+
+func TestInvalidNetworkConditionIsRejected(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost",
+		Rules: []config.RoutingRule{{
+			Path:       "/",
+			Backend:    "http://localhost",
+			Conditions: []config.RuleCondition{{Type: "ip", Operator: "in", Value: "10.0.0.0/33"}},
+		}},
+	}
+	if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Error("Expected an invalid CIDR to be rejected")
+	}
+}
@@ -0,0 +1,197 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestVariantOverrides(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	betaServer := createMockServer("Beta Backend")
+	defer betaServer.Close()
+
+	const secret = "qa-secret"
+	cfg := &config.Config{
+		DefaultBackend:  defaultServer.URL,
+		VariantOverride: config.VariantOverride{Secret: secret},
+		Rules: []config.RoutingRule{{
+			Name:       "new-checkout",
+			PathPrefix: "/checkout",
+			Backend:    betaServer.URL,
+			Conditions: []config.RuleCondition{{Type: "header", Parameter: "X-Beta", Operator: "eq", Value: "yes"}},
+		}},
+	}
+	handler, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatalf("Failed to create Forklift middleware: %v", err)
+	}
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	handler.SetClock(func() time.Time { return now })
+
+	valid := forklift.SignVariantOverride(secret, "new-checkout", now.Add(time.Hour), false)
+	pinned := forklift.SignVariantOverride(secret, "new-checkout", now.Add(time.Hour), true)
+
+	tests := []struct {
+		name      string
+		path      string
+		header    string
+		cookie    string
+		expected  string
+		setCookie bool
+	}{
+		{name: "no override", path: "/checkout", expected: "Default Backend"},
+		{name: "query override", path: "/checkout?forklift_variant=" + valid, expected: "Beta Backend"},
+		{name: "header override", path: "/checkout", header: valid, expected: "Beta Backend"},
+		{name: "cookie override", path: "/checkout", cookie: valid, expected: "Beta Backend"},
+		{name: "session pinning", path: "/checkout?forklift_variant=" + pinned, expected: "Beta Backend", setCookie: true},
+		{name: "other path", path: "/account", header: valid, expected: "Default Backend"},
+		{
+			name: "expired", path: "/checkout", expected: "Default Backend",
+			header: forklift.SignVariantOverride(secret, "new-checkout", now.Add(-time.Second), false),
+		},
+		{
+			name: "wrong secret", path: "/checkout", expected: "Default Backend",
+			header: forklift.SignVariantOverride("guess", "new-checkout", now.Add(time.Hour), false),
+		},
+		{
+			name: "tampered variant", path: "/checkout", expected: "Default Backend",
+			header: "other" + strings.TrimPrefix(valid, "new-checkout"),
+		},
+		{
+			name: "unknown variant", path: "/checkout", expected: "Default Backend",
+			header: forklift.SignVariantOverride(secret, "unknown", now.Add(time.Hour), false),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := createTestRequest(t, "GET", tt.path, nil, nil)
+			if tt.header != "" {
+				req.Header.Set("X-Forklift-Variant", tt.header)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "forklift_variant", Value: tt.cookie})
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, body)
+			}
+			pinnedCookie := strings.Contains(strings.Join(rr.Header().Values("Set-Cookie"), "\n"), "forklift_variant="+pinned)
+			if pinnedCookie != tt.setCookie {
+				t.Errorf("Expected override cookie to be set: %v, got %v", tt.setCookie, pinnedCookie)
+			}
+		})
+	}
+}
+
+func TestVariantOverridesDisabledWithoutSecret(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	betaServer := createMockServer("Beta Backend")
+	defer betaServer.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL,
+		Rules: []config.RoutingRule{{
+			Name: "beta", Path: "/", Backend: betaServer.URL,
+			Conditions: []config.RuleCondition{{Type: "header", Parameter: "X-Beta", Operator: "eq", Value: "yes"}},
+		}},
+	})
+	req := createTestRequest(t, "GET", "/", nil, nil)
+	req.Header.Set("X-Forklift-Variant", forklift.SignVariantOverride("", "beta", time.Now().Add(time.Hour), false))
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+
+	if body := strings.TrimSpace(rr.Body.String()); body != "Default Backend" {
+		t.Errorf("Expected body %q, got %q", "Default Backend", body)
+	}
+}
+
+func TestExperimentVariantOverrides(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	controlServer := createMockServer("Control Backend")
+	defer controlServer.Close()
+	treatmentServer := createMockServer("Treatment Backend")
+	defer treatmentServer.Close()
+
+	const secret = "qa-secret"
+	// With a weight of 0, the treatment is only reachable through the override.
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend:    defaultServer.URL,
+		VariantOverride:   config.VariantOverride{Secret: secret},
+		StickyAssignments: config.StickyAssignments{Secret: "sticky-secret"},
+		Experiments: []config.Experiment{{
+			Name:       "checkout",
+			Allocation: 100,
+			Variants: []config.ExperimentVariant{
+				{Name: "control", Backend: controlServer.URL, Weight: 100},
+				{Name: "treatment", Backend: treatmentServer.URL},
+			},
+			Routes: []config.ExperimentRoute{{PathPrefix: "/checkout"}},
+		}},
+	})
+	expires := time.Now().Add(time.Hour)
+	serve := func(path, token string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := createTestRequest(t, "GET", path, nil, nil)
+		req.AddCookie(&http.Cookie{Name: "forklift_id", Value: "c2Vzc2lvbi0x"})
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		if token != "" {
+			req.Header.Set("X-Forklift-Variant", token)
+		}
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		token    string
+		expected string
+	}{
+		{name: "no override", path: "/checkout", expected: "Control Backend"},
+		{name: "variant override", path: "/checkout/pay", token: forklift.SignVariantOverride(secret, "checkout:treatment", expires, false), expected: "Treatment Backend"},
+		{name: "outside the experiment's routes", path: "/account", token: forklift.SignVariantOverride(secret, "checkout:treatment", expires, false), expected: "Default Backend"},
+		{name: "unknown variant", path: "/checkout", token: forklift.SignVariantOverride(secret, "checkout:missing", expires, false), expected: "Control Backend"},
+		{name: "unknown experiment", path: "/checkout", token: forklift.SignVariantOverride(secret, "search:treatment", expires, false), expected: "Control Backend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if body := strings.TrimSpace(serve(tt.path, tt.token).Body.String()); body != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, body)
+			}
+		})
+	}
+
+	// A request-scoped override doesn't become the user's sticky assignment.
+	rr := serve("/checkout", forklift.SignVariantOverride(secret, "checkout:treatment", expires, false))
+	if responseCookie(rr, assignmentCookie) != nil {
+		t.Error("Expected a request-scoped override not to write the assignment cookie")
+	}
+
+	// A session-scoped override is kept by its pinned cookie instead.
+	rr = serve("/checkout", forklift.SignVariantOverride(secret, "checkout:treatment", expires, true))
+	pinned := responseCookie(rr, "forklift_variant")
+	if pinned == nil {
+		t.Fatal("Expected the session override to be pinned")
+	}
+	rr = serve("/checkout", "", pinned)
+	if body := strings.TrimSpace(rr.Body.String()); body != "Treatment Backend" {
+		t.Errorf("Expected the pinned override to keep the treatment, got %q", body)
+	}
+	if responseCookie(rr, assignmentCookie) != nil {
+		t.Error("Expected a pinned override not to write the assignment cookie")
+	}
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestPathPatterns(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	assetServer := createMockServer("Asset Backend")
+	defer assetServer.Close()
+	vipServer := createMockServer("VIP Backend")
+	defer vipServer.Close()
+	echoServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Echo %s", r.URL.Path)
+	}))
+	defer echoServer.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL,
+		Rules: []config.RoutingRule{
+			{PathPattern: "/static/**.js", Backend: assetServer.URL},
+			{
+				PathPattern: "/users/{id}/orders/*", Backend: vipServer.URL, Priority: 2,
+				Conditions: []config.RuleCondition{{Type: "param", Parameter: "id", Operator: "in", Value: "7, 42"}},
+			},
+			{
+				PathPattern: "/users/{id}/orders/{order}", Backend: echoServer.URL, Priority: 1,
+				PathRewrite: "/v2/orders/{order}/owner/{id}",
+			},
+			{
+				PathPattern: "/teams/{team}/*", Backend: vipServer.URL,
+				Expr: `startsWith(param("team"), "core-")`,
+			},
+		},
+	})
+
+	tests := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{name: "globstar across segments", path: "/static/js/vendor/app.js", expected: "Asset Backend"},
+		{name: "globstar suffix mismatch", path: "/static/css/app.css", expected: "Default Backend"},
+		{name: "param condition", path: "/users/42/orders/1001", expected: "VIP Backend"},
+		{name: "rewrite with params", path: "/users/5/orders/1001", expected: "Echo /v2/orders/1001/owner/5"},
+		{name: "param spans one segment", path: "/users/5/6/orders/1001", expected: "Default Backend"},
+		{name: "star spans one segment", path: "/users/5/orders/1001/items", expected: "Default Backend"},
+		{name: "param in expression", path: "/teams/core-infra/settings", expected: "VIP Backend"},
+		{name: "param in expression mismatch", path: "/teams/web/settings", expected: "Default Backend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := createTestRequest(t, "GET", tt.path, nil, nil)
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+			if body := strings.TrimSpace(rr.Body.String()); body != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, body)
+			}
+		})
+	}
+}
+
+func TestInvalidPathPatternsAreRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		rule config.RoutingRule
+	}{
+		{name: "relative pattern", rule: config.RoutingRule{PathPattern: "users/{id}"}},
+		{name: "unclosed parameter", rule: config.RoutingRule{PathPattern: "/users/{id"}},
+		{name: "duplicate parameter", rule: config.RoutingRule{PathPattern: "/a/{id}/b/{id}"}},
+		{name: "invalid parameter name", rule: config.RoutingRule{PathPattern: "/a/{user-id}"}},
+		{name: "unknown rewrite parameter", rule: config.RoutingRule{PathPattern: "/a/{id}", PathRewrite: "/b/{name}"}},
+		{name: "both rewrites", rule: config.RoutingRule{PathPrefix: "/a", PathPrefixRewrite: "/b", PathRewrite: "/c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.Backend = "http://localhost"
+			cfg := &config.Config{DefaultBackend: "http://localhost", Rules: []config.RoutingRule{tt.rule}}
+			if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+				t.Error("Expected the rule to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+var rampStart = time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC)
+
+// shareOf returns the percentage of 2000 sessions routed to backend at now.
+func shareOf(t *testing.T, handler *forklift.Forklift, now time.Time, path, backend string) float64 {
+	t.Helper()
+	handler.SetClock(func() time.Time { return now })
+	var n int
+	for i := 0; i < 2000; i++ {
+		if handler.SelectBackend(httptest.NewRequest("GET", path, nil), fmt.Sprintf("session-%d", i)).Backend == backend {
+			n++
+		}
+	}
+	return float64(n) / 20
+}
+
+func TestRuleRamps(t *testing.T) {
+	steps := config.Ramp{
+		Start: rampStart.Format(time.RFC3339),
+		Steps: []config.RampStep{{After: "0s", Value: 10}, {After: "2h", Value: 25}, {After: "1d", Value: 50}},
+	}
+	paused := steps
+	paused.PausedAt = rampStart.Add(time.Hour).Format(time.RFC3339)
+	linear := config.Ramp{
+		Start: rampStart.Format(time.RFC3339),
+		End:   rampStart.Add(10 * time.Hour).Format(time.RFC3339),
+		From:  0,
+		To:    100,
+	}
+	cfg := &config.Config{
+		DefaultBackend: "http://v1",
+		Rules: []config.RoutingRule{
+			{Path: "/steps", Backend: "http://v2", Ramp: steps},
+			{Path: "/paused", Backend: "http://v2", Ramp: paused},
+			{Path: "/linear", Backend: "http://v2", Ramp: linear},
+		},
+	}
+	handler, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		offset   time.Duration
+		expected float64
+	}{
+		{path: "/steps", offset: -time.Hour, expected: 0},
+		{path: "/steps", offset: time.Hour, expected: 10},
+		{path: "/steps", offset: 3 * time.Hour, expected: 25},
+		{path: "/steps", offset: 48 * time.Hour, expected: 50},
+		{path: "/paused", offset: 48 * time.Hour, expected: 10},
+		{path: "/linear", offset: 0, expected: 0},
+		{path: "/linear", offset: 5 * time.Hour, expected: 50},
+		{path: "/linear", offset: 20 * time.Hour, expected: 100},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s at %s", tt.path, tt.offset), func(t *testing.T) {
+			if got := shareOf(t, handler, rampStart.Add(tt.offset), tt.path, "http://v2"); math.Abs(got-tt.expected) > 3 {
+				t.Errorf("Expected about %.0f%% on the ramped backend, got %.1f%%", tt.expected, got)
+			}
+		})
+	}
+
+	// Sessions on the new backend stay there as the ramp goes up.
+	for i := 0; i < 500; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		handler.SetClock(func() time.Time { return rampStart.Add(time.Hour) })
+		early := handler.SelectBackend(httptest.NewRequest("GET", "/steps", nil), session).Backend
+		handler.SetClock(func() time.Time { return rampStart.Add(48 * time.Hour) })
+		late := handler.SelectBackend(httptest.NewRequest("GET", "/steps", nil), session).Backend
+		if early == "http://v2" && late != "http://v2" {
+			t.Fatalf("%s left the ramped backend as the ramp went up", session)
+		}
+	}
+}
+
+func TestVariantRamp(t *testing.T) {
+	experiment := config.Experiment{
+		Name:       "search",
+		Allocation: 100,
+		Variants: []config.ExperimentVariant{
+			{Name: "control", Backend: "http://v1", Weight: 1},
+			{Name: "treatment", Backend: "http://v2", Ramp: config.Ramp{
+				Start: rampStart.Format(time.RFC3339),
+				End:   rampStart.Add(4 * time.Hour).Format(time.RFC3339),
+				To:    50,
+			}},
+		},
+		Routes: []config.ExperimentRoute{{Path: "/search"}},
+	}
+	handler := newExperimentForklift(t, experiment)
+
+	for offset, expected := range map[time.Duration]float64{-time.Hour: 0, 2 * time.Hour: 25, 8 * time.Hour: 50} {
+		if got := shareOf(t, handler, rampStart.Add(offset), "/search", "http://v2"); math.Abs(got-expected) > 3 {
+			t.Errorf("At %s: expected about %.0f%% in treatment, got %.1f%%", offset, expected, got)
+		}
+		if got := shareOf(t, handler, rampStart.Add(offset), "/search", "http://v1"); math.Abs(got-(100-expected)) > 3 {
+			t.Errorf("At %s: expected about %.0f%% in control, got %.1f%%", offset, 100-expected, got)
+		}
+	}
+}
+
+func TestRampValidation(t *testing.T) {
+	start := rampStart.Format(time.RFC3339)
+	tests := []struct {
+		name string
+		rule config.RoutingRule
+	}{
+		{name: "percentage and ramp", rule: config.RoutingRule{Percentage: 10, Ramp: config.Ramp{Start: start, Steps: []config.RampStep{{Value: 10}}}}},
+		{name: "missing start", rule: config.RoutingRule{Ramp: config.Ramp{Steps: []config.RampStep{{Value: 10}}}}},
+		{name: "no steps or end", rule: config.RoutingRule{Ramp: config.Ramp{Start: start}}},
+		{name: "steps and end", rule: config.RoutingRule{Ramp: config.Ramp{Start: start, End: start, Steps: []config.RampStep{{Value: 10}}}}},
+		{name: "end before start", rule: config.RoutingRule{Ramp: config.Ramp{Start: start, End: "2024-06-01T00:00:00Z", To: 50}}},
+		{name: "steps out of order", rule: config.RoutingRule{Ramp: config.Ramp{Start: start, Steps: []config.RampStep{{After: "2h", Value: 10}, {After: "1h", Value: 20}}}}},
+		{name: "value above 100", rule: config.RoutingRule{Ramp: config.Ramp{Start: start, Steps: []config.RampStep{{Value: 120}}}}},
+		{name: "invalid offset", rule: config.RoutingRule{Ramp: config.Ramp{Start: start, Steps: []config.RampStep{{After: "soon", Value: 10}}}}},
+		{name: "invalid pausedAt", rule: config.RoutingRule{Ramp: config.Ramp{Start: start, PausedAt: "now", Steps: []config.RampStep{{Value: 10}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.Path, tt.rule.Backend = "/", "http://v2"
+			cfg := &config.Config{DefaultBackend: "http://v1", Rules: []config.RoutingRule{tt.rule}}
+			if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestRampStatus(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://v1",
+		Rules: []config.RoutingRule{{
+			Path:    "/steps",
+			Method:  "GET",
+			Backend: "http://v2",
+			Ramp: config.Ramp{
+				Start:    rampStart.Format(time.RFC3339),
+				Steps:    []config.RampStep{{After: "0s", Value: 10}, {After: "2h", Value: 25}, {After: "1d", Value: 50}},
+				PausedAt: rampStart.Add(30 * time.Hour).Format(time.RFC3339),
+			},
+		}},
+		Experiments: []config.Experiment{{
+			Name:       "search",
+			Allocation: 100,
+			Variants: []config.ExperimentVariant{
+				{Name: "control", Backend: "http://v1", Weight: 1},
+				{Name: "treatment", Backend: "http://v2", Ramp: config.Ramp{
+					Start: rampStart.Format(time.RFC3339),
+					End:   rampStart.Add(4 * time.Hour).Format(time.RFC3339),
+					To:    40,
+				}},
+			},
+			Routes: []config.ExperimentRoute{{Path: "/search"}},
+		}},
+	}
+	handler, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		offset    time.Duration
+		rule      float64
+		variant   float64
+		rulePause bool
+	}{
+		{offset: -time.Hour, rule: 0, variant: 0},
+		{offset: 3 * time.Hour, rule: 25, variant: 30},
+		{offset: 48 * time.Hour, rule: 50, variant: 40, rulePause: true},
+	}
+	for _, tt := range tests {
+		handler.SetClock(func() time.Time { return rampStart.Add(tt.offset) })
+		ramps := handler.Ramps()
+		if len(ramps) != 2 {
+			t.Fatalf("Expected a rule and a variant ramp, got %+v", ramps)
+		}
+		rule, variant := ramps[0], ramps[1]
+		if rule.Group != "/steps" || rule.Method != "GET" || rule.Backend != "http://v2" || rule.Percentage != tt.rule || rule.Paused != tt.rulePause {
+			t.Errorf("At %s: expected the rule ramp at %g%%, got %+v", tt.offset, tt.rule, rule)
+		}
+		if variant.Experiment != "search" || variant.Variant != "treatment" || math.Abs(variant.Percentage-tt.variant) > 1e-9 || variant.Paused {
+			t.Errorf("At %s: expected the variant ramp at %g%%, got %+v", tt.offset, tt.variant, variant)
+		}
+	}
+}
+
+func TestRampStatusAfterCanaryRollback(t *testing.T) {
+	controlServer := createMockServer("Control Backend")
+	defer controlServer.Close()
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failingServer.Close()
+
+	cfg := &config.Config{
+		DefaultBackend: "http://default",
+		Experiments: []config.Experiment{{
+			Name:       "search",
+			Allocation: 100,
+			Variants: []config.ExperimentVariant{
+				{Name: "control", Backend: controlServer.URL, Weight: 1},
+				{Name: "treatment", Backend: failingServer.URL, Ramp: config.Ramp{
+					Start: canaryStart.Add(-time.Hour).Format(time.RFC3339),
+					Steps: []config.RampStep{{Value: 50}},
+				}},
+			},
+			Routes: []config.ExperimentRoute{{Path: "/search"}},
+			Canary: config.Canary{MinRequests: 20, MaxErrorRateIncrease: 5},
+		}},
+	}
+	handler := newNamedForklift(t, canaryName(t), cfg, canaryStart)
+	if ramps := handler.Ramps(); len(ramps) != 1 || ramps[0].Percentage != 50 {
+		t.Fatalf("Expected the treatment ramp at 50%%, got %+v", ramps)
+	}
+
+	serveSessions(t, handler, "/search", 100)
+	handler.SetClock(func() time.Time { return canaryStart.Add(2 * time.Second) })
+	serveSessions(t, handler, "/search", 1)
+
+	if ramps := handler.Ramps(); len(ramps) != 1 || ramps[0].Percentage != 0 {
+		t.Errorf("Expected the rolled back treatment at 0%%, got %+v", ramps)
+	}
+}
@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestTimeWindowsAndSchedules(t *testing.T) {
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+	launchServer := createMockServer("Launch Backend")
+	defer launchServer.Close()
+	nightServer := createMockServer("Night Backend")
+	defer nightServer.Close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL,
+		Rules: []config.RoutingRule{
+			{
+				Path:        "/launch",
+				Backend:     launchServer.URL,
+				ActiveFrom:  "2026-03-01T09:00:00Z",
+				ActiveUntil: "2026-03-08T09:00:00Z",
+			},
+			{
+				Path:    "/render",
+				Backend: nightServer.URL,
+				Conditions: []config.RuleCondition{{
+					Type:     "schedule",
+					Days:     []string{"mon-fri"},
+					Hours:    []string{"22:00-06:00"},
+					Timezone: "America/New_York",
+				}},
+			},
+		},
+	}
+	handler, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatalf("Failed to create Forklift middleware: %v", err)
+	}
+
+	var now time.Time
+	handler.SetClock(func() time.Time { return now })
+
+	tests := []struct {
+		name     string
+		path     string
+		now      string
+		expected string
+	}{
+		{name: "before launch", path: "/launch", now: "2026-03-01T08:59:59Z", expected: "Default Backend"},
+		{name: "at launch", path: "/launch", now: "2026-03-01T09:00:00Z", expected: "Launch Backend"},
+		{name: "last second", path: "/launch", now: "2026-03-08T08:59:59Z", expected: "Launch Backend"},
+		{name: "ended", path: "/launch", now: "2026-03-08T09:00:00Z", expected: "Default Backend"},
+		{name: "weekday night in New York", path: "/render", now: "2026-03-04T04:30:00Z", expected: "Night Backend"},
+		{name: "weekday after midnight in New York", path: "/render", now: "2026-03-04T10:30:00Z", expected: "Night Backend"},
+		{name: "weekday daytime in New York", path: "/render", now: "2026-03-04T16:00:00Z", expected: "Default Backend"},
+		{name: "saturday night in New York", path: "/render", now: "2026-03-08T03:00:00Z", expected: "Default Backend"},
+		{name: "friday night after midnight in New York", path: "/render", now: "2026-03-07T07:00:00Z", expected: "Night Backend"},
+		{name: "sunday night after midnight in New York", path: "/render", now: "2026-03-02T07:00:00Z", expected: "Default Backend"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if now, err = time.Parse(time.RFC3339, tt.now); err != nil {
+				t.Fatal(err)
+			}
+			req := createTestRequest(t, "GET", tt.path, nil, nil)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tt.expected {
+				t.Errorf("Expected body %q, got %q", tt.expected, body)
+			}
+		})
+	}
+}
+
+func TestInvalidSchedulesAreRejected(t *testing.T) {
+	rules := []config.RoutingRule{
+		{Path: "/", Backend: "http://localhost", ActiveFrom: "tomorrow"},
+		{Path: "/", Backend: "http://localhost", ActiveFrom: "2026-03-08T09:00:00Z", ActiveUntil: "2026-03-01T09:00:00Z"},
+		{Path: "/", Backend: "http://localhost", Conditions: []config.RuleCondition{{Type: "schedule", Days: []string{"someday"}}}},
+		{Path: "/", Backend: "http://localhost", Conditions: []config.RuleCondition{{Type: "schedule", Hours: []string{"25:00-26:00"}}}},
+		{Path: "/", Backend: "http://localhost", Conditions: []config.RuleCondition{{Type: "schedule", Timezone: "Mars/Olympus_Mons"}}},
+		{Path: "/", Backend: "http://localhost", Conditions: []config.RuleCondition{{Type: "schedule", Hours: []string{"10:00xyz-12:00"}}}},
+		{Path: "/", Backend: "http://localhost", Conditions: []config.RuleCondition{{Type: "schedule", Hours: []string{"10:00-12:5"}}}},
+		{Path: "/", Backend: "http://localhost", Conditions: []config.RuleCondition{{Type: "schedule", Hours: []string{"+9:00-12:00"}}}},
+	}
+	for _, rule := range rules {
+		cfg := &config.Config{DefaultBackend: "http://localhost", Rules: []config.RoutingRule{rule}}
+		if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+			t.Errorf("Expected rule %+v to be rejected", rule)
+		}
+	}
+}
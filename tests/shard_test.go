@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// shardConfig returns a config whose /api/ rule shards tenants across
+// backends.
+func shardConfig(backends ...string) *config.Config {
+	return &config.Config{
+		DefaultBackend: "http://default",
+		Rules: []config.RoutingRule{{
+			PathPrefix: "/api/",
+			Backend:    "http://fallback",
+			BucketBy:   []string{"header:X-Tenant"},
+			Shard:      config.Shard{Backends: backends},
+		}},
+	}
+}
+
+// shardsOf returns the backend each of 4000 tenants is routed to.
+func shardsOf(handler *forklift.Forklift) map[string]string {
+	shards := make(map[string]string)
+	for i := 0; i < 4000; i++ {
+		tenant := fmt.Sprintf("tenant-%d", i)
+		req := httptest.NewRequest("GET", "/api/orders", nil)
+		req.Header.Set("X-Tenant", tenant)
+		shards[tenant] = handler.SelectBackend(req, "session").Backend
+	}
+	return shards
+}
+
+func TestShardDistribution(t *testing.T) {
+	backends := []string{"http://shard-a", "http://shard-b", "http://shard-c", "http://shard-d"}
+	shards := shardsOf(newForklift(t, shardConfig(backends...)))
+
+	counts := make(map[string]int)
+	for _, backend := range shards {
+		counts[backend]++
+	}
+	for _, backend := range backends {
+		if share := float64(counts[backend]) / 40; math.Abs(share-25) > 5 {
+			t.Errorf("Expected about 25%% of the tenants on %s, got %.1f%%", backend, share)
+		}
+	}
+
+	// The ring doesn't depend on the order of the backends.
+	reordered := shardsOf(newForklift(t, shardConfig(backends[3], backends[1], backends[0], backends[2])))
+	for tenant, backend := range shards {
+		if reordered[tenant] != backend {
+			t.Fatalf("%s moved from %s to %s when the backends were reordered", tenant, backend, reordered[tenant])
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/orders", nil)
+	if got := newForklift(t, shardConfig(backends...)).SelectBackend(req, "session").Backend; got != "http://fallback" {
+		t.Errorf("Expected requests without a tenant to go to the rule's backend, got %s", got)
+	}
+}
+
+func TestShardRebalancing(t *testing.T) {
+	four := shardsOf(newForklift(t, shardConfig("http://shard-a", "http://shard-b", "http://shard-c", "http://shard-d")))
+	five := shardsOf(newForklift(t, shardConfig("http://shard-a", "http://shard-b", "http://shard-c", "http://shard-d", "http://shard-e")))
+
+	var moved int
+	for tenant, backend := range four {
+		if five[tenant] == backend {
+			continue
+		}
+		moved++
+		if five[tenant] != "http://shard-e" {
+			t.Fatalf("%s moved from %s to %s instead of the new shard", tenant, backend, five[tenant])
+		}
+	}
+	if share := float64(moved) / 40; math.Abs(share-20) > 5 {
+		t.Errorf("Expected about 1/5 of the tenants to move, got %.1f%%", share)
+	}
+
+	// Removing a shard only moves its own tenants.
+	three := shardsOf(newForklift(t, shardConfig("http://shard-a", "http://shard-c", "http://shard-d")))
+	for tenant, backend := range four {
+		if backend != "http://shard-b" && three[tenant] != backend {
+			t.Fatalf("%s moved from %s to %s when shard-b was removed", tenant, backend, three[tenant])
+		}
+	}
+}
+
+func TestShardByPathParameter(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://default",
+		Rules: []config.RoutingRule{{
+			PathPattern: "/tenants/{tenant}/**",
+			Backend:     "http://fallback",
+			BucketBy:    []string{"param:tenant"},
+			Shard:       config.Shard{Backends: []string{"http://shard-a", "http://shard-b"}, VirtualNodes: 50},
+		}},
+	}
+	handler := newForklift(t, cfg)
+	for i := 0; i < 100; i++ {
+		orders := handler.SelectBackend(httptest.NewRequest("GET", fmt.Sprintf("/tenants/t%d/orders", i), nil), "session-1")
+		invoices := handler.SelectBackend(httptest.NewRequest("GET", fmt.Sprintf("/tenants/t%d/invoices/7", i), nil), "session-2")
+		if orders.Backend != invoices.Backend || orders.Backend == "http://fallback" {
+			t.Fatalf("Expected tenant t%d on one shard, got %s and %s", i, orders.Backend, invoices.Backend)
+		}
+	}
+}
+
+func TestShardValidation(t *testing.T) {
+	shard := config.Shard{Backends: []string{"http://shard-a", "http://shard-b"}}
+	tests := []struct {
+		name string
+		rule config.RoutingRule
+	}{
+		{name: "no backends", rule: config.RoutingRule{Backend: "http://v1", Shard: config.Shard{VirtualNodes: 10}}},
+		{name: "duplicate backends", rule: config.RoutingRule{Backend: "http://v1", Shard: config.Shard{Backends: []string{"http://a", "http://a"}}}},
+		{name: "negative virtualNodes", rule: config.RoutingRule{Backend: "http://v1", Shard: config.Shard{Backends: []string{"http://a"}, VirtualNodes: -1}}},
+		{name: "no fallback backend", rule: config.RoutingRule{Shard: shard}},
+		{name: "shard and percentage", rule: config.RoutingRule{Backend: "http://v1", Percentage: 10, Shard: shard}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.PathPrefix = "/api/"
+			cfg := &config.Config{DefaultBackend: "http://default", Rules: []config.RoutingRule{tt.rule}}
+			if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestRemainderBackend(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://default",
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: "http://v2", Percentage: 10},
+			{Path: "/checkout", Backend: "http://v3", Percentage: 20},
+			{Path: "/checkout", Backend: "http://v1", Remainder: true},
+		},
+	}
+	handler, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		counts[handler.SelectBackend(httptest.NewRequest("GET", "/checkout", nil), fmt.Sprintf("session-%d", i)).Backend]++
+	}
+	for backend, expected := range map[string]float64{"http://v1": 70, "http://v2": 10, "http://v3": 20, "http://default": 0} {
+		if got := float64(counts[backend]) / 20; math.Abs(got-expected) > 3 {
+			t.Errorf("Expected about %.0f%% on %s, got %.1f%%", expected, backend, got)
+		}
+	}
+}
+
+func TestAllocations(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://default",
+		Rules: []config.RoutingRule{
+			{Path: "/search", Backend: "http://v2", Percentage: 30},
+			{Path: "/search", Backend: "http://v3", Percentage: 70, Method: "POST"},
+			{Path: "/search", Backend: "http://v4", Percentage: 10, Method: "GET"},
+			{Path: "/search", Backend: "http://v1", Method: "GET", Remainder: true},
+			{Path: "/about", Backend: "http://v2"},
+		},
+	}
+	handler, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]map[string]float64{
+		"GET":  {"http://v1": 60, "http://v2": 30, "http://v4": 10},
+		"POST": {"http://v2": 30, "http://v3": 70},
+	}
+	allocations := handler.Allocations()
+	if len(allocations) != len(expected) {
+		t.Fatalf("Expected %d allocations, got %+v", len(expected), allocations)
+	}
+	for _, allocation := range allocations {
+		shares := expected[allocation.Method]
+		if allocation.Group != "/search" || len(allocation.Shares) != len(shares) {
+			t.Errorf("Unexpected allocation %+v", allocation)
+			continue
+		}
+		for backend, share := range shares {
+			if math.Abs(allocation.Shares[backend]-share) > 1e-9 {
+				t.Errorf("%s: expected %g%% on %s, got %+v", allocation.Method, share, backend, allocation.Shares)
+			}
+		}
+	}
+}
+
+func TestSplitValidation(t *testing.T) {
+	mobile := config.RuleCondition{Type: "header", Parameter: "X-Device", Operator: "eq", Value: "Mobile"}
+	ramp := config.Ramp{
+		Start: rampStart.Format(time.RFC3339),
+		Steps: []config.RampStep{{Value: 10}, {After: "1h", Value: 60}},
+	}
+	tests := []struct {
+		name  string
+		rules []config.RoutingRule
+	}{
+		{name: "over 100", rules: []config.RoutingRule{
+			{Path: "/a", Backend: "http://v2", Percentage: 80},
+			{Path: "/a", Backend: "http://v3", Percentage: 100},
+		}},
+		{name: "over 100 for a method", rules: []config.RoutingRule{
+			{Path: "/a", Backend: "http://v2", Percentage: 50},
+			{Path: "/a", Backend: "http://v3", Percentage: 60, Method: "GET"},
+		}},
+		{name: "ramp peak over 100", rules: []config.RoutingRule{
+			{Path: "/a", Backend: "http://v2", Percentage: 50},
+			{Path: "/a", Backend: "http://v3", Ramp: ramp},
+		}},
+		{name: "two remainders", rules: []config.RoutingRule{
+			{Path: "/a", Backend: "http://v2", Percentage: 50},
+			{Path: "/a", Backend: "http://v3", Remainder: true},
+			{Path: "/a", Backend: "http://v4", Remainder: true},
+		}},
+		{name: "over 100 with the same conditions", rules: []config.RoutingRule{
+			{Path: "/a", Backend: "http://v2", Percentage: 80, Conditions: []config.RuleCondition{mobile}},
+			{Path: "/a", Backend: "http://v3", Percentage: 80, Conditions: []config.RuleCondition{mobile}},
+		}},
+		{name: "over 100 with a rule without conditions", rules: []config.RoutingRule{
+			{Path: "/a", Backend: "http://v2", Percentage: 80, Conditions: []config.RuleCondition{mobile}},
+			{Path: "/a", Backend: "http://v3", Percentage: 30},
+		}},
+		{name: "remainder with a percentage", rules: []config.RoutingRule{
+			{Path: "/a", Backend: "http://v2", Percentage: 50, Remainder: true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://v1", Rules: tt.rules}
+			if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestSplitsByConditions(t *testing.T) {
+	device := func(value string) []config.RuleCondition {
+		return []config.RuleCondition{{Type: "header", Parameter: "X-Device", Operator: "eq", Value: value}}
+	}
+	cfg := &config.Config{
+		DefaultBackend: "http://default",
+		Rules: []config.RoutingRule{
+			{Path: "/experiment", Method: "GET", Backend: "http://mobile", Percentage: 80, Conditions: device("Mobile")},
+			{Path: "/experiment", Method: "GET", Backend: "http://desktop", Percentage: 80, Conditions: device("Desktop")},
+			{Path: "/experiment", Method: "GET", Backend: "http://v1", Remainder: true},
+		},
+	}
+	handler, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]map[string]float64{
+		"header X-Device eq Mobile":  {"http://mobile": 80, "http://v1": 20},
+		"header X-Device eq Desktop": {"http://desktop": 80, "http://v1": 20},
+	}
+	allocations := handler.Allocations()
+	if len(allocations) != len(expected) {
+		t.Fatalf("Expected %d allocations, got %+v", len(expected), allocations)
+	}
+	for _, allocation := range allocations {
+		shares, ok := expected[allocation.Conditions]
+		if !ok || len(allocation.Shares) != len(shares) {
+			t.Errorf("Unexpected allocation %+v", allocation)
+			continue
+		}
+		for backend, share := range shares {
+			if math.Abs(allocation.Shares[backend]-share) > 1e-9 {
+				t.Errorf("%s: expected %g%% on %s, got %+v", allocation.Conditions, share, backend, allocation.Shares)
+			}
+		}
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		req := httptest.NewRequest("GET", "/experiment", nil)
+		req.Header.Set("X-Device", "Mobile")
+		counts[handler.SelectBackend(req, fmt.Sprintf("session-%d", i)).Backend]++
+	}
+	if got := float64(counts["http://mobile"]) / 20; math.Abs(got-80) > 3 {
+		t.Errorf("Expected about 80%% of mobile requests on http://mobile, got %.1f%%", got)
+	}
+}
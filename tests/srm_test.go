@@ -0,0 +1,152 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+var srmStart = time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC)
+
+// srmConfig sets the default backend of cfg and a short window for the
+// sample ratio test.
+func srmConfig(cfg *config.Config) *config.Config {
+	cfg.DefaultBackend = "http://default"
+	cfg.SampleRatio = config.SampleRatio{Window: "10m", MinDecisions: 500}
+	return cfg
+}
+
+// sampleRatioOf returns the test result of the experiment or rule group.
+func sampleRatioOf(t *testing.T, handler *forklift.Forklift, name string) forklift.SampleRatio {
+	t.Helper()
+	for _, result := range handler.SampleRatios() {
+		if result.Experiment == name || result.Group == name {
+			return result
+		}
+	}
+	t.Fatalf("No sample ratio for %s", name)
+	return forklift.SampleRatio{}
+}
+
+func TestExperimentSampleRatio(t *testing.T) {
+	experiment := config.Experiment{
+		Name:       "search",
+		Allocation: 100,
+		Variants: []config.ExperimentVariant{
+			{Name: "control", Backend: "http://v1", Weight: 80},
+			{Name: "treatment", Backend: "http://v2", Weight: 20},
+		},
+		Routes: []config.ExperimentRoute{{Path: "/search"}},
+	}
+	handler := newForklift(t, srmConfig(&config.Config{Experiments: []config.Experiment{experiment}}), srmStart)
+
+	for i := 0; i < 1000; i++ {
+		handler.SelectBackend(httptest.NewRequest("GET", "/search", nil), fmt.Sprintf("session-%d", i))
+	}
+	result := sampleRatioOf(t, handler, "search")
+	if result.Mismatch {
+		t.Errorf("Expected no mismatch for an untouched split, got %+v", result)
+	}
+	if math.Abs(result.Expected["control"]-800) > 1e-6 || result.Decisions["control"]+result.Decisions["treatment"] != 1000 {
+		t.Errorf("Expected 1000 decisions with 800 expected in control, got %+v", result)
+	}
+
+	// A bot hammering the treatment with a single session skews the split.
+	bot := "session-0"
+	for i := 1; handler.SelectBackend(httptest.NewRequest("GET", "/search", nil), bot).Variant != "treatment"; i++ {
+		bot = fmt.Sprintf("session-%d", i)
+	}
+	for i := 0; i < 300; i++ {
+		handler.SelectBackend(httptest.NewRequest("GET", "/search", nil), bot)
+	}
+	if result := sampleRatioOf(t, handler, "search"); !result.Mismatch || result.PValue >= 0.001 {
+		t.Errorf("Expected a mismatch, got %+v", result)
+	}
+
+	// The skewed decisions leave the window.
+	handler.SetClock(func() time.Time { return srmStart.Add(11 * time.Minute) })
+	if result := sampleRatioOf(t, handler, "search"); result.Mismatch || result.Decisions["treatment"] != 0 {
+		t.Errorf("Expected an empty window, got %+v", result)
+	}
+}
+
+func TestRuleSampleRatio(t *testing.T) {
+	handler := newForklift(t, srmConfig(&config.Config{
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: "http://v2", Percentage: 10},
+			{Path: "/checkout", Backend: "http://v1", Percentage: 60},
+		},
+	}), srmStart)
+
+	for i := 0; i < 2000; i++ {
+		handler.SelectBackend(httptest.NewRequest("GET", "/checkout", nil), fmt.Sprintf("session-%d", i))
+	}
+	result := sampleRatioOf(t, handler, "/checkout")
+	if result.Mismatch {
+		t.Errorf("Expected no mismatch, got %+v", result)
+	}
+	for backend, expected := range map[string]float64{"http://v1": 1200, "http://v2": 200, "http://default": 600} {
+		if math.Abs(result.Expected[backend]-expected) > 1e-6 {
+			t.Errorf("Expected %.0f decisions for %s, got %+v", expected, backend, result.Expected)
+		}
+	}
+
+	bot := "session-0"
+	for i := 1; handler.SelectBackend(httptest.NewRequest("GET", "/checkout", nil), bot).Backend != "http://v2"; i++ {
+		bot = fmt.Sprintf("session-%d", i)
+	}
+	for i := 0; i < 200; i++ {
+		handler.SelectBackend(httptest.NewRequest("GET", "/checkout", nil), bot)
+	}
+	if result := sampleRatioOf(t, handler, "/checkout"); !result.Mismatch {
+		t.Errorf("Expected a mismatch, got %+v", result)
+	}
+}
+
+func TestRuleSampleRatioWithDefaultBackendRule(t *testing.T) {
+	handler := newForklift(t, srmConfig(&config.Config{
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: "http://v2", Percentage: 30},
+			{Path: "/checkout", Backend: "http://default", Percentage: 20},
+		},
+	}), srmStart)
+
+	for i := 0; i < 2000; i++ {
+		handler.SelectBackend(httptest.NewRequest("GET", "/checkout", nil), fmt.Sprintf("session-%d", i))
+	}
+	result := sampleRatioOf(t, handler, "/checkout")
+	if len(result.Decisions) != 2 || math.Abs(result.Expected["http://default"]-1400) > 1e-6 {
+		t.Errorf("Expected the unallocated share in the default backend's cell, got %+v", result)
+	}
+	// Two cells leave one degree of freedom, whose survival function is
+	// erfc(sqrt(x/2)).
+	if expected := math.Erfc(math.Sqrt(result.ChiSquared / 2)); math.Abs(result.PValue-expected) > 1e-6 {
+		t.Errorf("Expected a p-value of %g for one degree of freedom, got %+v", expected, result)
+	}
+}
+
+func TestSampleRatioValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.SampleRatio
+	}{
+		{name: "invalid window", cfg: config.SampleRatio{Window: "hourly"}},
+		{name: "negative minDecisions", cfg: config.SampleRatio{MinDecisions: -1}},
+		{name: "pValue of 1", cfg: config.SampleRatio{PValue: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://default", SampleRatio: tt.cfg}
+			if _, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
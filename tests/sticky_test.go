@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift/config"
+)
+
+const assignmentCookie = "forklift_assignments"
+
+func responseCookie(rr *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestStickyAssignments(t *testing.T) {
+	controlServer := createMockServer("Control Backend")
+	defer controlServer.Close()
+	treatmentServer := createMockServer("Treatment Backend")
+	defer treatmentServer.Close()
+	defaultServer := createMockServer("Default Backend")
+	defer defaultServer.Close()
+
+	newMiddleware := func(secret string, variants ...config.ExperimentVariant) http.Handler {
+		return createMiddleware(t, &config.Config{
+			DefaultBackend:    defaultServer.URL,
+			StickyAssignments: config.StickyAssignments{Secret: secret, MaxAge: "1h"},
+			Experiments: []config.Experiment{{
+				Name: "checkout", Allocation: 100, Variants: variants,
+				Routes: []config.ExperimentRoute{{PathPrefix: "/"}},
+			}},
+		})
+	}
+	// Weights of 100 and 0 make the split predictable.
+	control := config.ExperimentVariant{Name: "control", Backend: controlServer.URL}
+	treatment := config.ExperimentVariant{Name: "treatment", Backend: treatmentServer.URL}
+	controlOnly := config.ExperimentVariant{Name: "control", Backend: controlServer.URL, Weight: 100}
+	treatmentOnly := config.ExperimentVariant{Name: "treatment", Backend: treatmentServer.URL, Weight: 100}
+
+	serve := func(handler http.Handler, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := createTestRequest(t, "GET", "/checkout", nil, nil)
+		req.AddCookie(&http.Cookie{Name: "forklift_id", Value: "session-1"})
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	body := func(rr *httptest.ResponseRecorder) string { return strings.TrimSpace(rr.Body.String()) }
+
+	// A new user gets the current split and an assignment cookie.
+	rr := serve(newMiddleware("secret", controlOnly, treatment))
+	assigned := responseCookie(rr, assignmentCookie)
+	if body(rr) != "Control Backend" || assigned == nil {
+		t.Fatalf("Expected the control variant and an assignment cookie, got %q and %v", body(rr), assigned)
+	}
+	if assigned.MaxAge != 3600 || !assigned.HttpOnly {
+		t.Errorf("Expected an HttpOnly cookie with a max age of 1h, got %+v", assigned)
+	}
+
+	// Moving all traffic to treatment keeps assigned users on control.
+	shifted := newMiddleware("secret", control, treatmentOnly)
+	rr = serve(shifted, assigned)
+	if body(rr) != "Control Backend" {
+		t.Errorf("Expected the sticky control variant, got %q", body(rr))
+	}
+	if responseCookie(rr, assignmentCookie) != nil {
+		t.Error("Expected no new cookie for an unchanged assignment")
+	}
+	if rr = serve(shifted); body(rr) != "Treatment Backend" {
+		t.Errorf("Expected new users to get the current split, got %q", body(rr))
+	}
+
+	// Tampered cookies are ignored.
+	tampered := &http.Cookie{Name: assignmentCookie, Value: "Y2hlY2tvdXQ6Y29udHJvbA.forged"}
+	if rr = serve(shifted, tampered); body(rr) != "Treatment Backend" || responseCookie(rr, assignmentCookie) == nil {
+		t.Errorf("Expected a tampered cookie to be replaced by a new assignment, got %q", body(rr))
+	}
+
+	// Removing the variant reassigns its users.
+	rr = serve(newMiddleware("secret", treatmentOnly), assigned)
+	if body(rr) != "Treatment Backend" || responseCookie(rr, assignmentCookie) == nil {
+		t.Errorf("Expected a removed variant to be reassigned, got %q", body(rr))
+	}
+
+	// Without a secret, nothing is sticky.
+	if rr = serve(newMiddleware("", controlOnly, treatment)); responseCookie(rr, assignmentCookie) != nil {
+		t.Error("Expected no assignment cookie without a secret")
+	}
+	if rr = serve(newMiddleware("other-secret", control, treatmentOnly), assigned); body(rr) != "Treatment Backend" {
+		t.Errorf("Expected a cookie signed with another secret to be ignored, got %q", body(rr))
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/daemonp/forklift"
 	"github.com/daemonp/forklift/config"
@@ -17,6 +18,27 @@ import (
 
 const defaultBufferSize = 1024
 
+// newForklift creates a Forklift middleware for cfg. With a clock time, the
+// middleware's clock is fixed at it.
+func newForklift(t *testing.T, cfg *config.Config, clock ...time.Time) *forklift.Forklift {
+	t.Helper()
+	return newNamedForklift(t, "test", cfg, clock...)
+}
+
+// newNamedForklift is newForklift for a middleware with the given name.
+func newNamedForklift(t *testing.T, name string, cfg *config.Config, clock ...time.Time) *forklift.Forklift {
+	t.Helper()
+	handler, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clock) > 0 {
+		now := clock[0]
+		handler.SetClock(func() time.Time { return now })
+	}
+	return handler
+}
+
 // mockServer is a struct that holds a mock server and its associated response.
 type mockServer struct {
 	server   *httptest.Server